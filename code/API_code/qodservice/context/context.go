@@ -15,20 +15,42 @@
 package qodContext
 
 import (
+	"fmt"
+	"math"
 	"strconv"
 	"time"
 
-	"github.com/sfnuser/dbapi"
+	"github.com/google/uuid"
+	nefAsqSpec "github.com/sfnuser/nef/assessionwithqos"
 	"github.com/sfnuser/qodservice/factory"
 	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/store"
+	"github.com/sfnuser/qodservice/util"
+	"golang.org/x/oauth2"
 )
 
 type OAuth2ServiceCfg struct {
-	AuthServerURL   string
-	IssuerURL       string
-	CacheDuration   time.Duration
-	Audience        []string
-	AuthorizedScope []string
+	AuthServerURL string
+	IssuerURL     string
+	CacheDuration time.Duration
+	Audience      []string
+	AdminScope    string
+	MethodScopes  bool
+	Issuers       []OAuth2IssuerCfg
+}
+
+type OAuth2IssuerCfg struct {
+	IssuerURL  string
+	JwksURL    string
+	Algorithms []string
+	Audience   []string
+}
+
+type NefTlsCfg struct {
+	Env        string // Where the certificates are read from, as the ones of the service
+	CertDir    string
+	RootCaDir  string
+	ServerName string
 }
 
 type OAuth2ClientCfg struct {
@@ -37,6 +59,15 @@ type OAuth2ClientCfg struct {
 	ClientSecret string
 }
 
+type NotifierCfg struct {
+	Workers            int
+	QueueSize          int
+	MaxAttempts        int
+	InitialBackoffSecs int
+	MaxBackoffSecs     int
+	TimeoutSecs        int
+}
+
 // Running Bsf intance qodContext. Any param that is global to
 // replicas of this instance needs to be stored in DB
 type QodContext struct {
@@ -55,9 +86,19 @@ type QodContext struct {
 	NefServiceUrl          string
 	NefSuppFeat            string
 	NefHttpTimeoutSecs     int
+	NefTls                 *NefTlsCfg // Default TLS settings towards NEF if nil
+	InstanceId             string     // Unique per running replica. Used to own DB leases
+	SessionMaxDurationSecs int
+	ExpiryScanIntervalSecs int
+	ExpiryLeaseSecs        int
+	ReconcileIntervalSecs  int  // Not run periodically when negative
+	ReconcileDeleteOrphans bool // The orphaned NEF subscriptions are only reported if false
 	OAuth2Srv              *OAuth2ServiceCfg
 	OAuth2Cli              *OAuth2ClientCfg
-	Db                     *dbapi.DbApi
+	Notifier               *NotifierCfg
+	Db                     store.Store
+	NefClient              *nefAsqSpec.APIClient
+	NefTokenSource         oauth2.TokenSource
 }
 
 var qodContext QodContext
@@ -70,8 +111,10 @@ func InitQodContext() (err error) {
 
 	db := config.Configuration.Db
 	// Connect to DB
-	qodContext.Db = dbapi.NewDbApi(db.Name, db.Url)
-	qodContext.Db.Connect()
+	qodContext.Db, err = store.NewStore(db.Type, db.Name, db.Url)
+	if err != nil {
+		return err
+	}
 
 	qodContext.CompName = configuration.CompName
 	qodContext.UriScheme = configuration.Service.Scheme              // default uri scheme
@@ -83,6 +126,11 @@ func InitQodContext() (err error) {
 	qodContext.NefServiceName = factory.QOD_DEFAULT_NEF_SERVICE
 	qodContext.NefSuppFeat = factory.QOD_DEFAULT_NEF_SUPP_FEAT
 	qodContext.NefHttpTimeoutSecs = factory.QOD_DEFAULT_NEF_HTTP_TIMEOUT_SECS
+	qodContext.InstanceId = uuid.New().String()
+	qodContext.SessionMaxDurationSecs = factory.QOD_DEFAULT_SESSION_MAX_DURATION_SECS
+	qodContext.ExpiryScanIntervalSecs = factory.QOD_DEFAULT_EXPIRY_SCAN_INTERVAL_SECS
+	qodContext.ExpiryLeaseSecs = factory.QOD_DEFAULT_EXPIRY_LEASE_SECS
+	qodContext.ReconcileIntervalSecs = factory.QOD_DEFAULT_RECONCILE_INTERVAL_SECS
 
 	service := configuration.Service
 	if service != nil {
@@ -98,6 +146,9 @@ func InitQodContext() (err error) {
 		if service.BindingDomainName != "" {
 			qodContext.BindingDomainName = service.BindingDomainName
 		}
+		if err = registerCredentialReaders(service.Credentials); err != nil {
+			return err
+		}
 	}
 	nef := configuration.Nef
 	if nef != nil {
@@ -116,16 +167,78 @@ func InitQodContext() (err error) {
 		if nef.TimeoutSecs != 0 {
 			qodContext.NefHttpTimeoutSecs = nef.TimeoutSecs
 		}
+		if nef.Tls != nil {
+			qodContext.NefTls = &NefTlsCfg{
+				CertDir:    nef.Tls.CertDir,
+				RootCaDir:  nef.Tls.RootCaDir,
+				ServerName: nef.Tls.ServerName,
+			}
+			if service != nil {
+				qodContext.NefTls.Env = service.Env
+			}
+		}
+	}
+	session := configuration.Session
+	if session != nil {
+		if session.MaxDurationSecs != 0 {
+			// The durations of the sessions are int32
+			if session.MaxDurationSecs < 0 || session.MaxDurationSecs > math.MaxInt32 {
+				return fmt.Errorf("session maxDurationSecs %v not valid. 1 to %v secs", session.MaxDurationSecs, math.MaxInt32)
+			}
+			qodContext.SessionMaxDurationSecs = session.MaxDurationSecs
+		}
+	}
+	expiry := configuration.Expiry
+	if expiry != nil {
+		if expiry.ScanIntervalSecs != 0 {
+			qodContext.ExpiryScanIntervalSecs = expiry.ScanIntervalSecs
+		}
+		if expiry.LeaseSecs != 0 {
+			qodContext.ExpiryLeaseSecs = expiry.LeaseSecs
+		}
+	}
+	reconcile := configuration.Reconcile
+	if reconcile != nil {
+		if reconcile.IntervalSecs != 0 {
+			qodContext.ReconcileIntervalSecs = reconcile.IntervalSecs
+		}
+		qodContext.ReconcileDeleteOrphans = reconcile.DeleteOrphans
+	}
+	if err = InitQosProfiles(); err != nil {
+		return err
+	}
+	// Zero values are replaced with the notifier defaults
+	qodContext.Notifier = &NotifierCfg{}
+	if configuration.Notifier != nil {
+		qodContext.Notifier = &NotifierCfg{
+			Workers:            configuration.Notifier.Workers,
+			QueueSize:          configuration.Notifier.QueueSize,
+			MaxAttempts:        configuration.Notifier.MaxAttempts,
+			InitialBackoffSecs: configuration.Notifier.InitialBackoffSecs,
+			MaxBackoffSecs:     configuration.Notifier.MaxBackoffSecs,
+			TimeoutSecs:        configuration.Notifier.TimeoutSecs,
+		}
 	}
 	if configuration.OAuth2Srv != nil {
 		qodContext.OAuth2Srv = &OAuth2ServiceCfg{
-			AuthServerURL:   configuration.OAuth2Srv.AuthServerUrl,
-			IssuerURL:       configuration.OAuth2Srv.IssuerUrl,
-			Audience:        make([]string, len(configuration.OAuth2Srv.Audience)),
-			AuthorizedScope: make([]string, len(configuration.OAuth2Srv.AuthorizedScope)),
+			AuthServerURL: configuration.OAuth2Srv.AuthServerUrl,
+			IssuerURL:     configuration.OAuth2Srv.IssuerUrl,
+			Audience:      make([]string, len(configuration.OAuth2Srv.Audience)),
+			AdminScope:    configuration.OAuth2Srv.AdminScope,
+			MethodScopes:  configuration.OAuth2Srv.MethodScopes,
 		}
 		copy(qodContext.OAuth2Srv.Audience, configuration.OAuth2Srv.Audience)
-		copy(qodContext.OAuth2Srv.AuthorizedScope, configuration.OAuth2Srv.AuthorizedScope)
+		for _, issuer := range configuration.OAuth2Srv.Issuers {
+			qodContext.OAuth2Srv.Issuers = append(qodContext.OAuth2Srv.Issuers, OAuth2IssuerCfg{
+				IssuerURL:  issuer.IssuerUrl,
+				JwksURL:    issuer.JwksUrl,
+				Algorithms: append([]string(nil), issuer.Algorithms...),
+				Audience:   append([]string(nil), issuer.Audience...),
+			})
+		}
+		if qodContext.OAuth2Srv.AdminScope == "" {
+			qodContext.OAuth2Srv.AdminScope = factory.QOD_DEFAULT_OAUTH_ADMIN_SCOPE
+		}
 		if configuration.OAuth2Srv.CacheDuration == 0 {
 			qodContext.OAuth2Srv.CacheDuration = factory.QOD_DEFAULT_OAUTH_KEY_CACHE_DURATION_MINS
 		}
@@ -158,16 +271,85 @@ func InitQodContext() (err error) {
 		// Use default scheme ports
 		qodContext.NefServiceUrl = qodContext.NefScheme + "://" + qodContext.NefServiceDomainName
 	}
+	if err = initNefClient(); err != nil {
+		return err
+	}
 
 	logger.Ctx.Info("Init:", logger.LogString("CompName:", qodContext.CompName), logger.LogString("QodServiceUrl:", qodContext.ServiceUrl),
 		logger.LogString("NefServiceUrl:", qodContext.NefServiceUrl))
 	return
 }
 
+// InitQosProfiles sets the QoS profile catalogue of the config. The built-in
+// profiles are kept if the config has none.
+func InitQosProfiles() error {
+	cfgProfiles := factory.QodConfig.Configuration.QosProfiles
+	if len(cfgProfiles) == 0 {
+		return nil
+	}
+	return util.SetQosProfiles(convertQosProfiles(cfgProfiles))
+}
+
+func convertQosProfiles(cfgProfiles []factory.QosProfile) []util.QosProfileInfo {
+	rate := func(r *factory.QosRate) *util.Rate {
+		if r == nil {
+			return nil
+		}
+		return &util.Rate{Value: r.Value, Unit: r.Unit}
+	}
+	duration := func(d *factory.QosDuration) *util.Duration {
+		if d == nil {
+			return nil
+		}
+		return &util.Duration{Value: d.Value, Unit: d.Unit}
+	}
+	profiles := make([]util.QosProfileInfo, 0, len(cfgProfiles))
+	for _, p := range cfgProfiles {
+		profiles = append(profiles, util.QosProfileInfo{
+			Name:                    p.Name,
+			Description:             p.Description,
+			Status:                  p.Status,
+			TargetMinUpstreamRate:   rate(p.TargetMinUpstreamRate),
+			TargetMinDownstreamRate: rate(p.TargetMinDownstreamRate),
+			PacketDelayBudget:       duration(p.PacketDelayBudget),
+			Jitter:                  duration(p.Jitter),
+			PacketErrorLossRate:     p.PacketErrorLossRate,
+			MaxDuration:             duration(p.MaxDuration),
+		})
+	}
+	return profiles
+}
+
 func GetSelf() *QodContext {
 	return &qodContext
 }
 
 func Terminate() {
-	qodContext.Db.Disconnect()
+	qodContext.Db.Close()
+}
+
+// The credential backends that need settings are selectable once configured
+func registerCredentialReaders(credentials *factory.Credentials) error {
+	if credentials == nil {
+		return nil
+	}
+	if credentials.Pkcs12 != nil {
+		util.RegisterPkcs12CredentialReader(credentials.Pkcs12.Password)
+	}
+	if vault := credentials.Vault; vault != nil {
+		err := util.RegisterVaultCredentialReader(util.VaultConfig{
+			Address:  vault.Address,
+			Token:    vault.Token,
+			CaCert:   vault.CaCert,
+			KvMount:  vault.KvMount,
+			PkiMount: vault.PkiMount,
+			PkiRole:  vault.PkiRole,
+			PkiTtl:   vault.PkiTtl,
+			Timeout:  time.Second * time.Duration(vault.TimeoutSecs),
+		})
+		if err != nil {
+			return fmt.Errorf("vault credentials config incorrect. err %v", err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,106 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qodContext
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	nefAsqSpec "github.com/sfnuser/nef/assessionwithqos"
+	"github.com/sfnuser/qodservice/factory"
+	"github.com/sfnuser/qodservice/util"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// One NEF client is shared by all requests. The access token is fetched once and
+// reused until it expires, and the connections to NEF are pooled.
+func initNefClient() error {
+	timeout := time.Second * time.Duration(qodContext.NefHttpTimeoutSecs)
+
+	// Setup OAuth2 client credentials to be accepted by NEF
+	oAuth2Cfg := clientcredentials.Config{
+		ClientID:     qodContext.OAuth2Cli.ClientId,
+		ClientSecret: qodContext.OAuth2Cli.ClientSecret,
+		TokenURL:     qodContext.OAuth2Cli.TokenURL,
+	}
+	// The token endpoint is reached with its own client, the context is kept by the
+	// token source for all the refreshes.
+	tokenCtx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{
+		Timeout: timeout,
+	})
+	qodContext.NefTokenSource = oauth2.ReuseTokenSource(nil, oAuth2Cfg.TokenSource(tokenCtx))
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = factory.QOD_DEFAULT_NEF_MAX_IDLE_CONNS_PER_HOST
+	if qodContext.NefTls != nil {
+		tlsConfig, err := newNefTlsConfig(qodContext.NefTls)
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	configuration := nefAsqSpec.NewConfiguration()
+	// Update APIRoot default server path
+	server := configuration.Servers[0].Variables["apiRoot"]
+	server.DefaultValue = qodContext.NefServiceUrl
+	configuration.Servers[0].Variables["apiRoot"] = server
+	// The timeout is set per request with NefRequestContext
+	configuration.HTTPClient = &http.Client{
+		Transport: transport,
+	}
+	qodContext.NefClient = nefAsqSpec.NewAPIClient(configuration)
+	return nil
+}
+
+// TLS towards NEF with the client certificate (mTLS) and the NEF CA pinned, as configured
+func newNefTlsConfig(cfg *NefTlsCfg) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: cfg.ServerName,
+	}
+	if cfg.CertDir != "" {
+		c, err := util.GetTlsCredentialsWithoutRootCA(cfg.Env, cfg.CertDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get NEF client TLS credentials. error %v", err)
+		}
+		cert, err := tls.X509KeyPair(c.GetMyCert(), c.GetMyKey())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get NEF client X509KeyPair. error %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.RootCaDir != "" {
+		c, err := util.GetTlsRootCA(cfg.Env, cfg.RootCaDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get NEF root CA. error %v", err)
+		}
+		// Only the pinned CA is trusted, not the ones of the system
+		if tlsConfig.RootCAs, err = c.GetRootCAPool(); err != nil {
+			return nil, fmt.Errorf("bad NEF root CA. error %v", err)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// NefRequestContext returns the context for a single NEF request. It carries the
+// shared token source and the NEF request timeout.
+func (c *QodContext) NefRequestContext() (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), nefAsqSpec.ContextOAuth2, c.NefTokenSource)
+	return context.WithTimeout(ctx, time.Second*time.Duration(c.NefHttpTimeoutSecs))
+}
@@ -36,32 +36,92 @@ type Configuration struct {
 	OAuth2Srv *OAuth2Service `yaml:"oauth2Service"` // QoD's OAuth2 service configuration (incoming requests towards QoD)
 	OAuth2Cli *OAuth2Client  `yaml:"oauth2Client"`  // QoD's outgoing request towards NEF
 	Db        *Db            `yaml:"db"`
+	Session   *Session       `yaml:"session,omitempty"`
+	Expiry    *Expiry        `yaml:"expiry,omitempty"`       // Automatic teardown of sessions at expiresAt
+	Notifier  *Notifier      `yaml:"notification,omitempty"` // Delivery of session events to the client notificationUri
+	Reconcile *Reconcile     `yaml:"reconcile,omitempty"`    // Consistency of the sessions with the NEF subscriptions
+	// Catalogue of the qosProfiles offered to the clients. QOS_E/S/M/L if not given
+	QosProfiles []QosProfile `yaml:"qosProfiles,omitempty"`
 }
 
 type Service struct {
-	Scheme             string `yaml:"scheme"`
-	RegisterDomainName string `yaml:"registerDomainName"` // IP/DomainName that is registered at NRF.
-	BindingDomainName  string `yaml:"bindingDomainName"`  // IP/DomainName used to run the server in the node.
-	Port               int    `yaml:"port"`
-	NotifyPort         int    `yaml:"notifyPort,omitempty"` // If notifyPort is not provided then QoD will not subscribe to events from NEF
-	Env                string `yaml:"env"`                  // The cert & key are in local dir or azure cloud
+	Scheme             string       `yaml:"scheme"`
+	RegisterDomainName string       `yaml:"registerDomainName"` // IP/DomainName that is registered at NRF.
+	BindingDomainName  string       `yaml:"bindingDomainName"`  // IP/DomainName used to run the server in the node.
+	Port               int          `yaml:"port"`
+	NotifyPort         int          `yaml:"notifyPort,omitempty"`     // If notifyPort is not provided then QoD will not subscribe to events from NEF
+	Env                string       `yaml:"env"`                      // The cert & key are in local dir or azure cloud
+	MTls               *MTls        `yaml:"mtls,omitempty"`           // Verify the certificates of the clients (https only)
+	NotifyMTls         *MTls        `yaml:"notifyMtls,omitempty"`     // Verify the certificate of NEF on notifyPort (https only)
+	CertReloadSecs     int          `yaml:"certReloadSecs,omitempty"` // How often the cert & key are checked for renewal. Never if negative
+	Credentials        *Credentials `yaml:"credentials,omitempty"`    // Settings of the pkcs12 and vault env
+	Tls                *Tls         `yaml:"tls,omitempty"`            // TLS policy of the https servers
+}
+
+type Tls struct {
+	MinVersion   string   `yaml:"minVersion,omitempty"`   // 1.2 (default) or 1.3
+	CipherSuites []string `yaml:"cipherSuites,omitempty"` // TLS 1.2 cipher suites. ECDHE with AES-GCM or ChaCha20-Poly1305 if absent
+}
+
+type Credentials struct {
+	Pkcs12 *Pkcs12Credentials `yaml:"pkcs12,omitempty"`
+	Vault  *VaultCredentials  `yaml:"vault,omitempty"`
+}
+
+type Pkcs12Credentials struct {
+	Password string `yaml:"password"` // Of the cert.p12 & rootCA.p12 bundles
+}
+
+type VaultCredentials struct {
+	Address     string `yaml:"address,omitempty"`  // VAULT_ADDR if absent
+	Token       string `yaml:"token,omitempty"`    // VAULT_TOKEN if absent
+	CaCert      string `yaml:"caCert,omitempty"`   // PEM file of the CA of Vault
+	KvMount     string `yaml:"kvMount,omitempty"`  // secret if absent
+	PkiMount    string `yaml:"pkiMount,omitempty"` // pki if absent
+	PkiRole     string `yaml:"pkiRole,omitempty"`  // Issue the certs by PKI with the role instead of reading them from KV
+	PkiTtl      string `yaml:"pkiTtl,omitempty"`
+	TimeoutSecs int    `yaml:"timeoutSecs,omitempty"`
+}
+
+type MTls struct {
+	ClientCaDir string `yaml:"clientCaDir"`        // Dir of the rootCA.pem bundle the client certificates are verified with
+	Optional    bool   `yaml:"optional,omitempty"` // Verify a client certificate only if one is presented
+	// Client identity by certificate subject (RFC 2253 string, e.g. CN=app1,O=Org, or only the CN).
+	// It takes the place of the azp / client_id of the token.
+	SubjectClientIds map[string]string `yaml:"subjectClientIds,omitempty"`
 }
 
 type Nef struct {
-	Scheme            string `yaml:"scheme"`
-	ServiceDomainName string `yaml:"serviceDomainName"` // Service domain name
-	ServiceName       string `yaml:"serviceName"`       // Service base URL
-	Port              int    `yaml:"port,omitempty"`
-	SuppFeat          string `yaml:"suppFeatures"`
-	TimeoutSecs       int    `yaml:"timeoutSecs,omitempty"`
+	Scheme            string  `yaml:"scheme"`
+	ServiceDomainName string  `yaml:"serviceDomainName"` // Service domain name
+	ServiceName       string  `yaml:"serviceName"`       // Service base URL
+	Port              int     `yaml:"port,omitempty"`
+	SuppFeat          string  `yaml:"suppFeatures"`
+	TimeoutSecs       int     `yaml:"timeoutSecs,omitempty"`
+	Tls               *NefTls `yaml:"tls,omitempty"` // Client certificate and pinned CA towards NEF
+}
+
+type NefTls struct {
+	CertDir    string `yaml:"certDir,omitempty"`    // Dir of the cert.pem & key.pem presented to NEF. None if empty
+	RootCaDir  string `yaml:"rootCaDir,omitempty"`  // Dir of the rootCA.pem NEF is verified with. System CAs if empty
+	ServerName string `yaml:"serverName,omitempty"` // Name in the NEF certificate if it differs from serviceDomainName
 }
 
 type OAuth2Service struct {
-	AuthServerUrl   string   `yaml:"authServerUrl"`
-	IssuerUrl       string   `yaml:"issuerUrl,omitempty"`
-	CacheDuration   int      `yaml:"cacheDuration,omitempty"`
-	Audience        []string `yaml:"audience"`
-	AuthorizedScope []string `yaml:"authorizedScope"`
+	AuthServerUrl string         `yaml:"authServerUrl"`
+	IssuerUrl     string         `yaml:"issuerUrl,omitempty"`
+	CacheDuration int            `yaml:"cacheDuration,omitempty"`
+	Audience      []string       `yaml:"audience"`
+	AdminScope    string         `yaml:"adminScope,omitempty"`   // Grants the admin API and the sessions of all clients
+	MethodScopes  bool           `yaml:"methodScopes,omitempty"` // Also accept the HTTP method as scope of any route of the method
+	Issuers       []OAuth2Issuer `yaml:"issuers,omitempty"`      // Further trusted authorization servers
+}
+
+type OAuth2Issuer struct {
+	IssuerUrl  string   `yaml:"issuerUrl"`            // Must match the iss claim of the tokens
+	JwksUrl    string   `yaml:"jwksUrl,omitempty"`    // Discovered from the issuerUrl if absent
+	Algorithms []string `yaml:"algorithms,omitempty"` // RS256 if absent
+	Audience   []string `yaml:"audience,omitempty"`   // The audience of oauth2Service if absent
 }
 
 type OAuth2Client struct {
@@ -70,6 +130,52 @@ type OAuth2Client struct {
 	ClientSecret string `yaml:"clientSecret"`
 }
 type Db struct {
+	Type string `yaml:"type,omitempty"` // mongodb (default) or memory
 	Name string `yaml:"name"`
 	Url  string `yaml:"url"`
 }
+
+type Session struct {
+	MaxDurationSecs int `yaml:"maxDurationSecs,omitempty"` // Upper bound of the session duration, including extensions
+}
+
+type Expiry struct {
+	ScanIntervalSecs int `yaml:"scanIntervalSecs,omitempty"` // How often the DB is scanned for expired sessions
+	LeaseSecs        int `yaml:"leaseSecs,omitempty"`        // How long a replica owns an expired session before others may retry it
+}
+
+type Reconcile struct {
+	IntervalSecs  int  `yaml:"intervalSecs,omitempty"`  // How often the sessions are checked against NEF. -1 disables the periodic run
+	DeleteOrphans bool `yaml:"deleteOrphans,omitempty"` // Delete our NEF subscriptions without a session. Only reported if false
+}
+
+type Notifier struct {
+	Workers            int `yaml:"workers,omitempty"`
+	QueueSize          int `yaml:"queueSize,omitempty"`
+	MaxAttempts        int `yaml:"maxAttempts,omitempty"` // Attempts before the notification is stored as failed
+	InitialBackoffSecs int `yaml:"initialBackoffSecs,omitempty"`
+	MaxBackoffSecs     int `yaml:"maxBackoffSecs,omitempty"`
+	TimeoutSecs        int `yaml:"timeoutSecs,omitempty"`
+}
+
+type QosProfile struct {
+	Name                    string       `yaml:"name"`
+	Description             string       `yaml:"description,omitempty"`
+	Status                  string       `yaml:"status,omitempty"` // ACTIVE (default), INACTIVE or DEPRECATED
+	TargetMinUpstreamRate   *QosRate     `yaml:"targetMinUpstreamRate,omitempty"`
+	TargetMinDownstreamRate *QosRate     `yaml:"targetMinDownstreamRate,omitempty"`
+	PacketDelayBudget       *QosDuration `yaml:"packetDelayBudget,omitempty"`
+	Jitter                  *QosDuration `yaml:"jitter,omitempty"`
+	PacketErrorLossRate     *int32       `yaml:"packetErrorLossRate,omitempty"`
+	MaxDuration             *QosDuration `yaml:"maxDuration,omitempty"`
+}
+
+type QosRate struct {
+	Value int32  `yaml:"value"`
+	Unit  string `yaml:"unit"`
+}
+
+type QosDuration struct {
+	Value int32  `yaml:"value"`
+	Unit  string `yaml:"unit"`
+}
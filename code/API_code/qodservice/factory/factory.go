@@ -16,6 +16,7 @@ package factory
 
 import (
 	"io/ioutil"
+	"os"
 
 	"gopkg.in/yaml.v2"
 )
@@ -29,23 +30,41 @@ const (
 	QOD_DEFAULT_NOTIFY_PORT_INT       = 9001
 	QOD_DEFAULT_SERVICE               = "/qod/v0"
 	QOD_DEFAULT_NOTIFICATION_SERVICE  = "/qod/callback/v0"
+	QOD_DEFAULT_ADMIN_SERVICE         = "/qod/admin/v0"
 	QOD_DEFAULT_NEF_IPV4              = "127.0.0.1"
 	QOD_DEFAULT_NEF_SERVICE           = "/3gpp-as-session-with-qos/v1" // QoS Service
 	QOD_DEFAULT_NEF_SUPP_FEAT         = "0"
 	QOD_DEFAULT_NEF_HTTP_TIMEOUT_SECS = 5 // secs
 
+	QOD_DEFAULT_NEF_MAX_IDLE_CONNS_PER_HOST = 32
+
 	QOD_DEFAULT_OAUTH_KEY_CACHE_DURATION_MINS = 5
+	QOD_DEFAULT_OAUTH_ADMIN_SCOPE             = "qod:admin"
+
+	QOD_DEFAULT_SESSION_DURATION_SECS     = 86400 // Seconds in 24hrs
+	QOD_DEFAULT_SESSION_MAX_DURATION_SECS = 86400
+	QOD_DEFAULT_EXPIRY_SCAN_INTERVAL_SECS = 10
+	QOD_DEFAULT_EXPIRY_LEASE_SECS         = 60
+	QOD_DEFAULT_RECONCILE_INTERVAL_SECS   = 300
+	QOD_DEFAULT_CERT_RELOAD_SECS          = 60
+	QOD_DEFAULT_RECONCILE_ORPHAN_AGE_SECS = 60 // An orphan this old can not be a session being created
 )
 
-func InitConfigFactory(f string) error {
+// InitConfigFactory loads the config in layers, each one overriding the former:
+// the defaults, the YAML file f, the QOD_* environment variables and the path=value
+// overrides (of the --set flags)
+func InitConfigFactory(f string, overrides ...string) error {
 	if content, err := ioutil.ReadFile(f); err != nil {
 		return err
 	} else {
-		QodConfig = Config{}
+		QodConfig = defaultConfig()
 
 		if yamlErr := yaml.Unmarshal(content, &QodConfig); yamlErr != nil {
 			return yamlErr
 		}
 	}
-	return nil
+	if err := applyEnvOverrides(&QodConfig, os.LookupEnv); err != nil {
+		return err
+	}
+	return applyFlagOverrides(&QodConfig, overrides)
 }
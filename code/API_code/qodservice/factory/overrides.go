@@ -0,0 +1,220 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	QOD_ENV_PREFIX      = "QOD"   // e.g. QOD_NEF_SERVICEDOMAINNAME for configuration.nef.serviceDomainName
+	QOD_ENV_FILE_SUFFIX = "_FILE" // e.g. QOD_OAUTH2CLIENT_CLIENTSECRET_FILE=/run/secrets/nef-secret
+)
+
+// The config before the YAML file. Any other field left empty gets its QOD_DEFAULT_*
+// value in the qodContext.
+func defaultConfig() Config {
+	return Config{
+		Configuration: &Configuration{
+			Service: &Service{
+				Scheme: "http",
+				Env:    "local",
+			},
+		},
+		Logger: &LogComponents{
+			QodService: &LogSetting{
+				LogLevel: "info",
+			},
+		},
+	}
+}
+
+// The YAML name of the struct field. Empty if the field is not in the YAML.
+func yamlFieldName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// Appends the YAML paths of all the fields that are not structs. A slice or a map is
+// one field.
+func configFieldPaths(t reflect.Type, path []string, paths [][]string) [][]string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlFieldName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		fieldPath := append(append([]string(nil), path...), name)
+		fieldType := t.Field(i).Type
+		if fieldType.Kind() == reflect.Struct ||
+			(fieldType.Kind() == reflect.Ptr && fieldType.Elem().Kind() == reflect.Struct) {
+			paths = configFieldPaths(fieldType, fieldPath, paths)
+		} else {
+			paths = append(paths, fieldPath)
+		}
+	}
+	return paths
+}
+
+// The path of the field within the config from a path relative to the configuration
+// section: nef.port is configuration.nef.port, logger.* stays as is.
+func configPath(path []string) []string {
+	if len(path) > 0 && strings.EqualFold(path[0], "logger") {
+		return path
+	}
+	return append([]string{"configuration"}, path...)
+}
+
+// The environment variable of the field: QOD_ and the path in upper case, without
+// the configuration section
+func configEnvName(path []string) string {
+	if path[0] == "configuration" {
+		path = path[1:]
+	}
+	return QOD_ENV_PREFIX + "_" + strings.ToUpper(strings.Join(path, "_"))
+}
+
+// Sets the field at the path. The sections on the way are created if missing.
+func setConfigField(v reflect.Value, path []string, value string) error {
+	for _, name := range path {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return fmt.Errorf("%v is not a section", name)
+		}
+		found := false
+		for i := 0; i < v.NumField(); i++ {
+			if fieldName := yamlFieldName(v.Type().Field(i)); fieldName != "" && strings.EqualFold(fieldName, name) {
+				v = v.Field(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown field %v", name)
+		}
+	}
+	return setConfigValue(v, value)
+}
+
+// Strings are taken as is. Lists of strings may be comma separated, any other value
+// is read as YAML (e.g. [ ES256, PS256 ] or {name: QOS_E}).
+func setConfigValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid int %q", value)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid uint %q", value)
+		}
+		v.SetUint(u)
+	default:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String &&
+			!strings.HasPrefix(strings.TrimSpace(value), "[") {
+			list := reflect.MakeSlice(v.Type(), 0, 0)
+			for _, item := range strings.Split(value, ",") {
+				list = reflect.Append(list, reflect.ValueOf(strings.TrimSpace(item)).Convert(v.Type().Elem()))
+			}
+			v.Set(list)
+			return nil
+		}
+		parsed := reflect.New(v.Type())
+		if err := yaml.UnmarshalStrict([]byte(value), parsed.Interface()); err != nil {
+			return fmt.Errorf("invalid %v. err %v", v.Type(), err)
+		}
+		v.Set(parsed.Elem())
+	}
+	return nil
+}
+
+// Overrides the fields with the environment variables QOD_<PATH>. A string field
+// may also be read from the file named by QOD_<PATH>_FILE, as the secrets of
+// Docker and Kubernetes are mounted.
+func applyEnvOverrides(config *Config, lookupEnv func(string) (string, bool)) error {
+	root := reflect.ValueOf(config).Elem()
+	for _, path := range configFieldPaths(root.Type(), nil, nil) {
+		name := configEnvName(path)
+		value, ok := lookupEnv(name)
+		fileName, fromFile := lookupEnv(name + QOD_ENV_FILE_SUFFIX)
+		if fromFile {
+			if ok {
+				return fmt.Errorf("both %v and %v%v are set", name, name, QOD_ENV_FILE_SUFFIX)
+			}
+			content, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				return fmt.Errorf("%v%v: %v", name, QOD_ENV_FILE_SUFFIX, err)
+			}
+			// Secret files usually end with a newline which is not part of the secret
+			value, ok = strings.TrimRight(string(content), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+		if err := setConfigField(root, path, value); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Overrides the field of each path=value, the path being the one of the YAML below
+// configuration (e.g. nef.serviceDomainName=nef.example or logger.qodService.logLevel=debug)
+func applyFlagOverrides(config *Config, overrides []string) error {
+	root := reflect.ValueOf(config).Elem()
+	for _, override := range overrides {
+		path, value, ok := strings.Cut(override, "=")
+		if !ok || path == "" {
+			return fmt.Errorf("override %q is not path=value", override)
+		}
+		if err := setConfigField(root, configPath(strings.Split(path, ".")), value); err != nil {
+			return fmt.Errorf("override %v: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package factory
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		get     func(c *Config) interface{}
+		want    interface{}
+		wantErr string
+	}{
+		{
+			name: "string of a section absent from the YAML",
+			env:  map[string]string{"QOD_NEF_SERVICEDOMAINNAME": "nef.example"},
+			get:  func(c *Config) interface{} { return c.Configuration.Nef.ServiceDomainName },
+			want: "nef.example",
+		},
+		{
+			name: "nested sections absent from the YAML",
+			env:  map[string]string{"QOD_SERVICE_CREDENTIALS_VAULT_ADDRESS": "https://vault:8200"},
+			get:  func(c *Config) interface{} { return c.Configuration.Service.Credentials.Vault.Address },
+			want: "https://vault:8200",
+		},
+		{
+			name: "default kept",
+			env:  map[string]string{"QOD_SERVICE_PORT": "8443"},
+			get:  func(c *Config) interface{} { return c.Configuration.Service.Scheme },
+			want: "http",
+		},
+		{
+			name: "logger",
+			env:  map[string]string{"QOD_LOGGER_QODSERVICE_LOGLEVEL": "debug"},
+			get:  func(c *Config) interface{} { return c.Logger.QodService.LogLevel },
+			want: "debug",
+		},
+		{
+			name: "int",
+			env:  map[string]string{"QOD_NEF_PORT": "8443"},
+			get:  func(c *Config) interface{} { return c.Configuration.Nef.Port },
+			want: 8443,
+		},
+		{
+			name:    "bad int",
+			env:     map[string]string{"QOD_NEF_PORT": "http"},
+			wantErr: `QOD_NEF_PORT: invalid int "http"`,
+		},
+		{
+			name: "bool",
+			env:  map[string]string{"QOD_RECONCILE_DELETEORPHANS": "true"},
+			get:  func(c *Config) interface{} { return c.Configuration.Reconcile.DeleteOrphans },
+			want: true,
+		},
+		{
+			name:    "bad bool",
+			env:     map[string]string{"QOD_RECONCILE_DELETEORPHANS": "maybe"},
+			wantErr: `QOD_RECONCILE_DELETEORPHANS: invalid bool "maybe"`,
+		},
+		{
+			name: "comma separated strings",
+			env:  map[string]string{"QOD_OAUTH2SERVICE_AUDIENCE": "qod, qod-admin"},
+			get:  func(c *Config) interface{} { return c.Configuration.OAuth2Srv.Audience },
+			want: []string{"qod", "qod-admin"},
+		},
+		{
+			name: "YAML strings",
+			env:  map[string]string{"QOD_SERVICE_TLS_CIPHERSUITES": "[ TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 ]"},
+			get:  func(c *Config) interface{} { return c.Configuration.Service.Tls.CipherSuites },
+			want: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		},
+		{
+			name: "YAML structs",
+			env:  map[string]string{"QOD_OAUTH2SERVICE_ISSUERS": "[{issuerUrl: https://idp.example, algorithms: [ES256]}]"},
+			get:  func(c *Config) interface{} { return c.Configuration.OAuth2Srv.Issuers },
+			want: []OAuth2Issuer{{IssuerUrl: "https://idp.example", Algorithms: []string{"ES256"}}},
+		},
+		{
+			name:    "YAML structs with an unknown field",
+			env:     map[string]string{"QOD_OAUTH2SERVICE_ISSUERS": "[{issuerUrl: https://idp.example, algos: [ES256]}]"},
+			wantErr: "QOD_OAUTH2SERVICE_ISSUERS: invalid []factory.OAuth2Issuer",
+		},
+		{
+			name: "YAML map",
+			env:  map[string]string{"QOD_SERVICE_MTLS_SUBJECTCLIENTIDS": "{CN=app1: client1}"},
+			get:  func(c *Config) interface{} { return c.Configuration.Service.MTls.SubjectClientIds },
+			want: map[string]string{"CN=app1": "client1"},
+		},
+		{
+			name: "file",
+			env:  map[string]string{"QOD_OAUTH2CLIENT_CLIENTSECRET_FILE": secretFile},
+			get:  func(c *Config) interface{} { return c.Configuration.OAuth2Cli.ClientSecret },
+			want: "s3cret",
+		},
+		{
+			name:    "missing file",
+			env:     map[string]string{"QOD_OAUTH2CLIENT_CLIENTSECRET_FILE": filepath.Join(dir, "missing")},
+			wantErr: "QOD_OAUTH2CLIENT_CLIENTSECRET_FILE: ",
+		},
+		{
+			name: "both value and file",
+			env: map[string]string{
+				"QOD_OAUTH2CLIENT_CLIENTSECRET":      "other",
+				"QOD_OAUTH2CLIENT_CLIENTSECRET_FILE": secretFile,
+			},
+			wantErr: "both QOD_OAUTH2CLIENT_CLIENTSECRET and QOD_OAUTH2CLIENT_CLIENTSECRET_FILE are set",
+		},
+		{
+			name: "unknown variable ignored",
+			env:  map[string]string{"QOD_NEF_UNKNOWN": "1"},
+			get:  func(c *Config) interface{} { return c.Configuration.Nef },
+			want: (*Nef)(nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := defaultConfig()
+			err := applyEnvOverrides(&config, func(name string) (string, bool) {
+				value, ok := tt.env[name]
+				return value, ok
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.get(&config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyFlagOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides []string
+		get       func(c *Config) interface{}
+		want      interface{}
+		wantErr   string
+	}{
+		{
+			name:      "string",
+			overrides: []string{"nef.serviceDomainName=nef.example"},
+			get:       func(c *Config) interface{} { return c.Configuration.Nef.ServiceDomainName },
+			want:      "nef.example",
+		},
+		{
+			name:      "path in any case",
+			overrides: []string{"NEF.servicedomainname=nef.example"},
+			get:       func(c *Config) interface{} { return c.Configuration.Nef.ServiceDomainName },
+			want:      "nef.example",
+		},
+		{
+			name:      "value with =",
+			overrides: []string{"oauth2Client.clientSecret=a=b"},
+			get:       func(c *Config) interface{} { return c.Configuration.OAuth2Cli.ClientSecret },
+			want:      "a=b",
+		},
+		{
+			name:      "last one wins",
+			overrides: []string{"nef.port=80", "nef.port=8443"},
+			get:       func(c *Config) interface{} { return c.Configuration.Nef.Port },
+			want:      8443,
+		},
+		{
+			name:      "logger",
+			overrides: []string{"logger.qodService.logLevel=debug"},
+			get:       func(c *Config) interface{} { return c.Logger.QodService.LogLevel },
+			want:      "debug",
+		},
+		{
+			name:      "comma separated strings",
+			overrides: []string{"oauth2Service.issuers=[{issuerUrl: https://idp.example, audience: [qod]}]", "oauth2Service.audience=a,b"},
+			get: func(c *Config) interface{} {
+				return []interface{}{c.Configuration.OAuth2Srv.Audience, c.Configuration.OAuth2Srv.Issuers}
+			},
+			want: []interface{}{[]string{"a", "b"}, []OAuth2Issuer{{IssuerUrl: "https://idp.example", Audience: []string{"qod"}}}},
+		},
+		{
+			name:      "bad bool",
+			overrides: []string{"service.mtls.optional=yes please"},
+			wantErr:   `override service.mtls.optional: invalid bool "yes please"`,
+		},
+		{
+			name:      "unknown path",
+			overrides: []string{"nef.unknown=1"},
+			wantErr:   "override nef.unknown: unknown field unknown",
+		},
+		{
+			name:      "path below a value",
+			overrides: []string{"nef.port.value=1"},
+			wantErr:   "override nef.port.value: value is not a section",
+		},
+		{
+			name:      "no value",
+			overrides: []string{"nef.port"},
+			wantErr:   `override "nef.port" is not path=value`,
+		},
+		{
+			name:      "no path",
+			overrides: []string{"=1"},
+			wantErr:   `override "=1" is not path=value`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := defaultConfig()
+			err := applyFlagOverrides(&config, tt.overrides)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.get(&config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
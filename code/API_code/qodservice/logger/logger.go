@@ -32,6 +32,7 @@ var (
 	Ctx   *zap.Logger
 	Util  *zap.Logger
 	Gin   *zap.Logger
+	Auth  *zap.Logger
 )
 
 const (
@@ -108,6 +109,7 @@ func Initialize(env string) {
 	Api = Log.Named("[Api]")
 	Ctx = Log.Named("[Ctx]")
 	Gin = Log.Named("[Gin]")
+	Auth = Log.Named("[Auth]")
 
 }
 
@@ -0,0 +1,297 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+)
+
+// Some defaults when the values are not configured
+const (
+	defaultWorkers        = 4
+	defaultQueueSize      = 1024
+	defaultMaxAttempts    = 5
+	defaultInitialBackoff = 1 * time.Second
+	defaultMaxBackoff     = 60 * time.Second
+	defaultHttpTimeout    = 5 * time.Second
+)
+
+// Session events sent to the client. SESSION_TERMINATED is the only event of QoD v0.8.
+// QOS_STATUS_CHANGED carries the network side QoS changes as in the later QoD versions.
+const (
+	SESSION_TERMINATED api.SessionEvent = api.SESSION_TERMINATED
+	QOS_STATUS_CHANGED api.SessionEvent = "QOS_STATUS_CHANGED"
+)
+
+// QoS status of the session as seen by the network
+const (
+	QOS_STATUS_AVAILABLE   = "AVAILABLE"
+	QOS_STATUS_UNAVAILABLE = "UNAVAILABLE"
+)
+
+// Reason why the QoS status changed
+const (
+	STATUS_INFO_DURATION_EXPIRED   = "DURATION_EXPIRED"
+	STATUS_INFO_NETWORK_TERMINATED = "NETWORK_TERMINATED"
+	STATUS_INFO_DELETE_REQUESTED   = "DELETE_REQUESTED"
+)
+
+// Config related to delivery of notifications towards the clients
+type Config struct {
+	Workers        int           // Number of concurrent deliveries
+	QueueSize      int           // Notifications waiting for a worker. Send fails when full
+	MaxAttempts    int           // Attempts per notification before it is given up
+	InitialBackoff time.Duration // Wait before the first retry. Doubled on every retry
+	MaxBackoff     time.Duration // Upper bound of the wait between retries
+	HttpTimeout    time.Duration // Timeout of a single attempt
+}
+
+// QosNotification is posted to the notificationUri of the session. It is the
+// api.Notification of QoD v0.8 with the QoS status details of the later versions.
+type QosNotification struct {
+	SessionId  string           `json:"sessionId"`
+	Event      api.SessionEvent `json:"event"`
+	QosStatus  string           `json:"qosStatus,omitempty"`
+	StatusInfo string           `json:"statusInfo,omitempty"`
+}
+
+// Delivery is a notification towards one client
+type Delivery struct {
+	NotificationUri string
+	AuthToken       string // Sent as bearer token when present
+	Notification    *QosNotification
+	Attempts        int    // Attempts made so far
+	LastError       string // Reason of the last failed attempt
+}
+
+// FailureHandler is called with the deliveries that are given up
+type FailureHandler func(d *Delivery)
+
+type Notifier struct {
+	Conf      Config
+	cli       *http.Client
+	onFailure FailureHandler
+	queue     chan *Delivery
+	stop      chan struct{}
+	wg        sync.WaitGroup // Workers and retries that fired
+	mtx       sync.Mutex
+	stopped   bool
+	retries   map[*Delivery]*time.Timer // Deliveries waiting for a retry
+}
+
+var errPermanent = errors.New("permanent failure")
+
+func New(conf *Config, onFailure FailureHandler) *Notifier {
+	n := &Notifier{
+		Conf:      *conf,
+		onFailure: onFailure,
+	}
+	if n.Conf.Workers <= 0 {
+		n.Conf.Workers = defaultWorkers
+	}
+	if n.Conf.QueueSize <= 0 {
+		n.Conf.QueueSize = defaultQueueSize
+	}
+	if n.Conf.MaxAttempts <= 0 {
+		n.Conf.MaxAttempts = defaultMaxAttempts
+	}
+	if n.Conf.InitialBackoff <= 0 {
+		n.Conf.InitialBackoff = defaultInitialBackoff
+	}
+	if n.Conf.MaxBackoff <= 0 {
+		n.Conf.MaxBackoff = defaultMaxBackoff
+	}
+	if n.Conf.HttpTimeout <= 0 {
+		n.Conf.HttpTimeout = defaultHttpTimeout
+	}
+	n.cli = &http.Client{
+		Timeout: n.Conf.HttpTimeout,
+	}
+	n.queue = make(chan *Delivery, n.Conf.QueueSize)
+	n.stop = make(chan struct{})
+	n.retries = make(map[*Delivery]*time.Timer)
+	return n
+}
+
+// Start the delivery workers
+func (n *Notifier) Start() {
+	for i := 0; i < n.Conf.Workers; i++ {
+		n.wg.Add(1)
+		go n.worker()
+	}
+}
+
+// Stop the workers. Deliveries still queued or waiting for a retry are given up
+// before Stop returns, the FailureHandler is not called after.
+func (n *Notifier) Stop() {
+	n.mtx.Lock()
+	if n.stopped {
+		n.mtx.Unlock()
+		return
+	}
+	n.stopped = true
+	close(n.stop)
+	var pending []*Delivery
+	for d, timer := range n.retries {
+		// A retry that fired already is given up by itself
+		if timer.Stop() {
+			delete(n.retries, d)
+			pending = append(pending, d)
+			n.wg.Done()
+		}
+	}
+	n.mtx.Unlock()
+
+	n.wg.Wait()
+	for _, d := range pending {
+		n.giveUp(d, "notifier stopped")
+	}
+	for {
+		select {
+		case d := <-n.queue:
+			n.giveUp(d, "notifier stopped")
+		default:
+			return
+		}
+	}
+}
+
+// Send queues the delivery. It does not wait for the delivery to complete.
+func (n *Notifier) Send(d *Delivery) error {
+	if d.NotificationUri == "" {
+		return errors.New("empty notificationUri")
+	}
+	return n.enqueue(d)
+}
+
+func (n *Notifier) enqueue(d *Delivery) error {
+	reason := "notifier stopped"
+	n.mtx.Lock()
+	if !n.stopped {
+		select {
+		case n.queue <- d:
+			n.mtx.Unlock()
+			return nil
+		default:
+			reason = "notifier queue full"
+		}
+	}
+	n.mtx.Unlock()
+
+	n.giveUp(d, reason)
+	return errors.New(reason)
+}
+
+func (n *Notifier) worker() {
+	defer n.wg.Done()
+	for {
+		select {
+		case d := <-n.queue:
+			n.attempt(d)
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+func (n *Notifier) attempt(d *Delivery) {
+	d.Attempts++
+	err := n.post(d)
+	if err == nil {
+		return
+	}
+	d.LastError = err.Error()
+	if errors.Is(err, errPermanent) || d.Attempts >= n.Conf.MaxAttempts {
+		n.giveUp(d, d.LastError)
+		return
+	}
+	n.retryLater(d)
+}
+
+// Retry later without holding up the worker
+func (n *Notifier) retryLater(d *Delivery) {
+	n.mtx.Lock()
+	if n.stopped {
+		n.mtx.Unlock()
+		n.giveUp(d, "notifier stopped")
+		return
+	}
+	n.wg.Add(1)
+	n.retries[d] = time.AfterFunc(n.backoff(d.Attempts), func() {
+		defer n.wg.Done()
+		n.mtx.Lock()
+		delete(n.retries, d)
+		n.mtx.Unlock()
+		n.enqueue(d)
+	})
+	n.mtx.Unlock()
+}
+
+// Exponential backoff with jitter of up to a quarter of the wait
+func (n *Notifier) backoff(attempts int) time.Duration {
+	wait := n.Conf.InitialBackoff
+	for i := 1; i < attempts && wait < n.Conf.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > n.Conf.MaxBackoff {
+		wait = n.Conf.MaxBackoff
+	}
+	return wait + time.Duration(rand.Int63n(int64(wait)/4+1))
+}
+
+func (n *Notifier) post(d *Delivery) error {
+	body, err := json.Marshal(d.Notification)
+	if err != nil {
+		return fmt.Errorf("%w: failed to encode notification. err %v", errPermanent, err)
+	}
+	req, err := http.NewRequest(http.MethodPost, d.NotificationUri, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: bad notificationUri. err %v", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+d.AuthToken)
+	}
+	rsp, err := n.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return nil
+	}
+	// The client rejected the notification. Retrying will not help
+	if rsp.StatusCode >= 400 && rsp.StatusCode < 500 &&
+		rsp.StatusCode != http.StatusRequestTimeout && rsp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: statusCode %v", errPermanent, rsp.StatusCode)
+	}
+	return fmt.Errorf("statusCode %v", rsp.StatusCode)
+}
+
+func (n *Notifier) giveUp(d *Delivery, reason string) {
+	d.LastError = reason
+	if n.onFailure != nil {
+		n.onFailure(d)
+	}
+}
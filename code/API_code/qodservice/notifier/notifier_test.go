@@ -0,0 +1,282 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testReceiver answers the notifications with the statuses in turn, the last one repeated
+type testReceiver struct {
+	mu            sync.Mutex
+	statuses      []int
+	notifications []QosNotification
+	authHeaders   []string
+	delivered     chan struct{} // Signalled on every 2xx answer
+	block         chan struct{} // If set, the answers wait for it to be closed
+}
+
+func newTestReceiver(t *testing.T, statuses ...int) (*testReceiver, *httptest.Server) {
+	rcv := &testReceiver{statuses: statuses, delivered: make(chan struct{}, 16)}
+	srv := httptest.NewServer(rcv)
+	t.Cleanup(srv.Close)
+	return rcv, srv
+}
+
+func (rcv *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var notification QosNotification
+	json.NewDecoder(r.Body).Decode(&notification)
+	rcv.mu.Lock()
+	rcv.notifications = append(rcv.notifications, notification)
+	rcv.authHeaders = append(rcv.authHeaders, r.Header.Get("Authorization"))
+	status := rcv.statuses[0]
+	if len(rcv.statuses) > 1 {
+		rcv.statuses = rcv.statuses[1:]
+	}
+	block := rcv.block
+	rcv.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	w.WriteHeader(status)
+	if status >= 200 && status < 300 {
+		rcv.delivered <- struct{}{}
+	}
+}
+
+func (rcv *testReceiver) attempts() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.notifications)
+}
+
+// testFailures collects the given up deliveries
+type testFailures chan *Delivery
+
+func (f testFailures) handler(d *Delivery) {
+	f <- d
+}
+
+func newTestDelivery(uri string) *Delivery {
+	return &Delivery{
+		NotificationUri: uri,
+		AuthToken:       "token1",
+		Notification: &QosNotification{
+			SessionId:  "session1",
+			Event:      SESSION_TERMINATED,
+			QosStatus:  QOS_STATUS_UNAVAILABLE,
+			StatusInfo: STATUS_INFO_NETWORK_TERMINATED,
+		},
+	}
+}
+
+var testConf = Config{
+	Workers:        2,
+	MaxAttempts:    3,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     20 * time.Millisecond,
+	HttpTimeout:    time.Second,
+}
+
+func TestNotifierDelivery(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+		wantError    string // Of the given up delivery. Delivered if empty
+	}{
+		{"delivered", []int{http.StatusNoContent}, 1, ""},
+		{"retried on 5xx", []int{http.StatusServiceUnavailable, http.StatusOK}, 2, ""},
+		{"retried on 408 and 429", []int{http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusOK}, 3, ""},
+		{"given up on 400", []int{http.StatusBadRequest}, 1, "permanent failure: statusCode 400"},
+		{"given up on 404", []int{http.StatusNotFound}, 1, "permanent failure: statusCode 404"},
+		{"given up after the attempts", []int{http.StatusInternalServerError}, 3, "statusCode 500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv, srv := newTestReceiver(t, tt.statuses...)
+			failures := make(testFailures, 1)
+			n := New(&testConf, failures.handler)
+			n.Start()
+			defer n.Stop()
+
+			if err := n.Send(newTestDelivery(srv.URL)); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-rcv.delivered:
+				if tt.wantError != "" {
+					t.Fatalf("delivered, want %q", tt.wantError)
+				}
+			case d := <-failures:
+				if d.LastError != tt.wantError || d.Attempts != tt.wantAttempts {
+					t.Fatalf("given up after %v attempts with %q, want %v attempts with %q",
+						d.Attempts, d.LastError, tt.wantAttempts, tt.wantError)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out")
+			}
+			if attempts := rcv.attempts(); attempts != tt.wantAttempts {
+				t.Errorf("attempts %v, want %v", attempts, tt.wantAttempts)
+			}
+			rcv.mu.Lock()
+			defer rcv.mu.Unlock()
+			if got := rcv.notifications[0]; got != *newTestDelivery("").Notification {
+				t.Errorf("notification %+v", got)
+			}
+			if rcv.authHeaders[0] != "Bearer token1" {
+				t.Errorf("Authorization %q", rcv.authHeaders[0])
+			}
+		})
+	}
+}
+
+func TestNotifierBackoff(t *testing.T) {
+	n := New(&Config{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}, nil)
+	tests := []struct {
+		attempts int
+		min      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 10; i++ {
+			// Up to a quarter of jitter
+			if wait := n.backoff(tt.attempts); wait < tt.min || wait > tt.min+tt.min/4 {
+				t.Errorf("backoff of %v attempts %v, want %v plus up to a quarter", tt.attempts, wait, tt.min)
+			}
+		}
+	}
+}
+
+func TestNotifierQueueFull(t *testing.T) {
+	rcv, srv := newTestReceiver(t, http.StatusOK)
+	rcv.block = make(chan struct{})
+	failures := make(testFailures, 1)
+	n := New(&Config{Workers: 1, QueueSize: 1}, failures.handler)
+	n.Start()
+	defer n.Stop()
+
+	// The worker is held up by the first, the second waits in the queue
+	if err := n.Send(newTestDelivery(srv.URL)); err != nil {
+		t.Fatal(err)
+	}
+	for rcv.attempts() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := n.Send(newTestDelivery(srv.URL)); err != nil {
+		t.Fatal(err)
+	}
+	full := newTestDelivery(srv.URL)
+	if err := n.Send(full); err == nil || err.Error() != "notifier queue full" {
+		t.Fatalf("error %v, want notifier queue full", err)
+	}
+	if d := <-failures; d != full || d.LastError != "notifier queue full" || d.Attempts != 0 {
+		t.Errorf("given up %+v, want the third delivery", d)
+	}
+	close(rcv.block)
+	for i := 0; i < 2; i++ {
+		<-rcv.delivered
+	}
+}
+
+func TestNotifierStop(t *testing.T) {
+	rcv, srv := newTestReceiver(t, http.StatusServiceUnavailable)
+	failures := make(testFailures, 2)
+	conf := testConf
+	conf.InitialBackoff = time.Hour
+	conf.MaxBackoff = time.Hour
+	n := New(&conf, failures.handler)
+	n.Start()
+
+	if err := n.Send(&Delivery{}); err == nil {
+		t.Error("empty notificationUri sent")
+	}
+	waiting := newTestDelivery(srv.URL)
+	if err := n.Send(waiting); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the retry to be scheduled
+	for {
+		n.mtx.Lock()
+		scheduled := len(n.retries)
+		n.mtx.Unlock()
+		if scheduled == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	n.Stop()
+	n.Stop()
+	// The delivery waiting for its retry is given up before Stop returns
+	select {
+	case d := <-failures:
+		if d != waiting || d.LastError != "notifier stopped" || d.Attempts != 1 {
+			t.Errorf("given up %+v, want the waiting delivery", d)
+		}
+	default:
+		t.Fatal("waiting delivery not given up")
+	}
+	if rcv.attempts() != 1 {
+		t.Errorf("attempts %v, want 1", rcv.attempts())
+	}
+
+	if err := n.Send(newTestDelivery(srv.URL)); err == nil || err.Error() != "notifier stopped" {
+		t.Errorf("error %v, want notifier stopped", err)
+	}
+	<-failures
+	select {
+	case d := <-failures:
+		t.Errorf("given up %+v after Stop", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// A retry that fires while stopping is given up before Stop returns
+func TestNotifierStopRetrying(t *testing.T) {
+	_, srv := newTestReceiver(t, http.StatusServiceUnavailable)
+	failures := make(testFailures, 64)
+	conf := testConf
+	conf.MaxAttempts = 1000
+	conf.InitialBackoff = time.Millisecond
+	conf.MaxBackoff = time.Millisecond
+	n := New(&conf, failures.handler)
+	n.Start()
+
+	for i := 0; i < 8; i++ {
+		if err := n.Send(newTestDelivery(srv.URL)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	n.Stop()
+	if len(failures) != 8 {
+		t.Fatalf("%v given up by Stop, want 8", len(failures))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(failures) != 8 {
+		t.Errorf("%v given up after Stop, want 8", len(failures))
+	}
+}
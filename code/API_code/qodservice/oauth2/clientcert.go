@@ -0,0 +1,44 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Key of the client identity taken from the TLS client certificate
+const CertClientIdKey = "oauth2.certClientId"
+
+// ClientCertIdentity returns the handler that takes the client identity of the
+// request from its verified TLS client certificate. The subject of the certificate
+// is looked up in subjectClientIds by its RFC 2253 string (e.g. CN=app1,O=Org) and
+// then by its common name. Requests of unmapped certificates keep the identity of
+// the token.
+func ClientCertIdentity(subjectClientIds map[string]string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		tlsState := ctx.Request.TLS
+		if tlsState != nil && len(tlsState.VerifiedChains) > 0 {
+			subject := tlsState.VerifiedChains[0][0].Subject
+			clientId, ok := subjectClientIds[subject.String()]
+			if !ok && subject.CommonName != "" {
+				clientId, ok = subjectClientIds[subject.CommonName]
+			}
+			if ok {
+				ctx.Set(CertClientIdKey, clientId)
+			}
+		}
+		ctx.Next()
+	}
+}
@@ -18,7 +18,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -28,46 +27,182 @@ import (
 	"github.com/auth0/go-jwt-middleware/v2/jwks"
 	"github.com/auth0/go-jwt-middleware/v2/validator"
 	"github.com/gin-gonic/gin"
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/util"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 // Some defaults when the values are not configured
 const (
 	defaultCacheDuration time.Duration = 5 * time.Minute
+	defaultAlgorithm                   = validator.RS256
 )
 
+// Signature algorithms a trusted issuer may sign the tokens with. The symmetric
+// HS* algorithms are left out as the keys are fetched from the JWKS of the issuer.
+var supportedAlgorithms = map[string]validator.SignatureAlgorithm{
+	"RS256": validator.RS256,
+	"RS384": validator.RS384,
+	"RS512": validator.RS512,
+	"ES256": validator.ES256,
+	"ES384": validator.ES384,
+	"ES512": validator.ES512,
+	"PS256": validator.PS256,
+	"PS384": validator.PS384,
+	"PS512": validator.PS512,
+	"EdDSA": validator.EdDSA,
+}
+
+// Keys of the OAuth2 client identity, its scopes and its admin privilege in the
+// gin.Context of a validated request
+const (
+	ClientIdKey = "oauth2.clientId"
+	ScopesKey   = "oauth2.scopes"
+	AdminKey    = "oauth2.admin"
+
+	methodScopeKey = "oauth2.methodScope" // The token has the HTTP method as scope
+)
+
+// A valid token without any scope is refused the same as one lacking the scope of the route
+var errScopeMissing = errors.New("scope claim missing")
+
+// Key of the context of the request under which the error of the JWT validation is kept
+type authErrorKey struct{}
+
 // Config related to JWT based OAuth2 Authorization
 type Config struct {
 	AuthServerURL       string        // URL of the Auth server (e.g. http://oauthserver:8080/realms/sfn.nef for KeyCloak)
 	IssuerURL           string        // In case when Auth Server exposes an external or different IssuerURL. If empty AuthServerURL will be used
 	PubKeyCacheDuration time.Duration // Duration to store the RSA Pubic Key
 	Audience            []string      // The intended Audience the AccessToken should have (as configured in AuthServer)
-	AuthorizedScope     []string      // Allowed scopes to be validated against. At this point they MUST have http.Methods to be validated with route
+	AdminScope          string        // Scope that grants access to the sessions of all clients. None if empty
+	// Also accept the HTTP method of the request as scope, as before the scopes per route
+	MethodScopes bool
+	// Further authorization servers whose tokens are accepted. The issuer of a token
+	// is picked by its iss claim. AuthServerURL, if set, is trusted as the first one.
+	Issuers []Issuer
+}
+
+// A trusted authorization server
+type Issuer struct {
+	IssuerURL  string   // Must match the iss claim of the tokens
+	JwksURL    string   // If empty, discovered from the .well-known/openid-configuration of IssuerURL
+	Algorithms []string // Signature algorithms of the tokens (e.g. RS256, ES256, PS256). RS256 if empty
+	Audience   []string // The intended Audience of the tokens. Config Audience if empty
 }
 
 type AudienceCustomClaims struct {
-	Scope           string   `json:"scope"` // This is a mandatory claim that MUST be present in the token
-	authorizedScope []string // Not exported
+	Scope    string `json:"scope"`               // This is a mandatory claim that MUST be present in the token
+	Azp      string `json:"azp,omitempty"`       // Authorized party. The client the token was issued to
+	ClientId string `json:"client_id,omitempty"` // RFC 9068 client identifier. Used when azp is absent
 }
 
 type OAuth2Provider struct {
 	Conf Config
 }
 
+// The scopes a route needs are checked by RequireScopes. Scopes the routes do not
+// know of are allowed, tokens are often issued for other APIs as well.
 func (a *AudienceCustomClaims) Validate(ctx context.Context) error {
-	scope := strings.Split(a.Scope, " ")
-	for i := range scope {
-		var scopeValidated bool = false
-		for j := range a.authorizedScope {
-			if scope[i] == a.authorizedScope[j] {
-				scopeValidated = true
-				break
-			}
+	if len(a.GetScopes()) == 0 {
+		return errScopeMissing
+	}
+	return nil
+}
+
+func (a *AudienceCustomClaims) GetScopes() []string {
+	return strings.Fields(a.Scope)
+}
+
+// Identity of the OAuth2 client the token was issued to
+func (a *AudienceCustomClaims) GetClientId() string {
+	if a.Azp != "" {
+		return a.Azp
+	}
+	return a.ClientId
+}
+
+// GetClientId returns the OAuth2 client identity of the validated request. The
+// identity mapped from the TLS client certificate, if any, takes precedence.
+func GetClientId(ctx *gin.Context) string {
+	if clientId := ctx.GetString(CertClientIdKey); clientId != "" {
+		return clientId
+	}
+	return ctx.GetString(ClientIdKey)
+}
+
+// IsAdmin tells if the token of the validated request has the admin scope
+func IsAdmin(ctx *gin.Context) bool {
+	return ctx.GetBool(AdminKey)
+}
+
+// RequireAdmin returns the handler that lets the request of a validated token
+// through only if the token has the admin scope
+func RequireAdmin() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !IsAdmin(ctx) {
+			abortPermissionDenied(ctx, "Insufficient scope, the admin scope is needed")
+			return
 		}
-		if !scopeValidated {
-			return fmt.Errorf("scope %v is not allowed", scope[i])
+		ctx.Next()
+	}
+}
+
+// RequireScopes returns the handler that lets the request of a validated token
+// through only if the token has any of the scopes. It is added to the route
+// after the AuthorizationMiddleware.
+func RequireScopes(scopes ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.GetBool(methodScopeKey) {
+			ctx.Next()
+			return
 		}
+		tokenScopes := ctx.GetStringSlice(ScopesKey)
+		for _, scope := range scopes {
+			for _, tokenScope := range tokenScopes {
+				if scope == tokenScope {
+					ctx.Next()
+					return
+				}
+			}
+		}
+		abortPermissionDenied(ctx, fmt.Sprintf("Insufficient scope, one of %v is needed", scopes), scopes...)
 	}
-	return nil
+}
+
+// abortUnauthenticated answers 401 with the RFC 6750 challenge. The cause of an
+// invalid token is logged only, it is not disclosed to the client.
+func abortUnauthenticated(ctx *gin.Context, err error) {
+	challenge := `Bearer realm="qod"`
+	message := "Request not authenticated due to missing, invalid, or expired credentials"
+	if err != nil && !errors.Is(err, jwtmiddleware.ErrJWTMissing) {
+		challenge += `, error="invalid_token", error_description="The access token is invalid or expired"`
+	}
+	logger.Auth.Sugar().Infof("%v %v unauthenticated. err %v", ctx.Request.Method, ctx.Request.URL.Path, err)
+	abortWithErrorInfo(ctx, challenge, &api.ErrorInfo{
+		Code:    util.UNAUTHENTICATED,
+		Message: message,
+	})
+}
+
+// abortPermissionDenied answers 403 with the RFC 6750 insufficient_scope challenge
+func abortPermissionDenied(ctx *gin.Context, message string, scopes ...string) {
+	challenge := `Bearer realm="qod", error="insufficient_scope"`
+	if len(scopes) > 0 {
+		challenge += fmt.Sprintf(`, scope="%s"`, strings.Join(scopes, " "))
+	}
+	logger.Auth.Sugar().Infof("%v %v permission denied to client %v. %v",
+		ctx.Request.Method, ctx.Request.URL.Path, GetClientId(ctx), message)
+	abortWithErrorInfo(ctx, challenge, &api.ErrorInfo{
+		Code:    util.PERMISSION_DENIED,
+		Message: message,
+	})
+}
+
+func abortWithErrorInfo(ctx *gin.Context, challenge string, errInfo *api.ErrorInfo) {
+	ctx.Header("WWW-Authenticate", challenge)
+	ctx.AbortWithStatusJSON(util.ConvertErrorToHttpStatusCode(errInfo.Code), errInfo)
 }
 
 func New(conf *Config) (*OAuth2Provider, error) {
@@ -75,59 +210,153 @@ func New(conf *Config) (*OAuth2Provider, error) {
 		Conf: *conf,
 	}
 	// Sanity checks
-	if conf.AuthServerURL == "" {
+	if conf.AuthServerURL == "" && len(conf.Issuers) == 0 {
 		return nil, errors.New("invalid authserverURL")
 	}
 	if conf.PubKeyCacheDuration == 0 {
 		auth.Conf.PubKeyCacheDuration = defaultCacheDuration
 	}
-	if len(conf.Audience) == 0 {
+	if conf.AuthServerURL != "" && len(conf.Audience) == 0 {
 		return nil, errors.New("invalid audience")
 	}
-	if conf.AuthorizedScope == nil {
-		return nil, errors.New("invalid scope")
+	auth.Conf.Issuers = make([]Issuer, 0, len(conf.Issuers))
+	for _, issuer := range conf.Issuers {
+		if issuer.IssuerURL == "" {
+			return nil, errors.New("invalid issuerURL")
+		}
+		if len(issuer.Audience) == 0 {
+			if len(conf.Audience) == 0 {
+				return nil, fmt.Errorf("invalid audience of issuer %v", issuer.IssuerURL)
+			}
+			issuer.Audience = conf.Audience
+		}
+		if len(issuer.Algorithms) == 0 {
+			issuer.Algorithms = []string{string(defaultAlgorithm)}
+		}
+		for _, alg := range issuer.Algorithms {
+			if _, ok := supportedAlgorithms[alg]; !ok {
+				return nil, fmt.Errorf("unsupported algorithm %v of issuer %v", alg, issuer.IssuerURL)
+			}
+		}
+		auth.Conf.Issuers = append(auth.Conf.Issuers, issuer)
 	}
 	return auth, nil
 }
 
-// This can be used as a Middleware or a GinHandlerFunc for a specific route
-func (o *OAuth2Provider) AuthorizationMiddleware() (gin.HandlerFunc, error) {
-	authServerURL, err := url.Parse(o.Conf.AuthServerURL)
-	if err != nil {
-		return nil, fmt.Errorf("bad AuthServerURL string %v. err %v", o.Conf.AuthServerURL, err)
+// The validators of a trusted issuer by signature algorithm
+type issuerValidators map[string]*validator.Validator
+
+func newIssuerValidators(issuer *Issuer, keyProviderURL *url.URL, cacheDuration time.Duration) (issuerValidators, error) {
+	var opts []jwks.ProviderOption
+	if issuer.JwksURL != "" {
+		jwksURL, err := url.Parse(issuer.JwksURL)
+		if err != nil {
+			return nil, fmt.Errorf("bad JwksURL string %v. err %v", issuer.JwksURL, err)
+		}
+		opts = append(opts, jwks.WithCustomJWKSURI(jwksURL))
 	}
-	cacheProvider := jwks.NewCachingProvider(authServerURL, o.Conf.PubKeyCacheDuration)
+	cacheProvider := jwks.NewCachingProvider(keyProviderURL, cacheDuration, opts...)
 
 	audienceCustomClaims := func() validator.CustomClaims {
-		return &AudienceCustomClaims{
-			authorizedScope: o.Conf.AuthorizedScope,
-		}
+		return &AudienceCustomClaims{}
 	}
-	issuer := authServerURL.String()
-	if o.Conf.IssuerURL != "" {
-		issuerURL, err := url.Parse(o.Conf.IssuerURL)
+	validators := make(issuerValidators, len(issuer.Algorithms))
+	for _, alg := range issuer.Algorithms {
+		jwtValidator, err := validator.New(cacheProvider.KeyFunc,
+			supportedAlgorithms[alg],
+			issuer.IssuerURL,
+			issuer.Audience,
+			validator.WithCustomClaims(audienceCustomClaims),
+		)
 		if err != nil {
-			return nil, fmt.Errorf("bad IssuerURL string %v. err %v", o.Conf.IssuerURL, err)
+			return nil, fmt.Errorf("failed to create validator of issuer %v. err %v", issuer.IssuerURL, err)
 		}
-		issuer = issuerURL.String()
+		validators[alg] = jwtValidator
 	}
+	return validators, nil
+}
 
-	jwtValidator, err := validator.New(cacheProvider.KeyFunc,
-		validator.RS256,
-		issuer,
-		o.Conf.Audience,
-		validator.WithCustomClaims(audienceCustomClaims),
-	)
+// The issuer and the signature algorithm of the token. Nothing is verified yet,
+// they only pick the validator that verifies the token.
+func peekIssuerAlgorithm(tokenString string) (string, string, error) {
+	token, err := jwt.ParseSigned(tokenString)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create validator. err %v", err)
+		return "", "", fmt.Errorf("could not parse the token: %w", err)
+	}
+	claims := jwt.Claims{}
+	if err = token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", "", fmt.Errorf("could not decode the token claims: %w", err)
 	}
+	return claims.Issuer, token.Headers[0].Algorithm, nil
+}
 
+// This can be used as a Middleware or a GinHandlerFunc for a specific route
+func (o *OAuth2Provider) AuthorizationMiddleware() (gin.HandlerFunc, error) {
+	validators := make(map[string]issuerValidators, len(o.Conf.Issuers)+1)
+	if o.Conf.AuthServerURL != "" {
+		authServerURL, err := url.Parse(o.Conf.AuthServerURL)
+		if err != nil {
+			return nil, fmt.Errorf("bad AuthServerURL string %v. err %v", o.Conf.AuthServerURL, err)
+		}
+		issuer := Issuer{
+			IssuerURL:  authServerURL.String(),
+			Algorithms: []string{string(defaultAlgorithm)},
+			Audience:   o.Conf.Audience,
+		}
+		if o.Conf.IssuerURL != "" {
+			issuerURL, err := url.Parse(o.Conf.IssuerURL)
+			if err != nil {
+				return nil, fmt.Errorf("bad IssuerURL string %v. err %v", o.Conf.IssuerURL, err)
+			}
+			issuer.IssuerURL = issuerURL.String()
+		}
+		// The keys are discovered from the Auth server, which may differ from the issuer
+		validators[issuer.IssuerURL], err = newIssuerValidators(&issuer, authServerURL, o.Conf.PubKeyCacheDuration)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range o.Conf.Issuers {
+		issuer := &o.Conf.Issuers[i]
+		if _, ok := validators[issuer.IssuerURL]; ok {
+			return nil, fmt.Errorf("duplicate issuer %v", issuer.IssuerURL)
+		}
+		issuerURL, err := url.Parse(issuer.IssuerURL)
+		if err != nil {
+			return nil, fmt.Errorf("bad IssuerURL string %v. err %v", issuer.IssuerURL, err)
+		}
+		validators[issuer.IssuerURL], err = newIssuerValidators(issuer, issuerURL, o.Conf.PubKeyCacheDuration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Dispatches the token to the validator of its issuer and algorithm
+	validateToken := func(ctx context.Context, tokenString string) (interface{}, error) {
+		iss, alg, err := peekIssuerAlgorithm(tokenString)
+		if err != nil {
+			return nil, err
+		}
+		issuerValidators, ok := validators[iss]
+		if !ok {
+			return nil, fmt.Errorf("untrusted issuer %q", iss)
+		}
+		jwtValidator, ok := issuerValidators[alg]
+		if !ok {
+			return nil, fmt.Errorf("signing algorithm %q not allowed for issuer %q", alg, iss)
+		}
+		return jwtValidator.ValidateToken(ctx, tokenString)
+	}
+
+	// The response is written by the gin handler, the error is handed over to it
 	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("error while validating jwt. err %v", err)
+		if authErr, ok := r.Context().Value(authErrorKey{}).(*error); ok {
+			*authErr = err
+		}
 	}
 
 	middleware := jwtmiddleware.New(
-		jwtValidator.ValidateToken,
+		validateToken,
 		jwtmiddleware.WithErrorHandler(errorHandler),
 	)
 
@@ -137,12 +366,8 @@ func (o *OAuth2Provider) AuthorizationMiddleware() (gin.HandlerFunc, error) {
 		var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
 			ctx.Request = r
 
-			// At this point CheckJWT validations would be completed.
-			// Below is an extra check to compare the http.Method (route) with
-			// the claimed scope. For e.g. the method GET should be present in the scope claim.
-			// This is to avoid a valid access token with scope say DELETE only, to use the GET route.
-			// Without this check, the token & scope are valid and allowed to proceed. But here
-			// we tie up the scope with the route
+			// At this point CheckJWT validations would be completed. The scopes
+			// are checked against the ones of the route by RequireScopes.
 			claims, ok := ctx.Request.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
 			if !ok {
 				return
@@ -151,30 +376,37 @@ func (o *OAuth2Provider) AuthorizationMiddleware() (gin.HandlerFunc, error) {
 			if !ok {
 				return
 			}
-			scope := strings.Split(customClaims.Scope, " ")
-			var routeValidated bool = false
-			for i := range scope {
-				if scope[i] == ctx.Request.Method {
-					routeValidated = true
-					break
+			scopes := customClaims.GetScopes()
+			var admin bool = false
+			var methodScope bool = false
+			for i := range scopes {
+				if o.Conf.AdminScope != "" && scopes[i] == o.Conf.AdminScope {
+					admin = true
+				}
+				if o.Conf.MethodScopes && scopes[i] == ctx.Request.Method {
+					methodScope = true
 				}
 			}
-			if !routeValidated {
-				return
-			}
-			// If we are here then the route is validated.
+			// Make the client identity available to the handlers
+			ctx.Set(ClientIdKey, customClaims.GetClientId())
+			ctx.Set(ScopesKey, scopes)
+			ctx.Set(AdminKey, admin)
+			ctx.Set(methodScopeKey, methodScope)
 			// procError can be false now and the next gin Handler is called
 			procError = false
 			ctx.Next()
 		}
-		middleware.CheckJWT(handler).ServeHTTP(ctx.Writer, ctx.Request)
+		var authErr error
+		req := ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), authErrorKey{}, &authErr))
+		middleware.CheckJWT(handler).ServeHTTP(ctx.Writer, req)
 
 		// All the gin handlers are executed post validation of JWT and procError must be false at this point
 		if procError {
-			ctx.AbortWithStatusJSON(
-				http.StatusUnauthorized,
-				map[string]string{"message": "invalid token"},
-			)
+			if errors.Is(authErr, errScopeMissing) {
+				abortPermissionDenied(ctx, "Insufficient scope, the access token has no scope")
+				return
+			}
+			abortUnauthenticated(ctx, authErr)
 		}
 	}
 	return ginHandler, nil
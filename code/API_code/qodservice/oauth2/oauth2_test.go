@@ -0,0 +1,387 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oauth2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/util"
+	"go.uber.org/zap"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	testIdpIssuer  = "https://idp.example"
+	testAudience   = "qod"
+	testIdpAud     = "qod-idp"
+	testReadScope  = "qod:sessions:read"
+	testAdminScope = "qod:admin"
+)
+
+func TestMain(m *testing.M) {
+	logger.Auth = zap.NewNop()
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// testKeys are the signing keys of the stub authorization servers
+type testKeys struct {
+	rsa   *rsa.PrivateKey
+	ec    *ecdsa.PrivateKey
+	other *rsa.PrivateKey // Not in the JWKS
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeys{rsa: rsaKey, ec: ecKey, other: otherKey}
+}
+
+// newTestAuthServer serves the JWKS of the keys, and its discovery document as
+// the issuer of its own URL
+func newTestAuthServer(t *testing.T, keys *testKeys) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": srv.URL, "jwks_uri": srv.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &keys.rsa.PublicKey, KeyID: "rsa", Use: "sig"},
+			{Key: &keys.ec.PublicKey, KeyID: "ec", Use: "sig"},
+		}})
+	})
+	return srv
+}
+
+type testToken struct {
+	alg      jose.SignatureAlgorithm
+	issuer   string
+	audience string
+	scope    string
+	expiry   time.Time
+	otherKey bool // Signed by a key the issuer does not have
+}
+
+func signTestToken(t *testing.T, keys *testKeys, tok testToken) string {
+	t.Helper()
+	var key jose.JSONWebKey
+	switch {
+	case tok.otherKey:
+		key = jose.JSONWebKey{Key: keys.other, KeyID: "rsa"}
+	case strings.HasPrefix(string(tok.alg), "ES"):
+		key = jose.JSONWebKey{Key: keys.ec, KeyID: "ec"}
+	default:
+		key = jose.JSONWebKey{Key: keys.rsa, KeyID: "rsa"}
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: tok.alg, Key: key}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.expiry.IsZero() {
+		tok.expiry = time.Now().Add(time.Hour)
+	}
+	claims := jwt.Claims{
+		Issuer:   tok.issuer,
+		Audience: jwt.Audience{tok.audience},
+		Expiry:   jwt.NewNumericDate(tok.expiry),
+		IssuedAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+	}
+	custom := AudienceCustomClaims{Scope: tok.scope, Azp: "client1"}
+	token, err := jwt.Signed(signer).Claims(claims).Claims(custom).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// newTestRouter trusts the stub server as the Auth server (RS256) and as the
+// issuer testIdpIssuer (ES256 and PS256)
+func newTestRouter(t *testing.T, authServerURL string) *gin.Engine {
+	t.Helper()
+	provider, err := New(&Config{
+		AuthServerURL: authServerURL,
+		Audience:      []string{testAudience},
+		AdminScope:    testAdminScope,
+		MethodScopes:  true,
+		Issuers: []Issuer{{
+			IssuerURL:  testIdpIssuer,
+			JwksURL:    authServerURL + "/jwks",
+			Algorithms: []string{"ES256", "PS256"},
+			Audience:   []string{testIdpAud},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	middleware, err := provider.AuthorizationMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"clientId": GetClientId(ctx), "admin": IsAdmin(ctx)})
+	}
+	router := gin.New()
+	router.Use(middleware)
+	router.GET("/sessions", RequireScopes(testReadScope), identity)
+	router.POST("/sessions", RequireScopes("qod:sessions:create"), identity)
+	router.GET("/admin", RequireAdmin(), identity)
+	return router
+}
+
+func TestAuthorizationMiddleware(t *testing.T) {
+	keys := newTestKeys(t)
+	srv := newTestAuthServer(t, keys)
+	router := newTestRouter(t, srv.URL)
+
+	insufficientScope := `Bearer realm="qod", error="insufficient_scope"`
+	invalidToken := `Bearer realm="qod", error="invalid_token", error_description="The access token is invalid or expired"`
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		token         *testToken
+		rawToken      string
+		wantStatus    int
+		wantChallenge string
+		wantAdmin     bool
+	}{
+		{name: "no token", wantStatus: http.StatusUnauthorized, wantChallenge: `Bearer realm="qod"`},
+		{name: "malformed token", rawToken: "not.a.jwt", wantStatus: http.StatusUnauthorized, wantChallenge: invalidToken},
+		{
+			name:       "RS256 of the Auth server",
+			token:      &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience, scope: testReadScope},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "extra unrelated scopes",
+			token:      &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience, scope: "openid profile " + testReadScope},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:          "missing scope",
+			token:         &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience, scope: "openid profile"},
+			wantStatus:    http.StatusForbidden,
+			wantChallenge: insufficientScope + `, scope="` + testReadScope + `"`,
+		},
+		{
+			name:          "no scope",
+			token:         &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience},
+			wantStatus:    http.StatusForbidden,
+			wantChallenge: insufficientScope,
+		},
+		{
+			name:       "method scope",
+			token:      &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience, scope: http.MethodGet},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:          "method scope of another method",
+			method:        http.MethodPost,
+			token:         &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience, scope: http.MethodGet},
+			wantStatus:    http.StatusForbidden,
+			wantChallenge: insufficientScope + `, scope="qod:sessions:create"`,
+		},
+		{
+			name:          "wrong issuer",
+			token:         &testToken{alg: jose.RS256, issuer: "https://evil.example", audience: testAudience, scope: testReadScope},
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: invalidToken,
+		},
+		{
+			name:          "algorithm not allowed for the Auth server",
+			token:         &testToken{alg: jose.ES256, issuer: srv.URL, audience: testAudience, scope: testReadScope},
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: invalidToken,
+		},
+		{
+			name:          "wrong audience",
+			token:         &testToken{alg: jose.RS256, issuer: srv.URL, audience: testIdpAud, scope: testReadScope},
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: invalidToken,
+		},
+		{
+			name:          "expired",
+			token:         &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience, scope: testReadScope, expiry: time.Now().Add(-time.Hour)},
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: invalidToken,
+		},
+		{
+			name:          "unknown signing key",
+			token:         &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience, scope: testReadScope, otherKey: true},
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: invalidToken,
+		},
+		{
+			name:       "ES256 of the issuer",
+			token:      &testToken{alg: jose.ES256, issuer: testIdpIssuer, audience: testIdpAud, scope: testReadScope},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "PS256 of the issuer",
+			token:      &testToken{alg: jose.PS256, issuer: testIdpIssuer, audience: testIdpAud, scope: testReadScope},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:          "algorithm not allowed for the issuer",
+			token:         &testToken{alg: jose.RS256, issuer: testIdpIssuer, audience: testIdpAud, scope: testReadScope},
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: invalidToken,
+		},
+		{
+			name:          "audience of another issuer",
+			token:         &testToken{alg: jose.ES256, issuer: testIdpIssuer, audience: testAudience, scope: testReadScope},
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: invalidToken,
+		},
+		{
+			name:          "admin route without the admin scope",
+			path:          "/admin",
+			token:         &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience, scope: testReadScope},
+			wantStatus:    http.StatusForbidden,
+			wantChallenge: insufficientScope,
+		},
+		{
+			name:       "admin route",
+			path:       "/admin",
+			token:      &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience, scope: testAdminScope},
+			wantStatus: http.StatusOK,
+			wantAdmin:  true,
+		},
+		{
+			name:       "admin of the issuer",
+			token:      &testToken{alg: jose.PS256, issuer: testIdpIssuer, audience: testIdpAud, scope: testAdminScope + " " + testReadScope},
+			wantStatus: http.StatusOK,
+			wantAdmin:  true,
+		},
+		{
+			name:          "admin scope is not a route scope",
+			token:         &testToken{alg: jose.RS256, issuer: srv.URL, audience: testAudience, scope: testAdminScope},
+			wantStatus:    http.StatusForbidden,
+			wantChallenge: insufficientScope + `, scope="` + testReadScope + `"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, path := tt.method, tt.path
+			if method == "" {
+				method = http.MethodGet
+			}
+			if path == "" {
+				path = "/sessions"
+			}
+			req := httptest.NewRequest(method, path, nil)
+			token := tt.rawToken
+			if tt.token != nil {
+				token = signTestToken(t, keys, *tt.token)
+			}
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %v, want %v. body %v", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if challenge := rec.Header().Get("WWW-Authenticate"); challenge != tt.wantChallenge {
+				t.Errorf("WWW-Authenticate %q, want %q", challenge, tt.wantChallenge)
+			}
+			if tt.wantStatus != http.StatusOK {
+				var errInfo api.ErrorInfo
+				if err := json.Unmarshal(rec.Body.Bytes(), &errInfo); err != nil {
+					t.Fatal(err)
+				}
+				wantCode := util.UNAUTHENTICATED
+				if tt.wantStatus == http.StatusForbidden {
+					wantCode = util.PERMISSION_DENIED
+				}
+				if errInfo.Code != wantCode || errInfo.Message == "" {
+					t.Errorf("error %+v, want code %v", errInfo, wantCode)
+				}
+				return
+			}
+			var identity struct {
+				ClientId string `json:"clientId"`
+				Admin    bool   `json:"admin"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &identity); err != nil {
+				t.Fatal(err)
+			}
+			if identity.ClientId != "client1" || identity.Admin != tt.wantAdmin {
+				t.Errorf("identity %+v, want client1 admin %v", identity, tt.wantAdmin)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    Config
+		wantErr string
+	}{
+		{"no issuer", Config{}, "invalid authserverURL"},
+		{"no audience", Config{AuthServerURL: "https://auth.example"}, "invalid audience"},
+		{"issuer without audience", Config{Issuers: []Issuer{{IssuerURL: testIdpIssuer}}}, "invalid audience of issuer " + testIdpIssuer},
+		{"symmetric algorithm", Config{Audience: []string{testAudience}, Issuers: []Issuer{{IssuerURL: testIdpIssuer, Algorithms: []string{"HS256"}}}}, "unsupported algorithm HS256 of issuer " + testIdpIssuer},
+		{"issuer", Config{Audience: []string{testAudience}, Issuers: []Issuer{{IssuerURL: testIdpIssuer}}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := New(&tt.conf)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			issuer := provider.Conf.Issuers[0]
+			if issuer.Algorithms[0] != "RS256" || issuer.Audience[0] != testAudience {
+				t.Errorf("issuer %+v, want the RS256 and the audience defaults", issuer)
+			}
+		})
+	}
+}
@@ -17,7 +17,9 @@ package producer
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
@@ -26,9 +28,8 @@ import (
 	nefAsqSpec "github.com/sfnuser/nef/assessionwithqos"
 	qodContext "github.com/sfnuser/qodservice/context"
 	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/store"
 	"github.com/sfnuser/qodservice/util"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/clientcredentials"
 )
 
 func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionResp {
@@ -36,25 +37,25 @@ func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionR
 	rsp := util.CreateSessionResp{}
 
 	// These are validated already
-	ueIpv4Addr := sessionReq.UeId.Ipv4addr
-	asIpv4Addr := sessionReq.AsId.Ipv4addr
+	flowAddrs, _ := util.SelectFlowAddrs(&sessionReq.UeId, &sessionReq.AsId)
+	ue := newUeKey(&sessionReq.UeId, flowAddrs)
 
 	qodCtx := qodContext.GetSelf()
 	// Get provisioned data
-	asData, err := qodCtx.Db.GetCamaraProvQoDAppServerData(*asIpv4Addr)
+	asData, err := qodCtx.Db.GetAppServerData(flowAddrs.AsAddr, flowAddrs.Ipv6)
 	if err != nil {
-		logger.Prod.Sugar().Errorf("failed to get prov data for asIpv4Addr %v", *asIpv4Addr)
+		logger.Prod.Sugar().Errorf("failed to get prov data for asAddr %v", flowAddrs.AsAddr)
 		rsp.ErrorInfo = &api.ErrorInfo{
 			Code:    "INVALID_INPUT",
-			Message: fmt.Sprintf("asIpv4Addr %v not provisioned", *asIpv4Addr),
+			Message: fmt.Sprintf("asAddr %v not provisioned", flowAddrs.AsAddr),
 		}
 		return &rsp
 	}
-	// Get the QoSReference and ScsAsId for UeIpv4Addr
+	// Get the QoSReference and ScsAsId for the UE address
 	scsAsId := asData.ScsAsId
 	qosReference, ok := asData.QoSMap[string(sessionReq.Qos)]
 	if !ok {
-		logger.Prod.Sugar().Errorf("qosProfile %v not provisioned for asIpv4Addr %v", sessionReq.Qos, *asIpv4Addr)
+		logger.Prod.Sugar().Errorf("qosProfile %v not provisioned for asAddr %v", sessionReq.Qos, flowAddrs.AsAddr)
 		rsp.ErrorInfo = &api.ErrorInfo{
 			Code:    "INVALID_INPUT",
 			Message: fmt.Sprintf("qosProfile %v not provisioned", sessionReq.Qos),
@@ -62,6 +63,23 @@ func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionR
 		return &rsp
 	}
 
+	duration := newSessionDuration(sessionReq, asData.Policy)
+	if errorInfo := evaluateAppServerPolicy(asData, duration, time.Now()); errorInfo != nil {
+		rsp.ErrorInfo = errorInfo
+		return &rsp
+	}
+	slotReserved, errorInfo := reserveAppServerSlot(asData, time.Now())
+	if errorInfo != nil {
+		rsp.ErrorInfo = errorInfo
+		return &rsp
+	}
+	defer func() {
+		// The slot is held by the session once it is stored
+		if slotReserved && rsp.ErrorInfo != nil {
+			releaseAppServerSlot(scsAsId)
+		}
+	}()
+
 	var uePortFormat string
 	var asPortFormat string
 	if sessionReq.UePorts != nil {
@@ -71,24 +89,24 @@ func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionR
 		asPortFormat = util.ConvertPortSpecToFilterFormat(sessionReq.AsPorts)
 	}
 	flowDesc := []string{
-		fmt.Sprintf("permit in any from %s %s to %s %s", *ueIpv4Addr, uePortFormat, *asIpv4Addr, asPortFormat),
-		fmt.Sprintf("permit out any from %s %s to %s %s", *asIpv4Addr, asPortFormat, *ueIpv4Addr, uePortFormat),
+		fmt.Sprintf("permit in any from %s %s to %s %s", flowAddrs.FlowUeAddr(), uePortFormat, flowAddrs.AsAddr, asPortFormat),
+		fmt.Sprintf("permit out any from %s %s to %s %s", flowAddrs.AsAddr, asPortFormat, flowAddrs.FlowUeAddr(), uePortFormat),
 	}
-	logger.Prod.Sugar().Debugf("CreateSession: got prov data. ueIpv4Addr %v, asIpv4Addr %v scsAsId %v, qosReference %v, flowDesc %v",
-		*ueIpv4Addr, *asIpv4Addr, scsAsId, qosReference, flowDesc)
+	logger.Prod.Sugar().Debugf("CreateSession: got prov data. ue %v, asAddr %v scsAsId %v, qosReference %v, flowDesc %v",
+		ue.Value, flowAddrs.AsAddr, scsAsId, qosReference, flowDesc)
 
 	// Check for existing sessions
-	ueSessions, err := qodCtx.Db.GetAllCamaraQoDServiceUeSession(*ueIpv4Addr, scsAsId, string(sessionReq.Qos))
+	ueSessions, err := qodCtx.Db.GetUeSessions(ue, scsAsId, string(sessionReq.Qos))
 	if err != nil {
-		logger.Prod.Sugar().Errorf("failed to get existing UeSessions. ueIpv4Addr %v, scsAsId %v, qosProfile %v",
-			*ueIpv4Addr, scsAsId, sessionReq.Qos)
+		logger.Prod.Sugar().Errorf("failed to get existing UeSessions. ue %v, scsAsId %v, qosProfile %v",
+			ue.Value, scsAsId, sessionReq.Qos)
 		// Not a major error. Proceed
 	}
-	if ueSessions != nil && len(*ueSessions) > 0 {
-		for i := 0; i < len(*ueSessions); i++ {
-			ueSession := (*ueSessions)[i]
+	if len(ueSessions) > 0 {
+		for i := 0; i < len(ueSessions); i++ {
+			ueSession := ueSessions[i]
 			flowInfo := ueSession.FlowInfo
-			// We have other sessions for UeIpv4Addr, scsAsId and qosProfile
+			// We have other sessions for the UE address, scsAsId and qosProfile
 			// We just compare the FlowDesc.
 			if flowInfo.FlowDescriptions != nil {
 				if len(flowDesc) == len(*flowInfo.FlowDescriptions) {
@@ -116,7 +134,7 @@ func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionR
 	// Allocate a FlowId
 	medCompN := 1 // Always the same medCompN
 
-	// NOTE: We use fNum as an incremented counter for a given UeIpv4Addr, AS combo.
+	// NOTE: We use fNum as an incremented counter for a given UE address, AS combo.
 	// We could simply count the existing number of sessions and use that as fNum.
 	// THe problem will be when the first flow is deleted and created again, it will
 	// use the same fNum as the already established second flow, which is a problem.
@@ -127,7 +145,7 @@ func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionR
 	// we don't have an existing procedure in CAMARA. Writing down the corner cases
 	// here, so that we can revisit at appropriate time.
 
-	ueFlows, err := qodCtx.Db.GetCamaraQoDServiceIncrementUeFlow(*ueIpv4Addr, scsAsId)
+	flowCounter, err := qodCtx.Db.IncrementUeFlow(ue, scsAsId)
 	if err != nil {
 		// Unable to get the Flow Number
 		logger.Prod.Sugar().Errorf("failed to get the fNum. err %v", err)
@@ -139,21 +157,26 @@ func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionR
 	}
 
 	// Encode FlowId as per 24.008 Section 10.5.1.6.2
-	flowId := (medCompN << 16) | int(ueFlows.FlowCounter)
-
-	// Setup OAuth2 client credentials to be accepted by NEF
-	oAuth2Cfg := clientcredentials.Config{
-		ClientID:     qodCtx.OAuth2Cli.ClientId,
-		ClientSecret: qodCtx.OAuth2Cli.ClientSecret,
-		TokenURL:     qodCtx.OAuth2Cli.TokenURL,
-	}
-	// Get a new Context
-	tokenSource := oAuth2Cfg.TokenSource(context.Background())
-	oAuthCtx := context.WithValue(oauth2.NoContext, nefAsqSpec.ContextOAuth2, tokenSource)
+	flowId := (medCompN << 16) | int(flowCounter)
 
 	// Create a AsqRequest with the given details
 	nefAsqReq := nefAsqSpec.NewAsSessionWithQoSSubscriptionWithDefaults()
-	nefAsqReq.UeIpv4Addr = sessionReq.UeId.Ipv4addr
+	switch {
+	case flowAddrs.UeAddr != "" && flowAddrs.Ipv6:
+		nefAsqReq.UeIpv6Addr = &flowAddrs.UeAddr
+	case flowAddrs.UeAddr != "":
+		nefAsqReq.UeIpv4Addr = &flowAddrs.UeAddr
+	default:
+		// The generated NEF model has no UE identifiers other than the address. NEF
+		// resolves the UE address from the gpsi or externalId.
+		nefAsqReq.AdditionalProperties = make(map[string]interface{})
+		if sessionReq.UeId.Msisdn != nil {
+			nefAsqReq.AdditionalProperties["gpsi"] = util.ConvertMsisdnToGpsi(*sessionReq.UeId.Msisdn)
+		}
+		if sessionReq.UeId.ExternalId != nil {
+			nefAsqReq.AdditionalProperties["externalId"] = *sessionReq.UeId.ExternalId
+		}
+	}
 	nefAsqReq.FlowInfo = &[]nefAsqSpec.FlowInfo{
 		{
 			FlowId:           int32(flowId),
@@ -175,49 +198,61 @@ func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionR
 		}
 	}
 	// Make NEF Client request
-	configuration := nefAsqSpec.NewConfiguration()
-	// Update APIRoot default server path
-	server := configuration.Servers[0].Variables["apiRoot"]
-	server.DefaultValue = qodCtx.NefServiceUrl
-	configuration.Servers[0].Variables["apiRoot"] = server
-	configuration.HTTPClient = &http.Client{
-		Timeout: time.Second * time.Duration(qodCtx.NefHttpTimeoutSecs),
-	}
-
-	cli := nefAsqSpec.NewAPIClient(configuration)
-	subsPostReq := cli.AsSessionWithQoSAPISubscriptionLevelPOSTOperationApi.ScsAsIdSubscriptionsPost(oAuthCtx, scsAsId)
+	nefCtx, cancel := qodCtx.NefRequestContext()
+	defer cancel()
+	subsPostReq := qodCtx.NefClient.AsSessionWithQoSAPISubscriptionLevelPOSTOperationApi.ScsAsIdSubscriptionsPost(nefCtx, scsAsId)
 	subsPostReq = subsPostReq.AsSessionWithQoSSubscription(*nefAsqReq)
 	rspAsq, hdr, err := subsPostReq.Execute()
-	if err != nil || hdr == nil {
-		var errString string
-		if hdr != nil {
-			errString = fmt.Sprintf("nef assessionwithqos subscription create failed. http response %v, err %v", hdr.StatusCode, err)
-		} else {
-			errString = fmt.Sprintf("nef assessionwithqos subscription create failed. err %v", err)
-		}
+	if hdr == nil {
+		errString := fmt.Sprintf("nef assessionwithqos subscription create failed. err %v", err)
 		logger.Prod.Sugar().Errorln(errString)
+		if isTimeout(err) {
+			// NEF may have created the subscription before the timeout. Its id is unknown.
+			nefSubscription := util.QoDServiceSession{}
+			nefSubscription.ScsAsId = scsAsId
+			rollbackNefSubscription(&nefSubscription, errString)
+		}
 		rsp.ErrorInfo = &api.ErrorInfo{
 			Code:    "INTERNAL",
 			Message: errString,
 		}
 		return &rsp
 	}
-	// Get the ResourceId in locationHdr & subscriptionId
-	locationHdr := hdr.Header.Get("Location")
-	subscriptionId, err := util.ExtractSubstr(locationHdr, "subscriptions/", "")
-	if err != nil {
-		logger.Prod.Sugar().Errorf("NefAsSessionWithQoSSubscriptionCreate failed to get subscriptionId. err %v", err)
+	if hdr.StatusCode < http.StatusOK || hdr.StatusCode >= http.StatusMultipleChoices {
+		errString := fmt.Sprintf("nef assessionwithqos subscription create failed. http response %v, err %v", hdr.StatusCode, err)
+		logger.Prod.Sugar().Errorln(errString)
 		rsp.ErrorInfo = &api.ErrorInfo{
 			Code:    "INTERNAL",
-			Message: fmt.Sprintf("nef assessionwithqos subscription create failed to get subscriptionId. err %v", err),
+			Message: errString,
 		}
 		return &rsp
 	}
-	if hdr.StatusCode != http.StatusCreated {
-		logger.Prod.Sugar().Errorf("NefAsSessionWithQoSSubscriptionCreate failed. httpStatusCode %v", hdr.StatusCode)
+	// NEF has created the subscription. From here on it is rolled back when the session
+	// can not be created. Get the ResourceId in locationHdr & subscriptionId.
+	locationHdr := hdr.Header.Get("Location")
+	if locationHdr == "" && rspAsq.Self != nil {
+		locationHdr = *rspAsq.Self
+	}
+	subscriptionId, idErr := util.ExtractSubstr(locationHdr, "subscriptions/", "")
+	var errString string
+	switch {
+	case idErr != nil:
+		errString = fmt.Sprintf("nef assessionwithqos subscription create failed to get subscriptionId. err %v", idErr)
+	case hdr.StatusCode != http.StatusCreated:
+		errString = fmt.Sprintf("nef assessionwithqos subscription create failed. httpStatusCode %v", hdr.StatusCode)
+	case err != nil:
+		errString = fmt.Sprintf("nef assessionwithqos subscription create failed to decode the response. err %v", err)
+	}
+	if errString != "" {
+		logger.Prod.Sugar().Errorln(errString)
+		nefSubscription := util.QoDServiceSession{}
+		nefSubscription.ScsAsId = scsAsId
+		nefSubscription.NefSubscriptionId = subscriptionId
+		nefSubscription.NefSubscriptionResource = locationHdr
+		rollbackNefSubscription(&nefSubscription, errString)
 		rsp.ErrorInfo = &api.ErrorInfo{
 			Code:    "INTERNAL",
-			Message: fmt.Sprintf("nef assessionwithqos subscription create failed. httpStatusCode %v", hdr.StatusCode),
+			Message: errString,
 		}
 		return &rsp
 	}
@@ -225,10 +260,6 @@ func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionR
 		subscriptionId, locationHdr, rspAsq.Self)
 
 	// We have a valid NEF session created.
-	var duration int32 = 86400 // Seconds in 24hrs
-	if sessionReq.Duration != nil {
-		duration = *sessionReq.Duration
-	}
 	now := time.Now().Unix()
 	rsp.SessionInfo = &api.SessionInfo{
 		Duration:              duration,
@@ -246,7 +277,6 @@ func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionR
 
 	// Update the DB with the new params
 	apiData := util.QoDApiSessionInfo{
-		UeIpv4Addr:              *ueIpv4Addr,
 		ScsAsId:                 scsAsId,
 		SessionId:               rsp.SessionInfo.Id,
 		NefSubscriptionId:       subscriptionId,
@@ -256,14 +286,69 @@ func HandleCreateSessionRequest(req *util.CreateSessionReq) *util.CreateSessionR
 		FlowDescriptions:        &flowDesc,
 		SessionReq:              sessionReq,
 		SessionInfo:             rsp.SessionInfo,
+		ClientId:                req.ClientId,
+	}
+	if sessionReq.UeId.Ipv4addr != nil {
+		apiData.UeIpv4Addr = *sessionReq.UeId.Ipv4addr
 	}
-	logger.Prod.Sugar().Infof("CreateSession: Success. SubscriptionId %v, SessionId %v", subscriptionId, apiData.SessionId)
 	dbData := util.ConvertSpecToDbSessionInfo(&apiData)
-	matchCount, err := qodCtx.Db.PutCamaraQoDServiceUeSession(*ueIpv4Addr, apiData.SessionId, dbData)
-	if err != nil || matchCount != 0 {
-		logger.Prod.Sugar().Errorf("CreateSession: failed in db write. ueIpv4Addr %v, sessionId %v, err %v, matchCount %v",
-			*ueIpv4Addr, apiData.SessionId, err, matchCount)
-		// Not sure what we can do here. @todo. Should we delete the nef session and return error?
+	dbData.AsSlot = slotReserved
+	err = qodCtx.Db.PutSession(dbData)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("CreateSession: failed in db write. ue %v, sessionId %v, err %v",
+			ue.Value, apiData.SessionId, err)
+		// Without a record the session can neither be used nor deleted. Undo the NEF subscription.
+		rollbackNefSubscription(dbData, fmt.Sprintf("db write failed. err %v", err))
+		rsp.SessionInfo = nil
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("createSession failed to store the session. err %v", err),
+		}
+		return &rsp
 	}
+	logger.Prod.Sugar().Infof("CreateSession: Success. SubscriptionId %v, SessionId %v", subscriptionId, apiData.SessionId)
 	return &rsp
 }
+
+// Deletes the NEF subscription of a session that could not be created. A subscription
+// that can not be deleted either, or whose id is unknown, is kept in the dead letters
+// for a later cleanup.
+func rollbackNefSubscription(ueSession *util.QoDServiceSession, reason string) {
+	if ueSession.NefSubscriptionId == "" {
+		logger.Prod.Sugar().Errorf("CreateSession: NEF subscription %v of scsAsId %v can not be rolled back without its id",
+			ueSession.NefSubscriptionResource, ueSession.ScsAsId)
+		putNefDeadLetter(ueSession, reason, "no subscriptionId from NEF")
+		return
+	}
+	errorInfo := deleteNefSubscription(&ueSession.ServiceQoDUeSession)
+	if errorInfo == nil {
+		logger.Prod.Sugar().Infof("CreateSession: rolled back NEF subscriptionId %v", ueSession.NefSubscriptionId)
+		return
+	}
+	logger.Prod.Sugar().Errorf("CreateSession: rollback of NEF subscriptionId %v failed. errorInfo %v",
+		ueSession.NefSubscriptionId, errorInfo)
+	putNefDeadLetter(ueSession, reason, errorInfo.Message)
+}
+
+func putNefDeadLetter(ueSession *util.QoDServiceSession, reason, rollbackError string) {
+	deadLetter := store.NefDeadLetter{
+		SessionId:               ueSession.SessionId,
+		ScsAsId:                 ueSession.ScsAsId,
+		NefSubscriptionId:       ueSession.NefSubscriptionId,
+		NefSubscriptionResource: ueSession.NefSubscriptionResource,
+		Reason:                  reason,
+		RollbackError:           rollbackError,
+		FailedAt:                time.Now().Unix(),
+	}
+	if err := qodContext.GetSelf().Db.PutNefDeadLetter(&deadLetter); err != nil {
+		// Nothing left but the log
+		logger.Prod.Sugar().Errorf("CreateSession: NEF subscription %v %v of scsAsId %v left behind. err %v",
+			ueSession.NefSubscriptionId, ueSession.NefSubscriptionResource, ueSession.ScsAsId, err)
+	}
+}
+
+// A request that timed out may have been carried out by NEF nonetheless
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
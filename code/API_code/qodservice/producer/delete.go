@@ -15,18 +15,15 @@
 package producer
 
 import (
-	"context"
 	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/sfnuser/camara/qodmodels/api"
-	nefAsqSpec "github.com/sfnuser/nef/assessionwithqos"
+	"github.com/sfnuser/camara/qodmodels/db"
 	qodContext "github.com/sfnuser/qodservice/context"
 	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/notifier"
 	"github.com/sfnuser/qodservice/util"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/clientcredentials"
 )
 
 func HandleDeleteSessionRequest(req *util.DeleteSessionReq) *util.DeleteSessionResp {
@@ -34,83 +31,80 @@ func HandleDeleteSessionRequest(req *util.DeleteSessionReq) *util.DeleteSessionR
 	rsp := util.DeleteSessionResp{}
 	qodCtx := qodContext.GetSelf()
 	// Check if session exists
-	sessionInfo, err := qodCtx.Db.GetCamaraQoDServiceUeSession(sessionId)
+	sessionInfo, err := qodCtx.Db.GetSession(sessionId)
 	if err != nil {
-		logger.Prod.Sugar().Errorf("deleteSession: sessionId %v not found", sessionId)
-		rsp.ErrorInfo = &api.ErrorInfo{
-			Code:    "NOT_FOUND",
-			Message: fmt.Sprintf("sessionId %v does not exist", sessionId),
-		}
+		logger.Prod.Sugar().Errorf("deleteSession: sessionId %v not retrieved. err %v", sessionId, err)
+		rsp.ErrorInfo = sessionLookupError(sessionId, err)
+		return &rsp
+	}
+	if rsp.ErrorInfo = checkSessionOwner(sessionInfo, req.ClientId, req.IsAdmin); rsp.ErrorInfo != nil {
 		return &rsp
 	}
 	logger.Prod.Sugar().Infow("Delete Session:", "sessionId", sessionId,
 		"NEF subscriptionId", sessionInfo.NefSubscriptionId,
 		"scsAsId", sessionInfo.ScsAsId)
 
-	// Setup OAuth2 client credentials to be accepted by NEF
-	oAuth2Cfg := clientcredentials.Config{
-		ClientID:     qodCtx.OAuth2Cli.ClientId,
-		ClientSecret: qodCtx.OAuth2Cli.ClientSecret,
-		TokenURL:     qodCtx.OAuth2Cli.TokenURL,
+	rsp.ErrorInfo = deleteNefSubscription(&sessionInfo.ServiceQoDUeSession)
+	if rsp.ErrorInfo != nil {
+		return &rsp
 	}
-	// Get a new Context
-	tokenSource := oAuth2Cfg.TokenSource(context.Background())
-	oAuthCtx := context.WithValue(oauth2.NoContext, nefAsqSpec.ContextOAuth2, tokenSource)
-
-	configuration := nefAsqSpec.NewConfiguration()
-	// Update APIRoot default server path
-	server := configuration.Servers[0].Variables["apiRoot"]
-	server.DefaultValue = qodCtx.NefServiceUrl
-	configuration.Servers[0].Variables["apiRoot"] = server
-
-	configuration.HTTPClient = &http.Client{
-		Timeout: time.Second * time.Duration(qodCtx.NefHttpTimeoutSecs),
+	// Delete the session from QoD DB
+	found, err := qodCtx.Db.DeleteSession(sessionId)
+	if err != nil || !found {
+		logger.Prod.Sugar().Errorf("deleteSession: failed to delete sessionId %v from db. err %v", sessionId, err)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("deleteSession failed to delete db entry. err %v", err),
+		}
+		return &rsp
 	}
+	releaseSessionSlot(sessionInfo)
+	notifySessionTerminated(&sessionInfo.SessionInfo, notifier.STATUS_INFO_DELETE_REQUESTED)
+	// No error means the operation succeeded
+	return &rsp
+}
+
+// Deletes the NEF AsSessionWithQoS subscription backing the session. A subscription
+// that is already gone at NEF (404) is treated as deleted.
+func deleteNefSubscription(sessionInfo *db.ServiceQoDUeSession) *api.ErrorInfo {
+	qodCtx := qodContext.GetSelf()
 
-	cli := nefAsqSpec.NewAPIClient(configuration)
-	subsPostDel := cli.AsSessionWithQoSAPISubscriptionLevelDELETEOperationApi.ScsAsIdSubscriptionsSubscriptionIdDelete(oAuthCtx,
+	nefCtx, cancel := qodCtx.NefRequestContext()
+	defer cancel()
+	subsPostDel := qodCtx.NefClient.AsSessionWithQoSAPISubscriptionLevelDELETEOperationApi.ScsAsIdSubscriptionsSubscriptionIdDelete(nefCtx,
 		sessionInfo.ScsAsId, sessionInfo.NefSubscriptionId)
 	notifData, nefRsp, err := subsPostDel.Execute()
+	if nefRsp != nil && nefRsp.StatusCode == http.StatusNotFound {
+		logger.Prod.Sugar().Warnf("NefAsSessionWithQoSSubscriptionDelete: subscriptionId %v already removed at NEF",
+			sessionInfo.NefSubscriptionId)
+		return nil
+	}
 	if err != nil {
 		logger.Prod.Sugar().Errorf("NefAsSessionWithQoSSubscriptionDelete failed. err %v", err)
-		rsp.ErrorInfo = &api.ErrorInfo{
+		return &api.ErrorInfo{
 			Code:    "INTERNAL",
 			Message: fmt.Sprintf("nef assessionwithqos subscription delete failed. err %v", err),
 		}
-		return &rsp
 	} else if nefRsp != nil {
 		if !(nefRsp.StatusCode == http.StatusNoContent || nefRsp.StatusCode == http.StatusOK) {
 			logger.Prod.Sugar().Errorf("NefAsSessionWithQoSSubscriptionDelete failed. statusCode %v", nefRsp.StatusCode)
-			rsp.ErrorInfo = &api.ErrorInfo{
+			return &api.ErrorInfo{
 				Code:    "INTERNAL",
 				Message: fmt.Sprintf("nef assessionwithqos subscription delete failed. err %v", err),
 			}
-			return &rsp
 		}
 		// Success case
 		// Check if there is an event occurred during delete
 		if notifData.Transaction != "" {
 			logger.Prod.Sugar().Warnw("Notification event handling on delete is not implemented", "transaction", notifData.Transaction)
 		}
-		// Delete the session from QoD DB
-		matchCount, err := qodCtx.Db.DeleteCamaraQoDServiceUeSession(sessionId)
-		if err != nil || matchCount != 1 {
-			logger.Prod.Sugar().Errorf("deleteSession: failed to delete sessionId %v from db. err %v", sessionId, err)
-			rsp.ErrorInfo = &api.ErrorInfo{
-				Code:    "INTERNAL",
-				Message: fmt.Sprintf("deleteSession failed to delete db entry. err %v", err),
-			}
-			return &rsp
-		}
-		// No error means the operation succeeded
-		return &rsp
+		return nil
 	}
 
 	// No response but not error
 	logger.Prod.Sugar().Errorf("NefAsSessionWithQoSSubscriptionDelete failed. no response")
-	rsp.ErrorInfo = &api.ErrorInfo{
+	return &api.ErrorInfo{
 		Code:    "INTERNAL",
 		Message: fmt.Sprintf("nef assessionwithqos subscription delete failed. no response"),
 	}
-	return &rsp
 }
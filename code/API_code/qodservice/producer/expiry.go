@@ -0,0 +1,109 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"time"
+
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/notifier"
+	"github.com/sfnuser/qodservice/util"
+)
+
+var expiryStop chan struct{}
+
+// StartSessionExpiry runs the background teardown of expired sessions.
+// The DB is the only state used, so sessions that expired while no replica was
+// running are picked up on the first scan. Every replica can run the scan; a lease
+// on the session document makes sure only one of them tears down a given session.
+// A replica that fails midway releases the session to others once its lease is over.
+func StartSessionExpiry() {
+	qodCtx := qodContext.GetSelf()
+	interval := time.Second * time.Duration(qodCtx.ExpiryScanIntervalSecs)
+	expiryStop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		expireSessions()
+		for {
+			select {
+			case <-ticker.C:
+				expireSessions()
+			case <-stop:
+				return
+			}
+		}
+	}(expiryStop)
+	logger.Prod.Sugar().Infof("SessionExpiry: started. scanInterval %v, lease %vs", interval, qodCtx.ExpiryLeaseSecs)
+}
+
+func StopSessionExpiry() {
+	if expiryStop != nil {
+		close(expiryStop)
+		expiryStop = nil
+	}
+}
+
+func expireSessions() {
+	now := time.Now().Unix()
+	ueSessions, err := qodContext.GetSelf().Db.GetExpiredSessions(now)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("SessionExpiry: failed to get expired sessions. err %v", err)
+		return
+	}
+	for i := 0; i < len(ueSessions); i++ {
+		expireSession(&ueSessions[i], now)
+	}
+}
+
+func expireSession(ueSession *util.QoDServiceSession, now int64) {
+	qodCtx := qodContext.GetSelf()
+	sessionId := ueSession.SessionId
+
+	owned, err := qodCtx.Db.AcquireExpiryLease(sessionId, qodCtx.InstanceId, now, qodCtx.ExpiryLeaseSecs)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("SessionExpiry: failed to lease sessionId %v. err %v", sessionId, err)
+		return
+	}
+	if !owned {
+		// Another replica is on it
+		logger.Prod.Sugar().Debugf("SessionExpiry: sessionId %v leased by another instance", sessionId)
+		return
+	}
+	logger.Prod.Sugar().Infow("Expire Session:", "sessionId", sessionId,
+		"NEF subscriptionId", ueSession.NefSubscriptionId,
+		"scsAsId", ueSession.ScsAsId,
+		"expiresAt", ueSession.SessionInfo.ExpiresAt)
+
+	if errorInfo := deleteNefSubscription(&ueSession.ServiceQoDUeSession); errorInfo != nil {
+		// Retried once the lease is over
+		logger.Prod.Sugar().Errorf("SessionExpiry: sessionId %v NEF teardown failed. errorInfo %v", sessionId, errorInfo)
+		return
+	}
+	found, err := qodCtx.Db.DeleteSession(sessionId)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("SessionExpiry: failed to delete sessionId %v from db. err %v", sessionId, err)
+		return
+	}
+	if !found {
+		// Deleted by the client in the meantime
+		return
+	}
+	releaseSessionSlot(ueSession)
+	notifySessionTerminated(&ueSession.SessionInfo, notifier.STATUS_INFO_DURATION_EXPIRED)
+}
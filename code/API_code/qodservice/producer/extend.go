@@ -0,0 +1,100 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/util"
+)
+
+// Extends the duration of an active session. Only the session record changes;
+// the NEF subscription and the FlowId stay as they are.
+func HandleExtendSessionRequest(req *util.ExtendSessionReq) *util.ExtendSessionResp {
+	sessionId := req.SessionId
+	rsp := util.ExtendSessionResp{}
+	qodCtx := qodContext.GetSelf()
+
+	ueSession, err := qodCtx.Db.GetSession(sessionId)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("extendSession: sessionId %v not retrieved. err %v", sessionId, err)
+		rsp.ErrorInfo = sessionLookupError(sessionId, err)
+		return &rsp
+	}
+	if rsp.ErrorInfo = checkSessionOwner(ueSession, req.ClientId, req.IsAdmin); rsp.ErrorInfo != nil {
+		return &rsp
+	}
+	sessionInfo := &ueSession.SessionInfo
+	now := time.Now().Unix()
+	if sessionInfo.ExpiresAt <= now {
+		// Waiting to be torn down
+		logger.Prod.Sugar().Errorf("extendSession: sessionId %v expired at %v", sessionId, sessionInfo.ExpiresAt)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "NOT_FOUND",
+			Message: fmt.Sprintf("sessionId %v has expired", sessionId),
+		}
+		return &rsp
+	}
+
+	// The total duration is capped to the configured maximum and to the ones of the
+	// qosProfile and of the AS policy
+	maxDuration := int64(qodCtx.SessionMaxDurationSecs)
+	if profile, ok := util.GetQosProfile(string(sessionInfo.Qos)); ok {
+		if profileMax := profile.MaxDurationSecs(); profileMax != 0 && profileMax < maxDuration {
+			maxDuration = profileMax
+		}
+	}
+	if asMax := appServerMaxDuration(ueSession); asMax != 0 && asMax < maxDuration {
+		maxDuration = asMax
+	}
+	duration := int64(sessionInfo.Duration) + int64(req.AdditionalDuration)
+	if duration > maxDuration {
+		logger.Prod.Sugar().Infof("extendSession: sessionId %v duration %v capped to %v", sessionId, duration,
+			maxDuration)
+		duration = maxDuration
+	}
+	if duration <= int64(sessionInfo.Duration) {
+		// Already at the maximum, nothing can be added
+		logger.Prod.Sugar().Errorf("extendSession: sessionId %v already has the maximum duration %v", sessionId,
+			maxDuration)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    util.OUT_OF_RANGE,
+			Message: fmt.Sprintf("sessionId %v already has the maximum duration of %v secs", sessionId, maxDuration),
+		}
+		return &rsp
+	}
+	sessionInfo.Duration = int32(duration)
+	sessionInfo.ExpiresAt = sessionInfo.StartedAt + duration
+
+	found, err := qodCtx.Db.UpdateSession(ueSession)
+	if err != nil || !found {
+		logger.Prod.Sugar().Errorf("extendSession: failed in db write. sessionId %v, err %v, found %v",
+			sessionId, err, found)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("extendSession failed to update db entry. err %v", err),
+		}
+		return &rsp
+	}
+	logger.Prod.Sugar().Infow("Extend Session:", "sessionId", sessionId,
+		"duration", sessionInfo.Duration, "expiresAt", sessionInfo.ExpiresAt)
+
+	rsp.SessionInfo = util.ConvertServiceToSpecSessionInfo(ueSession)
+	return &rsp
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/store"
+	"github.com/sfnuser/qodservice/util"
+)
+
+func HandleGetSessionRequest(req *util.GetSessionReq) *util.GetSessionResp {
+	sessionId := req.SessionId
+	rsp := util.GetSessionResp{}
+
+	sessionInfo, err := qodContext.GetSelf().Db.GetSession(sessionId)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("getSession: sessionId %v not retrieved. err %v", sessionId, err)
+		rsp.ErrorInfo = sessionLookupError(sessionId, err)
+		return &rsp
+	}
+	if rsp.ErrorInfo = checkSessionOwner(sessionInfo, req.ClientId, req.IsAdmin); rsp.ErrorInfo != nil {
+		return &rsp
+	}
+	logger.Prod.Sugar().Debugw("Get Session:", "sessionId", sessionId,
+		"NEF subscriptionId", sessionInfo.NefSubscriptionId,
+		"scsAsId", sessionInfo.ScsAsId)
+
+	rsp.SessionInfo = util.ConvertServiceToSpecSessionInfo(sessionInfo)
+	return &rsp
+}
+
+// The error of a failed session lookup. NOT_FOUND only when the session is not in
+// the store. Other store errors, e.g. the db being unreachable, are INTERNAL.
+func sessionLookupError(sessionId string, err error) *api.ErrorInfo {
+	if !errors.Is(err, store.ErrNotFound) {
+		return &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("sessionId %v could not be retrieved", sessionId),
+		}
+	}
+	return &api.ErrorInfo{
+		Code:    "NOT_FOUND",
+		Message: fmt.Sprintf("sessionId %v does not exist", sessionId),
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	nefAsqSpec "github.com/sfnuser/nef/assessionwithqos"
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/notifier"
+	"github.com/sfnuser/qodservice/util"
+)
+
+const (
+	MESSAGE_SEVERITY_INFO    = "INFO"
+	MESSAGE_SEVERITY_WARNING = "WARNING"
+)
+
+// QoS status of the session
+type sessionQosStatus struct {
+	QosStatus string
+	Message   api.Message // Reported in the session messages
+}
+
+// The NEF user plane events that change the QoS status of the session
+var nefEventQosStatus = map[nefAsqSpec.UserPlaneEventAnyOf]sessionQosStatus{
+	nefAsqSpec.QOS_NOT_GUARANTEED: {
+		notifier.QOS_STATUS_UNAVAILABLE,
+		api.Message{
+			Severity:    MESSAGE_SEVERITY_WARNING,
+			Description: "The network is not able to guarantee the requested QoS",
+		},
+	},
+	nefAsqSpec.FAILED_RESOURCES_ALLOCATION: {
+		notifier.QOS_STATUS_UNAVAILABLE,
+		api.Message{
+			Severity:    MESSAGE_SEVERITY_WARNING,
+			Description: "The network failed to allocate resources for the requested QoS",
+		},
+	},
+	nefAsqSpec.LOSS_OF_BEARER: {
+		notifier.QOS_STATUS_UNAVAILABLE,
+		api.Message{
+			Severity:    MESSAGE_SEVERITY_WARNING,
+			Description: "The bearer of the session is lost",
+		},
+	},
+	nefAsqSpec.RELEASE_OF_BEARER: {
+		notifier.QOS_STATUS_UNAVAILABLE,
+		api.Message{
+			Severity:    MESSAGE_SEVERITY_WARNING,
+			Description: "The bearer of the session is released",
+		},
+	},
+	nefAsqSpec.QOS_GUARANTEED: {
+		notifier.QOS_STATUS_AVAILABLE,
+		api.Message{
+			Severity:    MESSAGE_SEVERITY_INFO,
+			Description: "The network guarantees the requested QoS",
+		},
+	},
+	nefAsqSpec.SUCCESSFUL_RESOURCES_ALLOCATION: {
+		notifier.QOS_STATUS_AVAILABLE,
+		api.Message{
+			Severity:    MESSAGE_SEVERITY_INFO,
+			Description: "The network allocated resources for the requested QoS",
+		},
+	},
+	nefAsqSpec.RECOVERY_OF_BEARER: {
+		notifier.QOS_STATUS_AVAILABLE,
+		api.Message{
+			Severity:    MESSAGE_SEVERITY_INFO,
+			Description: "The bearer of the session is recovered",
+		},
+	},
+}
+
+func HandleNefNotificationRequest(req *util.NefNotificationReq) *util.NefNotificationResp {
+	notification := req.Notification
+	rsp := util.NefNotificationResp{}
+	qodCtx := qodContext.GetSelf()
+
+	// Transaction is the resource URI of the NEF subscription. If it cannot be
+	// parsed only the exact resource URI is matched.
+	scsAsId, subscriptionId, err := util.ParseNefSubscriptionResource(notification.Transaction)
+	if err != nil {
+		logger.Prod.Sugar().Debugf("nefNotification: %v", err)
+	}
+	ueSession, err := qodCtx.Db.GetSessionByNefSubscription(notification.Transaction, scsAsId, subscriptionId)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("nefNotification: no session for transaction %v. err %v", notification.Transaction, err)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "NOT_FOUND",
+			Message: fmt.Sprintf("transaction %v does not exist", notification.Transaction),
+		}
+		return &rsp
+	}
+	sessionId := ueSession.SessionId
+
+	var terminated bool
+	var qosStatus *sessionQosStatus
+	for _, report := range notification.EventReports {
+		event := nefAsqSpec.UserPlaneEventAnyOf(report.Event)
+		logger.Prod.Sugar().Infow("NEF Notification:", "sessionId", sessionId,
+			"NEF subscriptionId", ueSession.NefSubscriptionId, "event", event)
+
+		if event == nefAsqSpec.SESSION_TERMINATION {
+			terminated = true
+			continue
+		}
+		status, ok := nefEventQosStatus[event]
+		if !ok {
+			logger.Prod.Sugar().Debugf("nefNotification: event %v not handled", event)
+			continue
+		}
+		// Only the latest QoS status of the session is kept
+		qosStatus = &status
+	}
+
+	if terminated {
+		// NEF has released the subscription already. Only our record is left
+		found, err := qodCtx.Db.DeleteSession(sessionId)
+		if err != nil {
+			logger.Prod.Sugar().Errorf("nefNotification: failed to delete sessionId %v from db. err %v", sessionId, err)
+			rsp.ErrorInfo = &api.ErrorInfo{
+				Code:    "INTERNAL",
+				Message: fmt.Sprintf("nefNotification failed to delete db entry. err %v", err),
+			}
+			return &rsp
+		}
+		if found {
+			releaseSessionSlot(ueSession)
+			notifySessionTerminated(&ueSession.SessionInfo, notifier.STATUS_INFO_NETWORK_TERMINATED)
+		}
+		return &rsp
+	}
+	if qosStatus != nil {
+		// Only the status is set, not to undo a concurrent update of the session
+		ueSession.SessionInfo.Messages = []api.Message{qosStatus.Message}
+		_, err := qodCtx.Db.UpdateSessionQosStatus(sessionId, ueSession.NefSubscriptionMissing, ueSession.SessionInfo.Messages)
+		if err != nil {
+			logger.Prod.Sugar().Errorf("nefNotification: failed to update sessionId %v in db. err %v", sessionId, err)
+			rsp.ErrorInfo = &api.ErrorInfo{
+				Code:    "INTERNAL",
+				Message: fmt.Sprintf("nefNotification failed to update db entry. err %v", err),
+			}
+			return &rsp
+		}
+		notifySessionEvent(&ueSession.SessionInfo, &notifier.QosNotification{
+			Event:     notifier.QOS_STATUS_CHANGED,
+			QosStatus: qosStatus.QosStatus,
+		})
+	}
+	return &rsp
+}
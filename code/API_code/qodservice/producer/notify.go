@@ -0,0 +1,92 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"time"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/notifier"
+)
+
+var sessionNotifier *notifier.Notifier
+
+// StartNotifier starts the delivery of session events to the clients. Notifications
+// that could not be delivered are stored in the db for inspection.
+func StartNotifier() {
+	cfg := qodContext.GetSelf().Notifier
+	conf := notifier.Config{
+		Workers:        cfg.Workers,
+		QueueSize:      cfg.QueueSize,
+		MaxAttempts:    cfg.MaxAttempts,
+		InitialBackoff: time.Second * time.Duration(cfg.InitialBackoffSecs),
+		MaxBackoff:     time.Second * time.Duration(cfg.MaxBackoffSecs),
+		HttpTimeout:    time.Second * time.Duration(cfg.TimeoutSecs),
+	}
+	sessionNotifier = notifier.New(&conf, func(d *notifier.Delivery) {
+		logger.Prod.Sugar().Errorw("Notification failed:", "sessionId", d.Notification.SessionId,
+			"event", d.Notification.Event, "notificationUri", d.NotificationUri,
+			"attempts", d.Attempts, "lastError", d.LastError)
+		if err := qodContext.GetSelf().Db.PutFailedNotification(d); err != nil {
+			logger.Prod.Sugar().Errorf("failed to store failed notification. sessionId %v, err %v", d.Notification.SessionId, err)
+		}
+	})
+	sessionNotifier.Start()
+	logger.Prod.Sugar().Infof("Notifier: started. config %+v", sessionNotifier.Conf)
+}
+
+func StopNotifier() {
+	if sessionNotifier != nil {
+		sessionNotifier.Stop()
+	}
+}
+
+// Sends the session event to the notificationUri of the session, if the client asked for it.
+// The notificationAuthToken, if any, is sent as the bearer token.
+func notifySessionEvent(sessionInfo *api.SessionInfo, notification *notifier.QosNotification) {
+	if sessionInfo.NotificationUri == nil || *sessionInfo.NotificationUri == "" {
+		return
+	}
+	if sessionNotifier == nil {
+		logger.Prod.Sugar().Warnf("notifySessionEvent: notifier not started. sessionId %v", sessionInfo.Id)
+		return
+	}
+	notification.SessionId = sessionInfo.Id
+	delivery := notifier.Delivery{
+		NotificationUri: *sessionInfo.NotificationUri,
+		Notification:    notification,
+	}
+	if sessionInfo.NotificationAuthToken != nil {
+		delivery.AuthToken = *sessionInfo.NotificationAuthToken
+	}
+	if err := sessionNotifier.Send(&delivery); err != nil {
+		logger.Prod.Sugar().Errorf("notifySessionEvent: failed to queue. sessionId %v, event %v, err %v",
+			sessionInfo.Id, notification.Event, err)
+		return
+	}
+	logger.Prod.Sugar().Infow("Notification queued:", "sessionId", sessionInfo.Id, "event", notification.Event,
+		"statusInfo", notification.StatusInfo)
+}
+
+// The session is gone for the reason in statusInfo
+func notifySessionTerminated(sessionInfo *api.SessionInfo, statusInfo string) {
+	notifySessionEvent(sessionInfo, &notifier.QosNotification{
+		Event:      notifier.SESSION_TERMINATED,
+		QosStatus:  notifier.QOS_STATUS_UNAVAILABLE,
+		StatusInfo: statusInfo,
+	})
+}
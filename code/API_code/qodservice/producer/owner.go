@@ -0,0 +1,72 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/util"
+)
+
+// A session belongs to the OAuth2 client that created it. Other clients get
+// NOT_FOUND, same as for a session that does not exist, so that they cannot tell
+// the sessionIds of others. Clients with the admin scope may use all sessions.
+//
+// Sessions stored without a client were created before the owner was recorded.
+// Their owner cannot be told afterwards, hence they are left to the admins until
+// they expire. They are logged at startup.
+func checkSessionOwner(session *util.QoDServiceSession, clientId string, admin bool) *api.ErrorInfo {
+	if admin {
+		return nil
+	}
+	if clientId != "" && session.ClientId == clientId {
+		return nil
+	}
+	if session.ClientId == "" {
+		logger.Prod.Sugar().Errorf("sessionId %v without owner denied to clientId %v", session.SessionId, clientId)
+	} else {
+		logger.Prod.Sugar().Errorf("sessionId %v of clientId %v denied to clientId %v", session.SessionId,
+			session.ClientId, clientId)
+	}
+	return &api.ErrorInfo{
+		Code:    util.NOT_FOUND,
+		Message: fmt.Sprintf("sessionId %v does not exist", session.SessionId),
+	}
+}
+
+// LogOwnerlessSessions logs the sessions stored without a client
+func LogOwnerlessSessions() {
+	ueSessions, err := qodContext.GetSelf().Db.GetAllSessions()
+	if err != nil {
+		logger.Prod.Sugar().Errorf("failed to get the sessions to check their owner. err %v", err)
+		return
+	}
+	count := 0
+	for i := range ueSessions {
+		ueSession := &ueSessions[i]
+		if ueSession.ClientId != "" {
+			continue
+		}
+		count++
+		logger.Prod.Sugar().Warnw("Session without owner:", "sessionId", ueSession.SessionId,
+			"scsAsId", ueSession.ScsAsId, "expiresAt", ueSession.SessionInfo.ExpiresAt)
+	}
+	if count != 0 {
+		logger.Prod.Sugar().Warnf("%v session(s) without owner are left to the admin clients until they expire", count)
+	}
+}
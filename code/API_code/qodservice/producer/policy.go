@@ -0,0 +1,146 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/factory"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/util"
+)
+
+// The policy of the AS is evaluated before anything is requested from NEF. The
+// concurrent sessions are limited by slots taken atomically in the store before
+// the NEF subscription is created. A slot is given back when the create fails and
+// when the session is deleted or expires. The reconciliation resyncs the slots to
+// the sessions holding one, should a slot be lost.
+
+// Duration the session is created with. The default duration is capped to the
+// configured maximum and to the maxDuration of the qosProfile and of the AS policy.
+func newSessionDuration(sessionReq *api.CreateSession, policy *util.AppServerPolicy) int32 {
+	if sessionReq.Duration != nil {
+		return *sessionReq.Duration
+	}
+	var duration int32 = factory.QOD_DEFAULT_SESSION_DURATION_SECS
+	if maxDuration := qodContext.GetSelf().SessionMaxDurationSecs; maxDuration < int(duration) {
+		duration = int32(maxDuration)
+	}
+	if profile, ok := util.GetQosProfile(string(sessionReq.Qos)); ok {
+		if profileMax := profile.MaxDurationSecs(); profileMax != 0 && profileMax < int64(duration) {
+			duration = int32(profileMax)
+		}
+	}
+	if policy != nil && policy.MaxDurationSecs != 0 && policy.MaxDurationSecs < duration {
+		duration = policy.MaxDurationSecs
+	}
+	return duration
+}
+
+// appServerMaxDuration returns the maxDurationSecs of the policy of the AS the
+// session is towards, 0 if there is none
+func appServerMaxDuration(session *util.QoDServiceSession) int64 {
+	sessionInfo := util.ConvertServiceToSpecSessionInfo(session)
+	flowAddrs, err := util.SelectFlowAddrs(&sessionInfo.UeId, &sessionInfo.AsId)
+	if err != nil {
+		return 0
+	}
+	asData, err := qodContext.GetSelf().Db.GetAppServerData(flowAddrs.AsAddr, flowAddrs.Ipv6)
+	if err != nil {
+		logger.Prod.Sugar().Infof("policy: no prov data for asAddr %v of sessionId %v. err %v", flowAddrs.AsAddr,
+			session.SessionId, err)
+		return 0
+	}
+	if asData.Policy == nil {
+		return 0
+	}
+	return int64(asData.Policy.MaxDurationSecs)
+}
+
+// The duration is checked against the configured maximum as well, the same one an
+// extend is capped to
+func evaluateAppServerPolicy(asData *util.QoDProvAppServerData, duration int32, now time.Time) *api.ErrorInfo {
+	if maxDuration := qodContext.GetSelf().SessionMaxDurationSecs; int(duration) > maxDuration {
+		logger.Prod.Sugar().Errorf("policy: duration %v exceeds the configured maxDurationSecs %v", duration, maxDuration)
+		return &api.ErrorInfo{
+			Code:    util.OUT_OF_RANGE,
+			Message: fmt.Sprintf("duration %v exceeds the maximum of %v secs", duration, maxDuration),
+		}
+	}
+	policy := asData.Policy
+	if policy == nil {
+		return nil
+	}
+	if policy.MaxDurationSecs != 0 && duration > policy.MaxDurationSecs {
+		logger.Prod.Sugar().Errorf("policy: duration %v exceeds maxDurationSecs %v of scsAsId %v", duration,
+			policy.MaxDurationSecs, asData.ScsAsId)
+		return &api.ErrorInfo{
+			Code:    util.OUT_OF_RANGE,
+			Message: fmt.Sprintf("duration %v exceeds the maximum of %v secs allowed towards the AS", duration, policy.MaxDurationSecs),
+		}
+	}
+	if !policy.InTimeWindows(now) {
+		logger.Prod.Sugar().Errorf("policy: %v is outside the time windows of scsAsId %v", now, asData.ScsAsId)
+		return &api.ErrorInfo{
+			Code:    util.FORBIDDEN,
+			Message: "sessions towards the AS are not allowed at this time",
+		}
+	}
+	return nil
+}
+
+// Takes a slot of the concurrent sessions of the AS. Returns false if the policy
+// has no limit.
+func reserveAppServerSlot(asData *util.QoDProvAppServerData, now time.Time) (bool, *api.ErrorInfo) {
+	policy := asData.Policy
+	if policy == nil || policy.MaxConcurrentSessions == 0 {
+		return false, nil
+	}
+	reserved, err := qodContext.GetSelf().Db.ReserveAppServerSlot(asData.ScsAsId, policy.MaxConcurrentSessions, now.Unix())
+	if err != nil {
+		logger.Prod.Sugar().Errorf("policy: failed to reserve a session slot of scsAsId %v. err %v", asData.ScsAsId, err)
+		return false, &api.ErrorInfo{
+			Code:    util.INTERNAL,
+			Message: "a session towards the AS could not be reserved",
+		}
+	}
+	if !reserved {
+		logger.Prod.Sugar().Errorf("policy: scsAsId %v has all of its maxConcurrentSessions %v", asData.ScsAsId,
+			policy.MaxConcurrentSessions)
+		return false, &api.ErrorInfo{
+			Code:    util.QUOTA_EXCEEDED,
+			Message: fmt.Sprintf("the maximum of %v concurrent sessions towards the AS is reached", policy.MaxConcurrentSessions),
+		}
+	}
+	return true, nil
+}
+
+// Gives back the slot of the AS. A slot that is not given back is recovered by the
+// reconciliation.
+func releaseAppServerSlot(scsAsId string) {
+	if err := qodContext.GetSelf().Db.ReleaseAppServerSlot(scsAsId); err != nil {
+		logger.Prod.Sugar().Errorf("policy: failed to release a session slot of scsAsId %v. err %v", scsAsId, err)
+	}
+}
+
+// Gives back the slot of a deleted session, if it holds one
+func releaseSessionSlot(session *util.QoDServiceSession) {
+	if session.AsSlot {
+		releaseAppServerSlot(session.ScsAsId)
+	}
+}
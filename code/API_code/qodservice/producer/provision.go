@@ -0,0 +1,144 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/store"
+	"github.com/sfnuser/qodservice/util"
+)
+
+// Provisioning of the application servers through the admin API. Sessions that
+// exist already keep the scsAsId and qosReference they were created with.
+
+func HandleGetAppServersRequest() *util.AppServersResp {
+	rsp := util.AppServersResp{}
+
+	asData, err := qodContext.GetSelf().Db.GetAllAppServerData()
+	if err != nil {
+		logger.Prod.Sugar().Errorf("getAppServers: failed to get provisioned data. err %v", err)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: "Provisioned data could not be retrieved",
+		}
+		return &rsp
+	}
+	rsp.Data = asData
+	if rsp.Data == nil {
+		rsp.Data = []util.QoDProvAppServerData{}
+	}
+	return &rsp
+}
+
+func HandleGetAppServerRequest(req *util.AppServerReq) *util.AppServerResp {
+	rsp := util.AppServerResp{}
+
+	asData, err := qodContext.GetSelf().Db.GetAppServerData(req.AsAddr, util.IsIpv6Addr(req.AsAddr))
+	if err != nil {
+		logger.Prod.Sugar().Errorf("getAppServer: asAddr %v not found. err %v", req.AsAddr, err)
+		rsp.ErrorInfo = appServerNotFound(req.AsAddr, err)
+		return &rsp
+	}
+	rsp.Data = asData
+	return &rsp
+}
+
+func HandleCreateAppServerRequest(req *util.AppServerReq) *util.AppServerResp {
+	rsp := util.AppServerResp{}
+	asAddr, _ := req.Data.AsAddr()
+
+	created, err := qodContext.GetSelf().Db.CreateAppServerData(req.Data)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("createAppServer: failed to store asAddr %v. err %v", asAddr, err)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("asAddr %v could not be provisioned", asAddr),
+		}
+		return &rsp
+	} else if !created {
+		logger.Prod.Sugar().Errorf("createAppServer: asAddr %v provisioned already", asAddr)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "CONFLICT",
+			Message: fmt.Sprintf("asAddr %v is provisioned already", asAddr),
+		}
+		return &rsp
+	}
+	logger.Prod.Sugar().Infow("Provisioned AS:", "asAddr", asAddr, "scsAsId", req.Data.ScsAsId,
+		"qosMap", req.Data.QoSMap)
+
+	rsp.Data = req.Data
+	return &rsp
+}
+
+func HandleUpdateAppServerRequest(req *util.AppServerReq) *util.AppServerResp {
+	rsp := util.AppServerResp{}
+
+	updated, err := qodContext.GetSelf().Db.UpdateAppServerData(req.Data)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("updateAppServer: failed to store asAddr %v. err %v", req.AsAddr, err)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("asAddr %v could not be updated", req.AsAddr),
+		}
+		return &rsp
+	} else if !updated {
+		logger.Prod.Sugar().Errorf("updateAppServer: asAddr %v not found", req.AsAddr)
+		rsp.ErrorInfo = appServerNotFound(req.AsAddr, store.ErrNotFound)
+		return &rsp
+	}
+	logger.Prod.Sugar().Infow("Updated AS:", "asAddr", req.AsAddr, "scsAsId", req.Data.ScsAsId,
+		"qosMap", req.Data.QoSMap)
+
+	rsp.Data = req.Data
+	return &rsp
+}
+
+func HandleDeleteAppServerRequest(req *util.AppServerReq) *util.AppServerResp {
+	rsp := util.AppServerResp{}
+
+	deleted, err := qodContext.GetSelf().Db.DeleteAppServerData(req.AsAddr, util.IsIpv6Addr(req.AsAddr))
+	if err != nil {
+		logger.Prod.Sugar().Errorf("deleteAppServer: failed to delete asAddr %v. err %v", req.AsAddr, err)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("asAddr %v could not be deleted", req.AsAddr),
+		}
+		return &rsp
+	} else if !deleted {
+		logger.Prod.Sugar().Errorf("deleteAppServer: asAddr %v not found", req.AsAddr)
+		rsp.ErrorInfo = appServerNotFound(req.AsAddr, store.ErrNotFound)
+		return &rsp
+	}
+	logger.Prod.Sugar().Infow("Deleted AS:", "asAddr", req.AsAddr)
+	return &rsp
+}
+
+func appServerNotFound(asAddr string, err error) *api.ErrorInfo {
+	if !errors.Is(err, store.ErrNotFound) {
+		return &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("asAddr %v could not be retrieved", asAddr),
+		}
+	}
+	return &api.ErrorInfo{
+		Code:    "NOT_FOUND",
+		Message: fmt.Sprintf("asAddr %v is not provisioned", asAddr),
+	}
+}
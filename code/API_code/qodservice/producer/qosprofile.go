@@ -0,0 +1,43 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/util"
+)
+
+func HandleGetQosProfilesRequest() *util.GetQosProfilesResp {
+	return &util.GetQosProfilesResp{QosProfiles: util.GetQosProfiles()}
+}
+
+func HandleGetQosProfileRequest(req *util.GetQosProfileReq) *util.GetQosProfileResp {
+	rsp := util.GetQosProfileResp{}
+
+	profile, ok := util.GetQosProfile(req.Name)
+	if !ok {
+		logger.Prod.Sugar().Errorf("getQosProfile: name %v not found", req.Name)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "NOT_FOUND",
+			Message: fmt.Sprintf("qosProfile %v does not exist", req.Name),
+		}
+		return &rsp
+	}
+	rsp.QosProfile = profile
+	return &rsp
+}
@@ -0,0 +1,357 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/camara/qodmodels/db"
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/factory"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/notifier"
+	"github.com/sfnuser/qodservice/util"
+)
+
+// The reconciliation checks that the sessions and the NEF subscriptions still match.
+// - A session whose NEF subscription is gone is marked and its client is told that
+//   the QoS is unavailable. The session is left to expire or to be deleted.
+// - A NEF subscription without a session is an orphan. Only the subscriptions with
+//   our notificationDestination are ours, the others may be of another AF or of
+//   another deployment on the same scsAsId. Without a notification server none is
+//   told ours. The orphans are reported, and deleted at NEF only with
+//   reconcile.deleteOrphans. An orphan is deleted only once this replica has seen it
+//   without a session for QOD_DEFAULT_RECONCILE_ORPHAN_AGE_SECS, so that a session
+//   still being created is not taken for an orphan.
+// - The dead letters of failed rollbacks are deleted at NEF. The ones without a
+//   subscriptionId, e.g. of a create that timed out, are left to the operator.
+// Every replica may reconcile. The NEF deletes are idempotent (404 is success).
+
+// A NEF subscriptionId is unique only per scsAsId
+type nefSubscriptionKey struct {
+	scsAsId        string
+	subscriptionId string
+}
+
+var (
+	reconcileStop chan struct{}
+	reconcileMu   sync.Mutex
+	// First seen time of the NEF subscriptions without a session
+	orphanSeenAt = map[nefSubscriptionKey]int64{}
+	// Published at GET /qod/admin/v0/metrics
+	reconcileMetrics = expvar.NewMap("qod_reconcile")
+)
+
+func StartReconciler() {
+	qodCtx := qodContext.GetSelf()
+	if qodCtx.ReconcileIntervalSecs < 0 {
+		logger.Prod.Sugar().Infof("Reconciler: periodic run disabled")
+		return
+	}
+	interval := time.Second * time.Duration(qodCtx.ReconcileIntervalSecs)
+	reconcileStop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := reconcile(); err != nil {
+					logger.Prod.Sugar().Errorf("Reconciler: failed. err %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(reconcileStop)
+	logger.Prod.Sugar().Infof("Reconciler: started. interval %v", interval)
+}
+
+func StopReconciler() {
+	if reconcileStop != nil {
+		close(reconcileStop)
+		reconcileStop = nil
+	}
+}
+
+// Runs the reconciliation on demand. Waits for a periodic run in progress to finish.
+func HandleReconcileRequest() *util.ReconcileResp {
+	rsp := util.ReconcileResp{}
+	report, err := reconcile()
+	if err != nil {
+		logger.Prod.Sugar().Errorf("Reconciler: failed. err %v", err)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("reconciliation failed. err %v", err),
+		}
+		return &rsp
+	}
+	rsp.Report = report
+	return &rsp
+}
+
+func reconcile() (*util.ReconcileReport, error) {
+	reconcileMu.Lock()
+	defer reconcileMu.Unlock()
+
+	qodCtx := qodContext.GetSelf()
+	now := time.Now().Unix()
+	report := util.ReconcileReport{
+		StartedAt: now,
+	}
+	ueSessions, err := qodCtx.Db.GetAllSessions()
+	if err != nil {
+		return nil, err
+	}
+	// NEF subscriptions that are accounted for, and the scsAsIds to look for orphans
+	known := make(map[nefSubscriptionKey]bool)
+	scsAsIds := make(map[string]bool)
+	for i := 0; i < len(ueSessions); i++ {
+		ueSession := &ueSessions[i]
+		known[nefSubscriptionKey{ueSession.ScsAsId, ueSession.NefSubscriptionId}] = true
+		scsAsIds[ueSession.ScsAsId] = true
+		if ueSession.SessionInfo.ExpiresAt <= now {
+			// Left to the expiry
+			continue
+		}
+		reconcileSession(ueSession, &report)
+	}
+
+	deadLetters, err := qodCtx.Db.GetNefDeadLetters()
+	if err != nil {
+		logger.Prod.Sugar().Errorf("Reconciler: failed to get dead letters. err %v", err)
+		report.Errors++
+	}
+	for _, deadLetter := range deadLetters {
+		scsAsIds[deadLetter.ScsAsId] = true
+		if deadLetter.NefSubscriptionId == "" {
+			// NEF did not tell the id. The subscription, if any, is found as an orphan
+			logger.Prod.Sugar().Warnw("Reconcile: dead letter without NEF subscriptionId", "scsAsId", deadLetter.ScsAsId,
+				"resource", deadLetter.NefSubscriptionResource, "reason", deadLetter.Reason)
+			continue
+		}
+		nefSubscription := db.ServiceQoDUeSession{
+			ScsAsId:           deadLetter.ScsAsId,
+			NefSubscriptionId: deadLetter.NefSubscriptionId,
+		}
+		if errorInfo := deleteNefSubscription(&nefSubscription); errorInfo != nil {
+			report.Errors++
+			continue
+		}
+		known[nefSubscriptionKey{deadLetter.ScsAsId, deadLetter.NefSubscriptionId}] = true
+		if err := qodCtx.Db.DeleteNefDeadLetter(deadLetter.ScsAsId, deadLetter.NefSubscriptionId); err != nil {
+			logger.Prod.Sugar().Errorf("Reconciler: failed to delete dead letter of subscriptionId %v. err %v",
+				deadLetter.NefSubscriptionId, err)
+			report.Errors++
+			continue
+		}
+		report.DeadLettersCleared++
+	}
+
+	asData, err := qodCtx.Db.GetAllAppServerData()
+	if err != nil {
+		logger.Prod.Sugar().Errorf("Reconciler: failed to get provisioned data. err %v", err)
+		report.Errors++
+	}
+	for _, data := range asData {
+		scsAsIds[data.ScsAsId] = true
+	}
+	seenAt := make(map[nefSubscriptionKey]int64)
+	for scsAsId := range scsAsIds {
+		reconcileOrphans(scsAsId, known, seenAt, now, &report)
+		// Same as for the orphans, a slot taken recently may be of a session still being created
+		if err := qodCtx.Db.ResyncAppServerSlots(scsAsId, now-factory.QOD_DEFAULT_RECONCILE_ORPHAN_AGE_SECS); err != nil {
+			logger.Prod.Sugar().Errorf("Reconciler: failed to resync the session slots of scsAsId %v. err %v", scsAsId, err)
+			report.Errors++
+		}
+	}
+	orphanSeenAt = seenAt
+
+	publishReconcileMetrics(&report)
+	logger.Prod.Sugar().Infow("Reconcile:", "sessionsChecked", report.SessionsChecked,
+		"subscriptionsMissing", report.SubscriptionsMissing, "nefSubscriptions", report.NefSubscriptions,
+		"orphansFound", report.OrphansFound, "orphansDeleted", report.OrphansDeleted,
+		"deadLettersCleared", report.DeadLettersCleared, "errors", report.Errors)
+	return &report, nil
+}
+
+// Marks the session if NEF no longer has its subscription
+func reconcileSession(ueSession *util.QoDServiceSession, report *util.ReconcileReport) {
+	sessionId := ueSession.SessionId
+	report.SessionsChecked++
+
+	found, err := getNefSubscription(ueSession.ScsAsId, ueSession.NefSubscriptionId)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("Reconciler: failed to get NEF subscriptionId %v of sessionId %v. err %v",
+			ueSession.NefSubscriptionId, sessionId, err)
+		report.Errors++
+		return
+	}
+	if found {
+		return
+	}
+	report.SubscriptionsMissing++
+	logger.Prod.Sugar().Warnw("Reconcile: NEF subscription missing", "sessionId", sessionId,
+		"NEF subscriptionId", ueSession.NefSubscriptionId, "scsAsId", ueSession.ScsAsId)
+	if ueSession.NefSubscriptionMissing {
+		// Marked on an earlier run
+		return
+	}
+	// The session read at the start of the run may be outdated by now, e.g. extended.
+	// Only the status is set.
+	ueSession.NefSubscriptionMissing = true
+	ueSession.SessionInfo.Messages = []api.Message{
+		{
+			Severity:    MESSAGE_SEVERITY_WARNING,
+			Description: "The network no longer provides the requested QoS for the session",
+		},
+	}
+	found, err = qodContext.GetSelf().Db.UpdateSessionQosStatus(sessionId, true, ueSession.SessionInfo.Messages)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("Reconciler: failed to update sessionId %v in db. err %v", sessionId, err)
+		report.Errors++
+		return
+	}
+	if !found {
+		// Deleted in the meantime
+		return
+	}
+	notifySessionEvent(&ueSession.SessionInfo, &notifier.QosNotification{
+		Event:     notifier.QOS_STATUS_CHANGED,
+		QosStatus: notifier.QOS_STATUS_UNAVAILABLE,
+	})
+}
+
+// Reports the NEF subscriptions of the AS, that are ours, without a session. Deletes
+// the ones that have been without a session for long enough if configured so.
+func reconcileOrphans(scsAsId string, known map[nefSubscriptionKey]bool, seenAt map[nefSubscriptionKey]int64, now int64,
+	report *util.ReconcileReport) {
+	qodCtx := qodContext.GetSelf()
+	if qodCtx.NotificationServiceUrl == "" {
+		return
+	}
+	subscriptionIds, err := listNefSubscriptions(scsAsId, qodCtx.NotificationServiceUrl)
+	if err != nil {
+		logger.Prod.Sugar().Errorf("Reconciler: failed to list NEF subscriptions of scsAsId %v. err %v", scsAsId, err)
+		report.Errors++
+		return
+	}
+	report.NefSubscriptions += len(subscriptionIds)
+	for _, subscriptionId := range subscriptionIds {
+		key := nefSubscriptionKey{scsAsId, subscriptionId}
+		if known[key] {
+			continue
+		}
+		report.OrphansFound++
+		firstSeen, ok := orphanSeenAt[key]
+		if !ok {
+			firstSeen = now
+		}
+		if !qodCtx.ReconcileDeleteOrphans || now-firstSeen < factory.QOD_DEFAULT_RECONCILE_ORPHAN_AGE_SECS {
+			logger.Prod.Sugar().Warnw("Reconcile: NEF subscription without session", "NEF subscriptionId", subscriptionId,
+				"scsAsId", scsAsId)
+			seenAt[key] = firstSeen
+			continue
+		}
+		nefSubscription := db.ServiceQoDUeSession{
+			ScsAsId:           scsAsId,
+			NefSubscriptionId: subscriptionId,
+		}
+		if errorInfo := deleteNefSubscription(&nefSubscription); errorInfo != nil {
+			seenAt[key] = firstSeen
+			report.Errors++
+			continue
+		}
+		logger.Prod.Sugar().Infow("Reconcile: deleted orphaned NEF subscription", "NEF subscriptionId", subscriptionId,
+			"scsAsId", scsAsId)
+		report.OrphansDeleted++
+	}
+}
+
+// Returns false if NEF does not have the subscription
+func getNefSubscription(scsAsId, subscriptionId string) (bool, error) {
+	qodCtx := qodContext.GetSelf()
+	nefCtx, cancel := qodCtx.NefRequestContext()
+	defer cancel()
+
+	subsGetReq := qodCtx.NefClient.AsSessionWithQoSAPISubscriptionLevelGETOperationApi.ScsAsIdSubscriptionsSubscriptionIdGet(nefCtx,
+		scsAsId, subscriptionId)
+	_, nefRsp, err := subsGetReq.Execute()
+	if nefRsp != nil && nefRsp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if nefRsp == nil || nefRsp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected response %v", nefRsp)
+	}
+	return true, nil
+}
+
+// Returns the ids of the NEF subscriptions of the AS with the notificationDestination
+func listNefSubscriptions(scsAsId, notificationDestination string) ([]string, error) {
+	qodCtx := qodContext.GetSelf()
+	nefCtx, cancel := qodCtx.NefRequestContext()
+	defer cancel()
+
+	subsGetReq := qodCtx.NefClient.AsSessionWithQoSAPISCSASLevelGETOperationApi.ScsAsIdSubscriptionsGet(nefCtx, scsAsId)
+	subscriptions, nefRsp, err := subsGetReq.Execute()
+	if nefRsp != nil && nefRsp.StatusCode == http.StatusNotFound {
+		// No subscriptions for the AS
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var subscriptionIds []string
+	for _, subscription := range subscriptions {
+		if subscription.Self == nil || subscription.NotificationDestination != notificationDestination {
+			continue
+		}
+		subscriptionId, err := util.ExtractSubstr(*subscription.Self, "subscriptions/", "")
+		if err != nil {
+			logger.Prod.Sugar().Debugf("Reconciler: no subscriptionId in %v", *subscription.Self)
+			continue
+		}
+		subscriptionIds = append(subscriptionIds, subscriptionId)
+	}
+	return subscriptionIds, nil
+}
+
+func publishReconcileMetrics(report *util.ReconcileReport) {
+	reconcileMetrics.Add("runs", 1)
+	reconcileMetrics.Add("sessionsChecked", int64(report.SessionsChecked))
+	reconcileMetrics.Add("subscriptionsMissing", int64(report.SubscriptionsMissing))
+	reconcileMetrics.Add("orphansFound", int64(report.OrphansFound))
+	reconcileMetrics.Add("orphansDeleted", int64(report.OrphansDeleted))
+	reconcileMetrics.Add("deadLettersCleared", int64(report.DeadLettersCleared))
+	reconcileMetrics.Add("errors", int64(report.Errors))
+
+	// Drift found by the last run
+	drift := new(expvar.Int)
+	drift.Set(int64(report.SubscriptionsMissing + report.OrphansFound))
+	reconcileMetrics.Set("drift", drift)
+	lastRunAt := new(expvar.Int)
+	lastRunAt.Set(report.StartedAt)
+	reconcileMetrics.Set("lastRunAt", lastRunAt)
+}
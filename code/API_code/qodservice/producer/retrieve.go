@@ -0,0 +1,56 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/util"
+)
+
+// Retrieves the active sessions of a UE. A client only gets to see the sessions it created.
+func HandleRetrieveSessionsRequest(req *util.RetrieveSessionsReq) *util.RetrieveSessionsResp {
+	rsp := util.RetrieveSessionsResp{
+		SessionInfos: []api.SessionInfo{},
+	}
+	if req.ClientId == "" {
+		logger.Prod.Sugar().Errorf("retrieveSessions: no client identity in the access token")
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "FORBIDDEN",
+			Message: "client identity missing in the access token",
+		}
+		return &rsp
+	}
+
+	ueSessions, err := qodContext.GetSelf().Db.GetClientUeSessions(newUeKeys(req.UeId), req.ClientId, time.Now().Unix())
+	if err != nil {
+		logger.Prod.Sugar().Errorf("retrieveSessions: failed to get sessions. clientId %v, err %v", req.ClientId, err)
+		rsp.ErrorInfo = &api.ErrorInfo{
+			Code:    "INTERNAL",
+			Message: fmt.Sprintf("retrieveSessions failed to get sessions. err %v", err),
+		}
+		return &rsp
+	}
+	for i := 0; i < len(ueSessions); i++ {
+		sessionInfo := util.ConvertServiceToSpecSessionInfo(&ueSessions[i])
+		rsp.SessionInfos = append(rsp.SessionInfos, *sessionInfo)
+	}
+	logger.Prod.Sugar().Infow("Retrieve Sessions:", "clientId", req.ClientId, "sessions", len(rsp.SessionInfos))
+	return &rsp
+}
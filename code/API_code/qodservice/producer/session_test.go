@@ -0,0 +1,808 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	nefAsqSpec "github.com/sfnuser/nef/assessionwithqos"
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/factory"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/store"
+	"github.com/sfnuser/qodservice/util"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/oauth2"
+)
+
+const (
+	testScsAsId   = "as1"
+	testAsAddr    = "10.0.0.100"
+	testUeAddr    = "10.0.0.1"
+	testClientId  = "client1"
+	testMaxSecs   = 1000
+	testSessionId = "session1"
+)
+
+func TestMain(m *testing.M) {
+	logger.Prod = zap.NewNop()
+	logger.Util = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// fakeNef answers the AsSessionWithQoS subscription creates and deletes
+type fakeNef struct {
+	mu               sync.Mutex
+	url              string
+	createStatus     int
+	createDelay      time.Duration
+	noSubscriptionId bool // The created subscription has no subscriptionId in its Location
+	deleteStatus     int
+	created          int
+	deleted          []string          // subscriptionIds
+	subscriptions    map[string]string // Found by the GETs. notificationDestination by subscriptionId
+}
+
+func (f *fakeNef) subscription(subscriptionId string) map[string]interface{} {
+	return map[string]interface{}{
+		"self":                    f.url + "/3gpp-as-session-with-qos/v1/" + testScsAsId + "/subscriptions/" + subscriptionId,
+		"notificationDestination": f.subscriptions[subscriptionId],
+	}
+}
+
+func (f *fakeNef) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		time.Sleep(f.createDelay)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/3gpp-as-session-with-qos/v1/"+testScsAsId+"/subscriptions")
+	switch {
+	case r.Method == http.MethodPost && path == "":
+		if f.createStatus >= http.StatusMultipleChoices {
+			w.WriteHeader(f.createStatus)
+			return
+		}
+		f.created++
+		subscription := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&subscription)
+		location := f.url + r.URL.Path + "/" + strconv.Itoa(f.created)
+		if f.noSubscriptionId {
+			location = f.url + "/3gpp-as-session-with-qos/v1/" + testScsAsId
+		}
+		subscription["self"] = location
+		w.Header().Set("Location", location)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(f.createStatus)
+		json.NewEncoder(w).Encode(subscription)
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/"):
+		if f.deleteStatus == http.StatusNoContent {
+			f.deleted = append(f.deleted, strings.TrimPrefix(path, "/"))
+			delete(f.subscriptions, strings.TrimPrefix(path, "/"))
+		}
+		w.WriteHeader(f.deleteStatus)
+	case r.Method == http.MethodGet && path == "":
+		subscriptions := []map[string]interface{}{}
+		for subscriptionId := range f.subscriptions {
+			subscriptions = append(subscriptions, f.subscription(subscriptionId))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscriptions)
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/"):
+		subscriptionId := strings.TrimPrefix(path, "/")
+		if _, ok := f.subscriptions[subscriptionId]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f.subscription(subscriptionId))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Sets the context up with a memory store, with the AS provisioned with the
+// policy, and with a NEF client towards a fake NEF
+func newTestContext(t *testing.T, policy *util.AppServerPolicy) *fakeNef {
+	t.Helper()
+	db, err := store.NewStore(store.STORE_TYPE_MEMORY, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asData := &util.QoDProvAppServerData{Policy: policy}
+	asData.AsIpv4Addr = testAsAddr
+	asData.ScsAsId = testScsAsId
+	asData.QoSMap = map[string]string{string(api.E): "qos-e"}
+	if _, err := db.CreateAppServerData(asData); err != nil {
+		t.Fatal(err)
+	}
+
+	nef := &fakeNef{createStatus: http.StatusCreated, deleteStatus: http.StatusNoContent}
+	// The NEF API client speaks HTTP/2 over cleartext
+	srv := httptest.NewServer(h2c.NewHandler(nef, &http2.Server{}))
+	t.Cleanup(srv.Close)
+	nef.url = srv.URL
+	configuration := nefAsqSpec.NewConfiguration()
+	server := configuration.Servers[0].Variables["apiRoot"]
+	server.DefaultValue = srv.URL
+	configuration.Servers[0].Variables["apiRoot"] = server
+
+	qodCtx := qodContext.GetSelf()
+	saved := *qodCtx
+	t.Cleanup(func() { *qodCtx = saved })
+	qodCtx.Db = db
+	qodCtx.SessionMaxDurationSecs = testMaxSecs
+	qodCtx.NefHttpTimeoutSecs = 5
+	qodCtx.NefTokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"})
+	qodCtx.NefClient = nefAsqSpec.NewAPIClient(configuration)
+	return nef
+}
+
+// Stores a session of the client that started now and lasts duration secs
+func putTestSession(t *testing.T, clientId string, duration int32, asSlot bool) {
+	t.Helper()
+	ueAddr, asAddr := testUeAddr, testAsAddr
+	sessionReq := &api.CreateSession{
+		UeId: api.UeId{Ipv4addr: &ueAddr},
+		AsId: api.AsId{Ipv4addr: &asAddr},
+		Qos:  api.E,
+	}
+	now := time.Now().Unix()
+	apiData := util.QoDApiSessionInfo{
+		ScsAsId:           testScsAsId,
+		SessionId:         testSessionId,
+		NefSubscriptionId: "9",
+		UeIpv4Addr:        ueAddr,
+		SessionReq:        sessionReq,
+		SessionInfo: &api.SessionInfo{
+			Id:        testSessionId,
+			Duration:  duration,
+			StartedAt: now,
+			ExpiresAt: now + int64(duration),
+			UeId:      sessionReq.UeId,
+			AsId:      sessionReq.AsId,
+			Qos:       sessionReq.Qos,
+		},
+		ClientId: clientId,
+	}
+	session := util.ConvertSpecToDbSessionInfo(&apiData)
+	session.AsSlot = asSlot
+	if err := qodContext.GetSelf().Db.PutSession(session); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func errorCode(errorInfo *api.ErrorInfo) string {
+	if errorInfo == nil {
+		return ""
+	}
+	return errorInfo.Code
+}
+
+// failingStore fails the reads of the sessions, as an unreachable db would
+type failingStore struct {
+	store.Store
+}
+
+func (s failingStore) GetSession(sessionId string) (*util.QoDServiceSession, error) {
+	return nil, errors.New("server selection timeout")
+}
+
+func TestCreateSession(t *testing.T) {
+	newReq := func(asAddr string, qos api.QosProfile, duration int32) *util.CreateSessionReq {
+		ueAddr := testUeAddr
+		return &util.CreateSessionReq{
+			SessionReq: &api.CreateSession{
+				UeId:     api.UeId{Ipv4addr: &ueAddr},
+				AsId:     api.AsId{Ipv4addr: &asAddr},
+				Qos:      qos,
+				Duration: &duration,
+			},
+			ClientId: testClientId,
+		}
+	}
+
+	defaultReq := newReq(testAsAddr, api.E, 0)
+	defaultReq.SessionReq.Duration = nil
+
+	tests := []struct {
+		name         string
+		policy       *util.AppServerPolicy
+		slotsTaken   int // Before the create
+		createStatus int // Of NEF
+		req          *util.CreateSessionReq
+		wantCode     string
+		wantSlot     bool  // The session holds a slot
+		wantDuration int32 // 600 if not given
+	}{
+		{
+			name: "created",
+			req:  newReq(testAsAddr, api.E, 600),
+		},
+		{
+			name:     "created with a slot",
+			policy:   &util.AppServerPolicy{MaxConcurrentSessions: 2},
+			req:      newReq(testAsAddr, api.E, 600),
+			wantSlot: true,
+		},
+		{
+			name:     "duration beyond the configured max",
+			req:      newReq(testAsAddr, api.E, testMaxSecs+1),
+			wantCode: util.OUT_OF_RANGE,
+		},
+		{
+			name:         "default duration capped to the configured max",
+			req:          defaultReq,
+			wantDuration: testMaxSecs,
+		},
+		{
+			name:     "AS not provisioned",
+			req:      newReq("10.0.0.200", api.E, 600),
+			wantCode: util.INVALID_INPUT,
+		},
+		{
+			name:     "qosProfile not provisioned",
+			req:      newReq(testAsAddr, api.L, 600),
+			wantCode: util.INVALID_INPUT,
+		},
+		{
+			name:     "duration beyond the policy",
+			policy:   &util.AppServerPolicy{MaxDurationSecs: 300},
+			req:      newReq(testAsAddr, api.E, 600),
+			wantCode: util.OUT_OF_RANGE,
+		},
+		{
+			name:       "all slots taken",
+			policy:     &util.AppServerPolicy{MaxConcurrentSessions: 1},
+			slotsTaken: 1,
+			req:        newReq(testAsAddr, api.E, 600),
+			wantCode:   util.QUOTA_EXCEEDED,
+		},
+		{
+			name:         "NEF failure",
+			policy:       &util.AppServerPolicy{MaxConcurrentSessions: 1},
+			createStatus: http.StatusInternalServerError,
+			req:          newReq(testAsAddr, api.E, 600),
+			wantCode:     util.INTERNAL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nef := newTestContext(t, tt.policy)
+			if tt.createStatus != 0 {
+				nef.createStatus = tt.createStatus
+			}
+			db := qodContext.GetSelf().Db
+			for i := 0; i < tt.slotsTaken; i++ {
+				db.ReserveAppServerSlot(testScsAsId, tt.policy.MaxConcurrentSessions, 0)
+			}
+
+			rsp := HandleCreateSessionRequest(tt.req)
+			if code := errorCode(rsp.ErrorInfo); code != tt.wantCode {
+				t.Fatalf("error %v, want %v", rsp.ErrorInfo, tt.wantCode)
+			}
+			if tt.wantCode != "" {
+				sessions, _ := db.GetAllSessions()
+				if len(sessions) != 0 {
+					t.Errorf("%v session(s) stored", len(sessions))
+				}
+				if tt.policy != nil && tt.policy.MaxConcurrentSessions != 0 {
+					// The slot taken by the failed create is given back
+					reserved, _ := db.ReserveAppServerSlot(testScsAsId, tt.policy.MaxConcurrentSessions, 0)
+					if reserved != (tt.slotsTaken < tt.policy.MaxConcurrentSessions) {
+						t.Errorf("slot of the failed create not released")
+					}
+				}
+				return
+			}
+			session, err := db.GetSession(rsp.SessionInfo.Id)
+			if err != nil {
+				t.Fatalf("session not stored: %v", err)
+			}
+			if session.ClientId != testClientId || session.ScsAsId != testScsAsId {
+				t.Errorf("stored with clientId %v & scsAsId %v", session.ClientId, session.ScsAsId)
+			}
+			if session.NefSubscriptionId != "1" || session.NefSubscriptionResource == "" {
+				t.Errorf("stored with NEF subscription %v %v", session.NefSubscriptionId, session.NefSubscriptionResource)
+			}
+			if session.AsSlot != tt.wantSlot {
+				t.Errorf("asSlot %v, want %v", session.AsSlot, tt.wantSlot)
+			}
+			wantDuration := tt.wantDuration
+			if wantDuration == 0 {
+				wantDuration = 600
+			}
+			if rsp.SessionInfo.Duration != wantDuration || rsp.SessionInfo.ExpiresAt != rsp.SessionInfo.StartedAt+int64(wantDuration) {
+				t.Errorf("duration %v from %v to %v", rsp.SessionInfo.Duration, rsp.SessionInfo.StartedAt,
+					rsp.SessionInfo.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestCreateSessionRollback(t *testing.T) {
+	tests := []struct {
+		name             string
+		createStatus     int
+		createDelay      time.Duration
+		noSubscriptionId bool
+		deleteStatus     int
+		wantDeleted      []string
+		wantDeadLetter   *store.NefDeadLetter // Only the NEF subscription is compared, the resource by its end
+	}{
+		{
+			name:         "refused by NEF",
+			createStatus: http.StatusInternalServerError,
+		},
+		{
+			name:         "created with 200",
+			createStatus: http.StatusOK,
+			wantDeleted:  []string{"1"},
+		},
+		{
+			name:           "rollback failed",
+			createStatus:   http.StatusOK,
+			deleteStatus:   http.StatusInternalServerError,
+			wantDeadLetter: &store.NefDeadLetter{ScsAsId: testScsAsId, NefSubscriptionId: "1", NefSubscriptionResource: "/subscriptions/1"},
+		},
+		{
+			name:             "no subscriptionId",
+			noSubscriptionId: true,
+			wantDeadLetter:   &store.NefDeadLetter{ScsAsId: testScsAsId, NefSubscriptionResource: "/3gpp-as-session-with-qos/v1/" + testScsAsId},
+		},
+		{
+			name:           "timed out",
+			createDelay:    1500 * time.Millisecond,
+			wantDeadLetter: &store.NefDeadLetter{ScsAsId: testScsAsId},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nef := newTestContext(t, nil)
+			qodContext.GetSelf().NefHttpTimeoutSecs = 1
+			if tt.createStatus != 0 {
+				nef.createStatus = tt.createStatus
+			}
+			if tt.deleteStatus != 0 {
+				nef.deleteStatus = tt.deleteStatus
+			}
+			nef.createDelay = tt.createDelay
+			nef.noSubscriptionId = tt.noSubscriptionId
+			ueAddr, asAddr, duration := testUeAddr, testAsAddr, int32(600)
+			req := &util.CreateSessionReq{
+				SessionReq: &api.CreateSession{
+					UeId:     api.UeId{Ipv4addr: &ueAddr},
+					AsId:     api.AsId{Ipv4addr: &asAddr},
+					Qos:      api.E,
+					Duration: &duration,
+				},
+				ClientId: testClientId,
+			}
+
+			rsp := HandleCreateSessionRequest(req)
+			if code := errorCode(rsp.ErrorInfo); code != util.INTERNAL {
+				t.Fatalf("error %v, want %v", rsp.ErrorInfo, util.INTERNAL)
+			}
+			nef.mu.Lock()
+			deleted := nef.deleted
+			nef.mu.Unlock()
+			if strings.Join(deleted, ",") != strings.Join(tt.wantDeleted, ",") {
+				t.Errorf("NEF subscriptions deleted %v, want %v", deleted, tt.wantDeleted)
+			}
+			deadLetters, _ := qodContext.GetSelf().Db.GetNefDeadLetters()
+			if tt.wantDeadLetter == nil {
+				if len(deadLetters) != 0 {
+					t.Errorf("dead letters %v", deadLetters)
+				}
+				return
+			}
+			if len(deadLetters) != 1 {
+				t.Fatalf("dead letters %v, want one", deadLetters)
+			}
+			got := deadLetters[0]
+			wantResource := tt.wantDeadLetter.NefSubscriptionResource
+			if got.ScsAsId != tt.wantDeadLetter.ScsAsId || got.NefSubscriptionId != tt.wantDeadLetter.NefSubscriptionId ||
+				(wantResource == "" && got.NefSubscriptionResource != "") || !strings.HasSuffix(got.NefSubscriptionResource, wantResource) {
+				t.Errorf("dead letter %+v, want %+v", got, *tt.wantDeadLetter)
+			}
+		})
+	}
+}
+
+func TestGetSession(t *testing.T) {
+	tests := []struct {
+		name      string
+		owner     string
+		req       util.GetSessionReq
+		failingDb bool
+		wantCode  string
+	}{
+		{"owner", testClientId, util.GetSessionReq{SessionId: testSessionId, ClientId: testClientId}, false, ""},
+		{"admin", testClientId, util.GetSessionReq{SessionId: testSessionId, ClientId: "admin", IsAdmin: true}, false, ""},
+		{"other client", testClientId, util.GetSessionReq{SessionId: testSessionId, ClientId: "client2"}, false, util.NOT_FOUND},
+		{"session without owner", "", util.GetSessionReq{SessionId: testSessionId, ClientId: testClientId}, false, util.NOT_FOUND},
+		{"unknown session", testClientId, util.GetSessionReq{SessionId: "session2", ClientId: testClientId}, false, util.NOT_FOUND},
+		{"db failure", testClientId, util.GetSessionReq{SessionId: testSessionId, ClientId: testClientId}, true, util.INTERNAL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestContext(t, nil)
+			putTestSession(t, tt.owner, 600, false)
+			if tt.failingDb {
+				qodContext.GetSelf().Db = failingStore{qodContext.GetSelf().Db}
+			}
+
+			rsp := HandleGetSessionRequest(&tt.req)
+			if code := errorCode(rsp.ErrorInfo); code != tt.wantCode {
+				t.Fatalf("error %v, want %v", rsp.ErrorInfo, tt.wantCode)
+			}
+			if tt.wantCode == "" && (rsp.SessionInfo == nil || rsp.SessionInfo.Id != testSessionId) {
+				t.Errorf("got session %v", rsp.SessionInfo)
+			}
+		})
+	}
+}
+
+func TestExtendSession(t *testing.T) {
+	tests := []struct {
+		name         string
+		duration     int32 // Of the stored session, negative when it expired already
+		policy       *util.AppServerPolicy
+		clientId     string
+		additional   int32
+		wantCode     string
+		wantDuration int32
+	}{
+		{"extended", 600, nil, testClientId, 300, "", 900},
+		{"capped to the max", 600, nil, testClientId, 600, "", testMaxSecs},
+		{"capped to the policy", 600, &util.AppServerPolicy{MaxDurationSecs: 700}, testClientId, 300, "", 700},
+		{"at the max", testMaxSecs, nil, testClientId, 300, util.OUT_OF_RANGE, 0},
+		{"expired", -1, nil, testClientId, 300, util.NOT_FOUND, 0},
+		{"other client", 600, nil, "client2", 300, util.NOT_FOUND, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestContext(t, tt.policy)
+			putTestSession(t, testClientId, tt.duration, false)
+
+			rsp := HandleExtendSessionRequest(&util.ExtendSessionReq{
+				SessionId:          testSessionId,
+				AdditionalDuration: tt.additional,
+				ClientId:           tt.clientId,
+			})
+			if code := errorCode(rsp.ErrorInfo); code != tt.wantCode {
+				t.Fatalf("error %v, want %v", rsp.ErrorInfo, tt.wantCode)
+			}
+			session, err := qodContext.GetSelf().Db.GetSession(testSessionId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCode != "" {
+				if session.SessionInfo.Duration != tt.duration {
+					t.Errorf("stored duration changed to %v", session.SessionInfo.Duration)
+				}
+				return
+			}
+			sessionInfo := &session.SessionInfo
+			if sessionInfo.Duration != tt.wantDuration || sessionInfo.ExpiresAt != sessionInfo.StartedAt+int64(tt.wantDuration) {
+				t.Errorf("stored duration %v from %v to %v, want %v", sessionInfo.Duration, sessionInfo.StartedAt,
+					sessionInfo.ExpiresAt, tt.wantDuration)
+			}
+			if rsp.SessionInfo.Duration != tt.wantDuration {
+				t.Errorf("answered duration %v, want %v", rsp.SessionInfo.Duration, tt.wantDuration)
+			}
+		})
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientId     string
+		deleteStatus int // Of NEF
+		wantCode     string
+		wantNef      bool // The NEF subscription is deleted
+	}{
+		{"deleted", testClientId, http.StatusNoContent, "", true},
+		{"already gone at NEF", testClientId, http.StatusNotFound, "", false},
+		{"NEF failure", testClientId, http.StatusInternalServerError, util.INTERNAL, false},
+		{"other client", "client2", http.StatusNoContent, util.NOT_FOUND, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &util.AppServerPolicy{MaxConcurrentSessions: 1}
+			nef := newTestContext(t, policy)
+			nef.deleteStatus = tt.deleteStatus
+			db := qodContext.GetSelf().Db
+			db.ReserveAppServerSlot(testScsAsId, policy.MaxConcurrentSessions, 0)
+			putTestSession(t, testClientId, 600, true)
+
+			rsp := HandleDeleteSessionRequest(&util.DeleteSessionReq{SessionId: testSessionId, ClientId: tt.clientId})
+			if code := errorCode(rsp.ErrorInfo); code != tt.wantCode {
+				t.Fatalf("error %v, want %v", rsp.ErrorInfo, tt.wantCode)
+			}
+			if deleted := len(nef.deleted) == 1 && nef.deleted[0] == "9"; deleted != tt.wantNef {
+				t.Errorf("NEF subscriptions deleted %v", nef.deleted)
+			}
+			_, err := db.GetSession(testSessionId)
+			reserved, _ := db.ReserveAppServerSlot(testScsAsId, policy.MaxConcurrentSessions, 0)
+			if tt.wantCode != "" {
+				if err != nil || reserved {
+					t.Errorf("session not kept: %v, slot released %v", err, reserved)
+				}
+				return
+			}
+			if err != store.ErrNotFound || !reserved {
+				t.Errorf("session not deleted: %v, slot released %v", err, reserved)
+			}
+		})
+	}
+}
+
+// The handlers of an existing session tell a session not in the store from a failing store
+func TestSessionLookupError(t *testing.T) {
+	handlers := map[string]func(sessionId string) *api.ErrorInfo{
+		"get": func(sessionId string) *api.ErrorInfo {
+			return HandleGetSessionRequest(&util.GetSessionReq{SessionId: sessionId, ClientId: testClientId}).ErrorInfo
+		},
+		"extend": func(sessionId string) *api.ErrorInfo {
+			return HandleExtendSessionRequest(&util.ExtendSessionReq{SessionId: sessionId, AdditionalDuration: 60,
+				ClientId: testClientId}).ErrorInfo
+		},
+		"delete": func(sessionId string) *api.ErrorInfo {
+			return HandleDeleteSessionRequest(&util.DeleteSessionReq{SessionId: sessionId, ClientId: testClientId}).ErrorInfo
+		},
+	}
+	tests := []struct {
+		name      string
+		sessionId string
+		dbFailure bool
+		wantCode  string
+	}{
+		{"unknown session", "session2", false, util.NOT_FOUND},
+		{"db failure", testSessionId, true, util.INTERNAL},
+	}
+	for handlerName, handle := range handlers {
+		for _, tt := range tests {
+			t.Run(handlerName+" "+tt.name, func(t *testing.T) {
+				newTestContext(t, nil)
+				putTestSession(t, testClientId, 600, false)
+				if tt.dbFailure {
+					qodContext.GetSelf().Db = failingStore{qodContext.GetSelf().Db}
+				}
+
+				errorInfo := handle(tt.sessionId)
+				if code := errorCode(errorInfo); code != tt.wantCode {
+					t.Fatalf("error %v, want %v", errorInfo, tt.wantCode)
+				}
+				if !strings.Contains(errorInfo.Message, tt.sessionId) {
+					t.Errorf("message %q without the sessionId", errorInfo.Message)
+				}
+			})
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	const ourDestination = "http://qod:9090/notifications"
+	longAgo := time.Now().Unix() - factory.QOD_DEFAULT_RECONCILE_ORPHAN_AGE_SECS - 1
+	tests := []struct {
+		name            string
+		duration        int32             // Of the session with NEF subscriptionId 9. No session if 0
+		subscriptions   map[string]string // At NEF
+		noNotifyUrl     bool
+		deleteOrphans   bool
+		orphanSeenAt    map[string]int64 // By the earlier runs
+		deadLetters     []store.NefDeadLetter
+		deleteStatus    int // Of NEF
+		want            util.ReconcileReport
+		wantMissing     bool     // The session is marked
+		wantDeleted     []string // At NEF
+		wantDeadLetters int      // Left
+		wantSeen        []string // Orphans remembered for the next run
+	}{
+		{
+			name:          "in sync",
+			duration:      600,
+			subscriptions: map[string]string{"9": ourDestination},
+			want:          util.ReconcileReport{SessionsChecked: 1, NefSubscriptions: 1},
+		},
+		{
+			name:        "subscription missing",
+			duration:    600,
+			want:        util.ReconcileReport{SessionsChecked: 1, SubscriptionsMissing: 1},
+			wantMissing: true,
+		},
+		{
+			name:          "expired session left to the expiry",
+			duration:      -1,
+			subscriptions: map[string]string{"9": ourDestination},
+			want:          util.ReconcileReport{NefSubscriptions: 1},
+		},
+		{
+			name:          "orphan seen first",
+			subscriptions: map[string]string{"5": ourDestination},
+			deleteOrphans: true,
+			want:          util.ReconcileReport{NefSubscriptions: 1, OrphansFound: 1},
+			wantSeen:      []string{"5"},
+		},
+		{
+			name:          "orphan past the grace reported only",
+			subscriptions: map[string]string{"5": ourDestination},
+			orphanSeenAt:  map[string]int64{"5": longAgo},
+			want:          util.ReconcileReport{NefSubscriptions: 1, OrphansFound: 1},
+			wantSeen:      []string{"5"},
+		},
+		{
+			name:          "orphan past the grace deleted",
+			subscriptions: map[string]string{"5": ourDestination},
+			deleteOrphans: true,
+			orphanSeenAt:  map[string]int64{"5": longAgo},
+			want:          util.ReconcileReport{NefSubscriptions: 1, OrphansFound: 1, OrphansDeleted: 1},
+			wantDeleted:   []string{"5"},
+		},
+		{
+			name:          "orphan delete failed",
+			subscriptions: map[string]string{"5": ourDestination},
+			deleteOrphans: true,
+			orphanSeenAt:  map[string]int64{"5": longAgo},
+			deleteStatus:  http.StatusInternalServerError,
+			want:          util.ReconcileReport{NefSubscriptions: 1, OrphansFound: 1, Errors: 1},
+			wantSeen:      []string{"5"},
+		},
+		{
+			name:          "subscription of another AF",
+			subscriptions: map[string]string{"7": "http://other:9090/notifications"},
+			deleteOrphans: true,
+			orphanSeenAt:  map[string]int64{"7": longAgo},
+		},
+		{
+			name:          "no notification server",
+			subscriptions: map[string]string{"5": ourDestination},
+			noNotifyUrl:   true,
+			deleteOrphans: true,
+			orphanSeenAt:  map[string]int64{"5": longAgo},
+		},
+		{
+			name:          "dead letter cleared",
+			subscriptions: map[string]string{"3": ourDestination},
+			deadLetters:   []store.NefDeadLetter{{ScsAsId: testScsAsId, NefSubscriptionId: "3"}},
+			want:          util.ReconcileReport{DeadLettersCleared: 1},
+			wantDeleted:   []string{"3"},
+		},
+		{
+			name:            "dead letter delete failed",
+			subscriptions:   map[string]string{"3": ourDestination},
+			deadLetters:     []store.NefDeadLetter{{ScsAsId: testScsAsId, NefSubscriptionId: "3"}},
+			deleteStatus:    http.StatusInternalServerError,
+			want:            util.ReconcileReport{NefSubscriptions: 1, OrphansFound: 1, Errors: 1},
+			wantDeadLetters: 1,
+			wantSeen:        []string{"3"},
+		},
+		{
+			name:            "dead letter without subscriptionId",
+			deadLetters:     []store.NefDeadLetter{{ScsAsId: testScsAsId, NefSubscriptionResource: "/subscriptions"}},
+			wantDeadLetters: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nef := newTestContext(t, nil)
+			if tt.deleteStatus != 0 {
+				nef.deleteStatus = tt.deleteStatus
+			}
+			nef.subscriptions = tt.subscriptions
+			qodCtx := qodContext.GetSelf()
+			if !tt.noNotifyUrl {
+				qodCtx.NotificationServiceUrl = ourDestination
+			}
+			qodCtx.ReconcileDeleteOrphans = tt.deleteOrphans
+			orphanSeenAt = map[nefSubscriptionKey]int64{}
+			for subscriptionId, seenAt := range tt.orphanSeenAt {
+				orphanSeenAt[nefSubscriptionKey{testScsAsId, subscriptionId}] = seenAt
+			}
+			t.Cleanup(func() { orphanSeenAt = map[nefSubscriptionKey]int64{} })
+			if tt.duration != 0 {
+				putTestSession(t, testClientId, tt.duration, false)
+			}
+			for i := range tt.deadLetters {
+				qodCtx.Db.PutNefDeadLetter(&tt.deadLetters[i])
+			}
+
+			report, err := reconcile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.StartedAt = report.StartedAt
+			if *report != tt.want {
+				t.Errorf("report %+v, want %+v", *report, tt.want)
+			}
+			if tt.duration != 0 {
+				session, err := qodCtx.Db.GetSession(testSessionId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if session.NefSubscriptionMissing != tt.wantMissing || (len(session.SessionInfo.Messages) != 0) != tt.wantMissing {
+					t.Errorf("nefSubscriptionMissing %v with messages %v, want %v",
+						session.NefSubscriptionMissing, session.SessionInfo.Messages, tt.wantMissing)
+				}
+			}
+			if strings.Join(nef.deleted, ",") != strings.Join(tt.wantDeleted, ",") {
+				t.Errorf("deleted at NEF %v, want %v", nef.deleted, tt.wantDeleted)
+			}
+			deadLetters, _ := qodCtx.Db.GetNefDeadLetters()
+			if len(deadLetters) != tt.wantDeadLetters {
+				t.Errorf("%v dead letters left, want %v", len(deadLetters), tt.wantDeadLetters)
+			}
+			if len(orphanSeenAt) != len(tt.wantSeen) {
+				t.Errorf("orphans seen %v, want %v", orphanSeenAt, tt.wantSeen)
+			}
+			for _, subscriptionId := range tt.wantSeen {
+				seenAt, ok := orphanSeenAt[nefSubscriptionKey{testScsAsId, subscriptionId}]
+				if wantSeenAt, earlier := tt.orphanSeenAt[subscriptionId]; !ok || (earlier && seenAt != wantSeenAt) {
+					t.Errorf("orphan %v seen at %v, want %v", subscriptionId, seenAt, tt.orphanSeenAt[subscriptionId])
+				}
+			}
+		})
+	}
+}
+
+// The slots taken of the AS are set back to the sessions holding one, unless taken recently
+func TestReconcileAppServerSlots(t *testing.T) {
+	tests := []struct {
+		name      string
+		takenAt   int64
+		wantTaken int
+	}{
+		{"resynced", time.Now().Unix() - factory.QOD_DEFAULT_RECONCILE_ORPHAN_AGE_SECS - 1, 1},
+		{"taken recently", time.Now().Unix(), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestContext(t, &util.AppServerPolicy{MaxConcurrentSessions: 3})
+			db := qodContext.GetSelf().Db
+			for i := 0; i < 3; i++ {
+				db.ReserveAppServerSlot(testScsAsId, 3, tt.takenAt)
+			}
+			// Only one of the creates stored its session
+			putTestSession(t, testClientId, 600, true)
+
+			if _, err := reconcile(); err != nil {
+				t.Fatal(err)
+			}
+			taken := 0
+			for ; taken < 3; taken++ {
+				if reserved, _ := db.ReserveAppServerSlot(testScsAsId, 3, 0); !reserved {
+					break
+				}
+			}
+			if taken = 3 - taken; taken != tt.wantTaken {
+				t.Errorf("%v slots taken, want %v", taken, tt.wantTaken)
+			}
+		})
+	}
+}
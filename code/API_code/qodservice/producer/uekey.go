@@ -0,0 +1,54 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package producer
+
+import (
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/qodservice/store"
+	"github.com/sfnuser/qodservice/util"
+)
+
+// The UE of a new session is keyed by the address the flow is described with.
+// A UE without address is keyed by its msisdn or externalId.
+func newUeKey(ueId *api.UeId, flowAddrs *util.FlowAddrs) store.UeKey {
+	switch {
+	case flowAddrs.UeAddr != "" && flowAddrs.Ipv6:
+		return store.UeKey{Field: store.UE_KEY_IPV6_ADDR, Value: flowAddrs.UeAddr}
+	case flowAddrs.UeAddr != "":
+		return store.UeKey{Field: store.UE_KEY_IPV4_ADDR, Value: flowAddrs.UeAddr}
+	case ueId.Msisdn != nil:
+		return store.UeKey{Field: store.UE_KEY_MSISDN, Value: util.NormalizeMsisdn(*ueId.Msisdn)}
+	default:
+		return store.UeKey{Field: store.UE_KEY_EXTERNAL_ID, Value: *ueId.ExternalId}
+	}
+}
+
+// All the keys a session of the UE may be stored with
+func newUeKeys(ueId *api.UeId) []store.UeKey {
+	var ues []store.UeKey
+	if ueId.Ipv4addr != nil {
+		ues = append(ues, store.UeKey{Field: store.UE_KEY_IPV4_ADDR, Value: *ueId.Ipv4addr})
+	}
+	if ueIpv6Addr := util.GetUeIpv6Addr(ueId); ueIpv6Addr != nil {
+		ues = append(ues, store.UeKey{Field: store.UE_KEY_IPV6_ADDR, Value: *ueIpv6Addr})
+	}
+	if ueId.Msisdn != nil {
+		ues = append(ues, store.UeKey{Field: store.UE_KEY_MSISDN, Value: util.NormalizeMsisdn(*ueId.Msisdn)})
+	}
+	if ueId.ExternalId != nil {
+		ues = append(ues, store.UeKey{Field: store.UE_KEY_EXTERNAL_ID, Value: *ueId.ExternalId})
+	}
+	return ues
+}
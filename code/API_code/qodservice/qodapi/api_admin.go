@@ -0,0 +1,199 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qodapi
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/producer"
+	"github.com/sfnuser/qodservice/util"
+	"go.uber.org/zap"
+)
+
+// Reconcile - Check the sessions against the NEF subscriptions now
+func Reconcile(c *gin.Context) {
+	logger.Api.Info("Reconcile")
+
+	rsp := producer.HandleReconcileRequest()
+	if rsp.ErrorInfo != nil {
+		statusCode := util.ConvertErrorToHttpStatusCode(rsp.ErrorInfo.Code)
+		rspBody, err := json.Marshal(rsp.ErrorInfo)
+		if err != nil {
+			logger.Api.Sugar().Errorf("failed to encode error info. err %v, statusCode %v", err, statusCode)
+		}
+		logger.Api.Sugar().Errorf("Reconcile: failed. errorInfo %v", rsp.ErrorInfo)
+		c.Data(statusCode, CONTENT_TYPE_DATA, rspBody)
+		return
+	}
+	rspBody, err := json.Marshal(rsp.Report)
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to encode reconcile report. err %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "Reconcile report could not be encoded")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	c.Data(http.StatusOK, CONTENT_TYPE_DATA, rspBody)
+}
+
+// Metrics - The expvar metrics of this instance
+var Metrics = gin.WrapH(expvar.Handler())
+
+// GetAppServers - List the provisioned application servers
+func GetAppServers(c *gin.Context) {
+	logger.Api.Info("Get AppServers")
+
+	rsp := producer.HandleGetAppServersRequest()
+	if rsp.ErrorInfo != nil {
+		adminErrorResponse(c, "GetAppServers", rsp.ErrorInfo)
+		return
+	}
+	adminDataResponse(c, "GetAppServers", http.StatusOK, rsp.Data)
+}
+
+// GetAppServer - Get the provisioned data of an application server
+func GetAppServer(c *gin.Context) {
+	asAddr := appServerAddr(c)
+	logger.Api.Info("Get AppServer", zap.String("asAddr", asAddr))
+
+	rsp := producer.HandleGetAppServerRequest(&util.AppServerReq{AsAddr: asAddr})
+	if rsp.ErrorInfo != nil {
+		adminErrorResponse(c, "GetAppServer", rsp.ErrorInfo)
+		return
+	}
+	adminDataResponse(c, "GetAppServer", http.StatusOK, rsp.Data)
+}
+
+// CreateAppServer - Provision an application server
+func CreateAppServer(c *gin.Context) {
+	requestBody, err := c.GetRawData()
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to get request body: %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "AppServer could not be created")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	var asData util.QoDProvAppServerData
+	if err := util.DecodeAppServerData(requestBody, &asData); err != nil {
+		logger.Api.Sugar().Errorf("failed to unmarshal request: %v", err)
+		data := util.NewQoDErrorInfo("INVALID_INPUT", "Schema validation failed")
+		c.Data(http.StatusBadRequest, CONTENT_TYPE_DATA, data)
+		return
+	}
+	if err := util.ValidateAppServerData(&asData); err != nil {
+		data := util.NewQoDErrorInfo("INVALID_INPUT", err.Error())
+		c.Data(http.StatusBadRequest, CONTENT_TYPE_DATA, data)
+		return
+	}
+	asAddr, _ := asData.AsAddr()
+	logger.Api.Info("Create AppServer", zap.String("asAddr", asAddr))
+
+	rsp := producer.HandleCreateAppServerRequest(&util.AppServerReq{AsAddr: asAddr, Data: &asData})
+	if rsp.ErrorInfo != nil {
+		adminErrorResponse(c, "CreateAppServer", rsp.ErrorInfo)
+		return
+	}
+	adminDataResponse(c, "CreateAppServer", http.StatusCreated, rsp.Data)
+}
+
+// UpdateAppServer - Replace the provisioned data of an application server. The
+// AS address may be left out of the body; it has to match the URI otherwise.
+func UpdateAppServer(c *gin.Context) {
+	asAddr := appServerAddr(c)
+	logger.Api.Info("Update AppServer", zap.String("asAddr", asAddr))
+
+	requestBody, err := c.GetRawData()
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to get request body: %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "AppServer could not be updated")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	var asData util.QoDProvAppServerData
+	if err := util.DecodeAppServerData(requestBody, &asData); err != nil {
+		logger.Api.Sugar().Errorf("failed to unmarshal request: %v", err)
+		data := util.NewQoDErrorInfo("INVALID_INPUT", "Schema validation failed")
+		c.Data(http.StatusBadRequest, CONTENT_TYPE_DATA, data)
+		return
+	}
+	if asData.AsIpv4Addr == "" && asData.AsIpv6Addr == "" {
+		if util.IsIpv6Addr(asAddr) {
+			asData.AsIpv6Addr = asAddr
+		} else {
+			asData.AsIpv4Addr = asAddr
+		}
+	}
+	if err := util.ValidateAppServerData(&asData); err != nil {
+		data := util.NewQoDErrorInfo("INVALID_INPUT", err.Error())
+		c.Data(http.StatusBadRequest, CONTENT_TYPE_DATA, data)
+		return
+	}
+	if bodyAsAddr, _ := asData.AsAddr(); bodyAsAddr != asAddr {
+		data := util.NewQoDErrorInfo("INVALID_INPUT", "asAddr of the body does not match the URI")
+		c.Data(http.StatusBadRequest, CONTENT_TYPE_DATA, data)
+		return
+	}
+
+	rsp := producer.HandleUpdateAppServerRequest(&util.AppServerReq{AsAddr: asAddr, Data: &asData})
+	if rsp.ErrorInfo != nil {
+		adminErrorResponse(c, "UpdateAppServer", rsp.ErrorInfo)
+		return
+	}
+	adminDataResponse(c, "UpdateAppServer", http.StatusOK, rsp.Data)
+}
+
+// DeleteAppServer - Remove the provisioned data of an application server
+func DeleteAppServer(c *gin.Context) {
+	asAddr := appServerAddr(c)
+	logger.Api.Info("Delete AppServer", zap.String("asAddr", asAddr))
+
+	rsp := producer.HandleDeleteAppServerRequest(&util.AppServerReq{AsAddr: asAddr})
+	if rsp.ErrorInfo != nil {
+		adminErrorResponse(c, "DeleteAppServer", rsp.ErrorInfo)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// The asAddr catch-all parameter starts with "/"
+func appServerAddr(c *gin.Context) string {
+	return util.NormalizeAsAddr(strings.TrimPrefix(c.Params.ByName("asAddr"), "/"))
+}
+
+func adminErrorResponse(c *gin.Context, operation string, errorInfo *api.ErrorInfo) {
+	statusCode := util.ConvertErrorToHttpStatusCode(errorInfo.Code)
+	rspBody, err := json.Marshal(errorInfo)
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to encode error info. err %v, statusCode %v", err, statusCode)
+	}
+	logger.Api.Sugar().Errorf("%v: failed. errorInfo %v", operation, errorInfo)
+	c.Data(statusCode, CONTENT_TYPE_DATA, rspBody)
+}
+
+func adminDataResponse(c *gin.Context, operation string, statusCode int, data interface{}) {
+	rspBody, err := json.Marshal(data)
+	if err != nil {
+		logger.Api.Sugar().Errorf("%v: failed to encode response. err %v", operation, err)
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA,
+			util.NewQoDErrorInfo("INTERNAL", "Response could not be encoded"))
+		return
+	}
+	c.Data(statusCode, CONTENT_TYPE_DATA, rspBody)
+}
@@ -31,6 +31,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/sfnuser/camara/qodmodels/api"
 	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/oauth2"
 	"github.com/sfnuser/qodservice/producer"
 	"github.com/sfnuser/qodservice/util"
 	"go.uber.org/zap"
@@ -46,7 +47,7 @@ func CreateSession(c *gin.Context) {
 		return
 	}
 	var sessionReq api.CreateSession
-	err = json.Unmarshal(requestBody, &sessionReq)
+	err = util.DecodeCreateSession(requestBody, &sessionReq)
 	if err != nil {
 		logger.Api.Sugar().Errorf("failed to unmarshal request: %v", err)
 		data := util.NewQoDErrorInfo("INVALID_INPUT", "Schema validation failed")
@@ -68,7 +69,10 @@ func CreateSession(c *gin.Context) {
 	}
 
 	// Handle the Create Session request
-	rsp := producer.HandleCreateSessionRequest(&util.CreateSessionReq{SessionReq: &sessionReq})
+	rsp := producer.HandleCreateSessionRequest(&util.CreateSessionReq{
+		SessionReq: &sessionReq,
+		ClientId:   oauth2.GetClientId(c),
+	})
 	var contentType string
 	var rspBody []byte
 	var statusCode int
@@ -107,7 +111,11 @@ func DeleteSession(c *gin.Context) {
 	logger.Api.Info("Delete Session", zap.String("sessionId", sessionId))
 
 	// Handle the Create Session request
-	rsp := producer.HandleDeleteSessionRequest(&util.DeleteSessionReq{SessionId: sessionId})
+	rsp := producer.HandleDeleteSessionRequest(&util.DeleteSessionReq{
+		SessionId: sessionId,
+		ClientId:  oauth2.GetClientId(c),
+		IsAdmin:   oauth2.IsAdmin(c),
+	})
 	if rsp.ErrorInfo != nil {
 		contentType := CONTENT_TYPE_DATA
 		statusCode := util.ConvertErrorToHttpStatusCode(rsp.ErrorInfo.Code)
@@ -125,6 +133,136 @@ func DeleteSession(c *gin.Context) {
 
 // GetSession - Get session information
 func GetSession(c *gin.Context) {
-	logger.Api.Sugar().Warnf("@todo: not implemented yet")
-	c.JSON(http.StatusOK, gin.H{})
+	sessionId := c.Params.ByName("sessionId")
+	logger.Api.Info("Get Session", zap.String("sessionId", sessionId))
+
+	// Handle the Get Session request
+	rsp := producer.HandleGetSessionRequest(&util.GetSessionReq{
+		SessionId: sessionId,
+		ClientId:  oauth2.GetClientId(c),
+		IsAdmin:   oauth2.IsAdmin(c),
+	})
+	if rsp.ErrorInfo != nil {
+		contentType := CONTENT_TYPE_DATA
+		statusCode := util.ConvertErrorToHttpStatusCode(rsp.ErrorInfo.Code)
+		rspBody, err := json.Marshal(rsp.ErrorInfo)
+		if err != nil {
+			logger.Api.Sugar().Errorf("failed to encode error info. err %v, statusCode %v", err, statusCode)
+		}
+		logger.Api.Sugar().Errorf("GetSession: failed. errorInfo %v", rsp.ErrorInfo)
+		c.Data(statusCode, contentType, rspBody)
+		return
+	}
+	rspBody, err := json.Marshal(rsp.SessionInfo)
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to encode session info. err %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "Session could not be retrieved")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	c.Data(http.StatusOK, CONTENT_TYPE_DATA, rspBody)
+}
+
+// ExtendSession - Extend the duration of an active session
+func ExtendSession(c *gin.Context) {
+	sessionId := c.Params.ByName("sessionId")
+	requestBody, err := c.GetRawData()
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to get request body: %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "Session could not be extended")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	var extendReq util.ExtendSessionDuration
+	err = json.Unmarshal(requestBody, &extendReq)
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to unmarshal request: %v", err)
+		data := util.NewQoDErrorInfo("INVALID_INPUT", "Schema validation failed")
+		c.Data(http.StatusBadRequest, CONTENT_TYPE_DATA, data)
+		return
+	}
+	err = util.ValidateExtendSessionReq(&extendReq)
+	if err != nil {
+		data := util.NewQoDErrorInfo("INVALID_INPUT", err.Error())
+		c.Data(http.StatusBadRequest, CONTENT_TYPE_DATA, data)
+		return
+	}
+	logger.Api.Info("Extend Session", zap.String("sessionId", sessionId),
+		zap.Int32("requestedAdditionalDuration", *extendReq.RequestedAdditionalDuration))
+
+	// Handle the Extend Session request
+	rsp := producer.HandleExtendSessionRequest(&util.ExtendSessionReq{
+		SessionId:          sessionId,
+		AdditionalDuration: *extendReq.RequestedAdditionalDuration,
+		ClientId:           oauth2.GetClientId(c),
+		IsAdmin:            oauth2.IsAdmin(c),
+	})
+	if rsp.ErrorInfo != nil {
+		statusCode := util.ConvertErrorToHttpStatusCode(rsp.ErrorInfo.Code)
+		rspBody, err := json.Marshal(rsp.ErrorInfo)
+		if err != nil {
+			logger.Api.Sugar().Errorf("failed to encode error info. err %v, statusCode %v", err, statusCode)
+		}
+		logger.Api.Sugar().Errorf("ExtendSession: failed. errorInfo %v", rsp.ErrorInfo)
+		c.Data(statusCode, CONTENT_TYPE_DATA, rspBody)
+		return
+	}
+	rspBody, err := json.Marshal(rsp.SessionInfo)
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to encode session info. err %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "Session could not be extended")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	c.Data(http.StatusOK, CONTENT_TYPE_DATA, rspBody)
+}
+
+// RetrieveSessions - Get the sessions of a device
+func RetrieveSessions(c *gin.Context) {
+	requestBody, err := c.GetRawData()
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to get request body: %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "Sessions could not be retrieved")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	var retrieveReq util.RetrieveSessionsInput
+	err = util.DecodeRetrieveSessions(requestBody, &retrieveReq)
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to unmarshal request: %v", err)
+		data := util.NewQoDErrorInfo("INVALID_INPUT", "Schema validation failed")
+		c.Data(http.StatusBadRequest, CONTENT_TYPE_DATA, data)
+		return
+	}
+	err = util.ValidateRetrieveSessionsReq(&retrieveReq)
+	if err != nil {
+		data := util.NewQoDErrorInfo("INVALID_INPUT", err.Error())
+		c.Data(http.StatusBadRequest, CONTENT_TYPE_DATA, data)
+		return
+	}
+	logger.Api.Sugar().Debugf("RetrieveSessions: Req: JSON(retrieveSessions): %s", requestBody)
+
+	// Handle the Retrieve Sessions request
+	rsp := producer.HandleRetrieveSessionsRequest(&util.RetrieveSessionsReq{
+		UeId:     retrieveReq.UeId,
+		ClientId: oauth2.GetClientId(c),
+	})
+	if rsp.ErrorInfo != nil {
+		statusCode := util.ConvertErrorToHttpStatusCode(rsp.ErrorInfo.Code)
+		rspBody, err := json.Marshal(rsp.ErrorInfo)
+		if err != nil {
+			logger.Api.Sugar().Errorf("failed to encode error info. err %v, statusCode %v", err, statusCode)
+		}
+		logger.Api.Sugar().Errorf("RetrieveSessions: failed. errorInfo %v", rsp.ErrorInfo)
+		c.Data(statusCode, CONTENT_TYPE_DATA, rspBody)
+		return
+	}
+	rspBody, err := json.Marshal(rsp.SessionInfos)
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to encode session info. err %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "Sessions could not be retrieved")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	c.Data(http.StatusOK, CONTENT_TYPE_DATA, rspBody)
 }
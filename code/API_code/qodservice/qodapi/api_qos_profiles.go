@@ -0,0 +1,67 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qodapi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/producer"
+	"github.com/sfnuser/qodservice/util"
+	"go.uber.org/zap"
+)
+
+// GetQosProfiles - The QoS profiles that can be requested
+func GetQosProfiles(c *gin.Context) {
+	logger.Api.Info("Get QosProfiles")
+
+	rsp := producer.HandleGetQosProfilesRequest()
+	rspBody, err := json.Marshal(rsp.QosProfiles)
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to encode qosProfiles. err %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "QoS profiles could not be encoded")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	c.Data(http.StatusOK, CONTENT_TYPE_DATA, rspBody)
+}
+
+// GetQosProfile - Get a QoS profile by its name
+func GetQosProfile(c *gin.Context) {
+	name := c.Params.ByName("name")
+	logger.Api.Info("Get QosProfile", zap.String("name", name))
+
+	rsp := producer.HandleGetQosProfileRequest(&util.GetQosProfileReq{Name: name})
+	if rsp.ErrorInfo != nil {
+		statusCode := util.ConvertErrorToHttpStatusCode(rsp.ErrorInfo.Code)
+		rspBody, err := json.Marshal(rsp.ErrorInfo)
+		if err != nil {
+			logger.Api.Sugar().Errorf("failed to encode error info. err %v, statusCode %v", err, statusCode)
+		}
+		logger.Api.Sugar().Errorf("GetQosProfile: failed. errorInfo %v", rsp.ErrorInfo)
+		c.Data(statusCode, CONTENT_TYPE_DATA, rspBody)
+		return
+	}
+	rspBody, err := json.Marshal(rsp.QosProfile)
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to encode qosProfile. err %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "QoS profile could not be encoded")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	c.Data(http.StatusOK, CONTENT_TYPE_DATA, rspBody)
+}
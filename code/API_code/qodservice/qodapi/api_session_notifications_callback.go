@@ -25,12 +25,46 @@
 package qodapi
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/producer"
+	"github.com/sfnuser/qodservice/util"
 )
 
-// PostNotification - Session notifications callback
+// PostNotification - NEF UserPlaneNotification callback
 func PostNotification(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{})
+	requestBody, err := c.GetRawData()
+	if err != nil {
+		logger.Api.Sugar().Errorf("failed to get notification body: %v", err)
+		data := util.NewQoDErrorInfo("INTERNAL", "Notification could not be read")
+		c.Data(http.StatusInternalServerError, CONTENT_TYPE_DATA, data)
+		return
+	}
+	logger.Api.Sugar().Debugf("PostNotification: Req: JSON(userPlaneNotificationData): %s", requestBody)
+
+	var notification util.NefUserPlaneNotification
+	err = json.Unmarshal(requestBody, &notification)
+	if err != nil || notification.Transaction == "" {
+		logger.Api.Sugar().Errorf("failed to unmarshal notification: %v", err)
+		data := util.NewQoDErrorInfo("INVALID_INPUT", "Schema validation failed")
+		c.Data(http.StatusBadRequest, CONTENT_TYPE_DATA, data)
+		return
+	}
+
+	// Handle the NEF notification
+	rsp := producer.HandleNefNotificationRequest(&util.NefNotificationReq{Notification: &notification})
+	if rsp.ErrorInfo != nil {
+		statusCode := util.ConvertErrorToHttpStatusCode(rsp.ErrorInfo.Code)
+		rspBody, err := json.Marshal(rsp.ErrorInfo)
+		if err != nil {
+			logger.Api.Sugar().Errorf("failed to encode error info. err %v, statusCode %v", err, statusCode)
+		}
+		logger.Api.Sugar().Errorf("PostNotification: failed. errorInfo %v", rsp.ErrorInfo)
+		c.Data(statusCode, CONTENT_TYPE_DATA, rspBody)
+		return
+	}
+	c.Status(http.StatusNoContent)
 }
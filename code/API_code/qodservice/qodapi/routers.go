@@ -18,6 +18,8 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sfnuser/qodservice/factory"
+	"github.com/sfnuser/qodservice/oauth2"
 )
 
 const (
@@ -25,6 +27,16 @@ const (
 	CONTENT_TYPE_DATA    = "application/json"
 )
 
+// OAuth2 scopes of the routes
+const (
+	SCOPE_SESSIONS_CREATE             = "qod:sessions:create"
+	SCOPE_SESSIONS_READ               = "qod:sessions:read"
+	SCOPE_SESSIONS_UPDATE             = "qod:sessions:update"
+	SCOPE_SESSIONS_DELETE             = "qod:sessions:delete"
+	SCOPE_SESSIONS_RETRIEVE_BY_DEVICE = "qod:sessions:retrieve-by-device"
+	SCOPE_QOS_PROFILES_READ           = "qod:qos-profiles:read"
+)
+
 // Route is the information for every URI.
 type Route struct {
 	// Name is the name of this Route.
@@ -35,6 +47,8 @@ type Route struct {
 	Pattern string
 	// HandlerFunc is the handler function of this route.
 	HandlerFunc gin.HandlerFunc
+	// Scopes of which the access token needs any. Any valid token if empty.
+	Scopes []string
 }
 
 // Routes is the list of the generated Route.
@@ -42,19 +56,44 @@ type Routes []Route
 
 // AddService adds the routes
 func AddService(engine *gin.Engine) *gin.RouterGroup {
-	group := engine.Group("/qod/v0")
+	group := engine.Group(factory.QOD_DEFAULT_SERVICE)
+	addRoutes(group, routes)
+	return group
+}
+
+// AddNotificationService adds the routes of the notification listener (NEF callbacks)
+func AddNotificationService(engine *gin.Engine) *gin.RouterGroup {
+	group := engine.Group(factory.QOD_DEFAULT_NOTIFICATION_SERVICE)
+	addRoutes(group, notificationRoutes)
+	return group
+}
 
+// AddAdminService adds the routes to operate this service. They all need the
+// admin scope. AS addresses in the URIs may be prefixes, hence asAddr is a
+// catch-all parameter that keeps the "/" of the prefix, escaped or not.
+func AddAdminService(engine *gin.Engine) *gin.RouterGroup {
+	group := engine.Group(factory.QOD_DEFAULT_ADMIN_SERVICE, oauth2.RequireAdmin())
+	addRoutes(group, adminRoutes)
+	return group
+}
+
+func addRoutes(group *gin.RouterGroup, routes Routes) {
 	for _, route := range routes {
+		handlers := []gin.HandlerFunc{route.HandlerFunc}
+		if len(route.Scopes) != 0 {
+			handlers = []gin.HandlerFunc{oauth2.RequireScopes(route.Scopes...), route.HandlerFunc}
+		}
 		switch route.Method {
 		case http.MethodGet:
-			group.GET(route.Pattern, route.HandlerFunc)
+			group.GET(route.Pattern, handlers...)
 		case http.MethodPost:
-			group.POST(route.Pattern, route.HandlerFunc)
+			group.POST(route.Pattern, handlers...)
+		case http.MethodPut:
+			group.PUT(route.Pattern, handlers...)
 		case http.MethodDelete:
-			group.DELETE(route.Pattern, route.HandlerFunc)
+			group.DELETE(route.Pattern, handlers...)
 		}
 	}
-	return group
 }
 
 // Index is the index handler.
@@ -68,6 +107,7 @@ var routes = Routes{
 		http.MethodGet,
 		"/",
 		Index,
+		nil,
 	},
 
 	{
@@ -75,6 +115,7 @@ var routes = Routes{
 		http.MethodDelete,
 		"/sessions/:sessionId",
 		DeleteSession,
+		[]string{SCOPE_SESSIONS_DELETE},
 	},
 
 	{
@@ -82,6 +123,7 @@ var routes = Routes{
 		http.MethodPost,
 		"/sessions",
 		CreateSession,
+		[]string{SCOPE_SESSIONS_CREATE},
 	},
 
 	{
@@ -89,5 +131,106 @@ var routes = Routes{
 		http.MethodGet,
 		"/sessions/:sessionId",
 		GetSession,
+		[]string{SCOPE_SESSIONS_READ},
+	},
+
+	{
+		"ExtendSession",
+		http.MethodPost,
+		"/sessions/:sessionId/extend",
+		ExtendSession,
+		[]string{SCOPE_SESSIONS_UPDATE},
+	},
+
+	{
+		"RetrieveSessions",
+		http.MethodPost,
+		"/retrieve-sessions",
+		RetrieveSessions,
+		[]string{SCOPE_SESSIONS_RETRIEVE_BY_DEVICE},
+	},
+
+	{
+		"GetQosProfiles",
+		http.MethodGet,
+		"/qos-profiles",
+		GetQosProfiles,
+		[]string{SCOPE_QOS_PROFILES_READ},
+	},
+
+	{
+		"GetQosProfile",
+		http.MethodGet,
+		"/qos-profiles/:name",
+		GetQosProfile,
+		[]string{SCOPE_QOS_PROFILES_READ},
+	},
+}
+
+var notificationRoutes = Routes{
+	{
+		"PostNotification",
+		http.MethodPost,
+		"",
+		PostNotification,
+		nil,
+	},
+}
+
+var adminRoutes = Routes{
+	{
+		"Reconcile",
+		http.MethodPost,
+		"/reconcile",
+		Reconcile,
+		nil,
+	},
+
+	{
+		"Metrics",
+		http.MethodGet,
+		"/metrics",
+		Metrics,
+		nil,
+	},
+
+	{
+		"GetAppServers",
+		http.MethodGet,
+		"/app-servers",
+		GetAppServers,
+		nil,
+	},
+
+	{
+		"CreateAppServer",
+		http.MethodPost,
+		"/app-servers",
+		CreateAppServer,
+		nil,
+	},
+
+	{
+		"GetAppServer",
+		http.MethodGet,
+		"/app-servers/*asAddr",
+		GetAppServer,
+		nil,
+	},
+
+	{
+		"UpdateAppServer",
+		http.MethodPut,
+		"/app-servers/*asAddr",
+		UpdateAppServer,
+		nil,
+	},
+
+	{
+		"DeleteAppServer",
+		http.MethodDelete,
+		"/app-servers/*asAddr",
+		DeleteAppServer,
+		nil,
 	},
 }
@@ -32,6 +32,9 @@ func main() {
 	app.Usage = "-h for help"
 	app.Action = action
 	app.Flags = QoD.GetCliCmd()
+	app.Commands = QoD.GetCommands()
+	// A --set value may hold commas, e.g. a list
+	app.DisableSliceFlagSeparator = true
 
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "%s Run Error: %v", app.Name, err)
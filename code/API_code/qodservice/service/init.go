@@ -21,6 +21,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/urfave/cli/v2"
@@ -29,6 +30,7 @@ import (
 	"github.com/sfnuser/qodservice/factory"
 	"github.com/sfnuser/qodservice/logger"
 	"github.com/sfnuser/qodservice/oauth2"
+	"github.com/sfnuser/qodservice/producer"
 	"github.com/sfnuser/qodservice/qodapi"
 	"github.com/sfnuser/qodservice/util"
 	"golang.org/x/net/http2"
@@ -38,11 +40,20 @@ import (
 type QoD struct{}
 
 type Config struct {
-	qodCfg string
+	qodCfg    string
+	overrides []string // path=value of the config fields
 }
 
 var config Config
 
+// TLS of the https servers and their cert & key. Nil with http. The notification
+// server has its own client CA, NEF not being one of the northbound clients.
+var (
+	tlsConfig       *tls.Config
+	notifyTlsConfig *tls.Config
+	certManager     *util.CertManager
+)
+
 var qodCli = []cli.Flag{
 	&cli.StringFlag{
 		Name:  "qodservice_cfg",
@@ -54,31 +65,96 @@ var qodCli = []cli.Flag{
 		Value:   "dev",
 		EnvVars: []string{"QODAPI_LOGMODE"},
 	},
+	&cli.StringSliceFlag{
+		Name:  "set",
+		Usage: "override a config field, after the QOD_* env vars (e.g. --set nef.serviceDomainName=nef.example)",
+	},
 }
 
 func (*QoD) GetCliCmd() (flags []cli.Flag) {
 	return qodCli
 }
 
-func StartHttpsServer(server *http.Server, env, srvDomainName string) (err error) {
-	logger.Init.Sugar().Infof("Attempting https: env %s", env)
+// Builds the TLS config of the https servers as per the TLS policy, with the cert &
+// key reloaded when renewed and the client CA of mTLS. Everything is validated here
+// so that a bad setup fails at startup, not at the first handshake.
+func initTls(service *factory.Service) (err error) {
+	policy := &util.TlsPolicy{}
+	if service.Tls != nil {
+		policy.MinVersion = service.Tls.MinVersion
+		policy.CipherSuites = service.Tls.CipherSuites
+	}
+	config, err := util.NewServerTlsConfig(policy)
+	if err != nil {
+		return err
+	}
 
-	c, err := util.GetTlsCredentialsWithoutRootCA(env, srvDomainName)
+	certManager, err = util.NewCertManager(service.Env, service.BindingDomainName)
 	if err != nil {
 		return fmt.Errorf("failed to get TLS credentials. error %v", err)
 	}
+	// Add the server credential. A renewed one is picked up without restart
+	config.GetCertificate = certManager.GetCertificate
+	notifyConfig := config.Clone()
 
-	cert, err := tls.X509KeyPair(c.GetMyCert(), c.GetMyKey())
-	if err != nil {
-		return fmt.Errorf("failed to get X509KeyPair. error %v", err)
+	// Verify the client certificates against the client CA bundle
+	if err = setClientAuth(config, service.Env, service.MTls); err != nil {
+		return err
+	}
+	if err = setClientAuth(notifyConfig, service.Env, service.NotifyMTls); err != nil {
+		return err
+	}
+
+	reloadSecs := factory.QOD_DEFAULT_CERT_RELOAD_SECS
+	if service.CertReloadSecs != 0 {
+		reloadSecs = service.CertReloadSecs
 	}
+	if reloadSecs > 0 {
+		certManager.Start(time.Second * time.Duration(reloadSecs))
+	}
+	tlsConfig = config
+	notifyTlsConfig = notifyConfig
+	return nil
+}
 
-	// Add the server credential
-	server.TLSConfig.Certificates = []tls.Certificate{
-		cert,
+// Without mTls no client certificate is requested
+func setClientAuth(config *tls.Config, env string, mTls *factory.MTls) error {
+	if mTls == nil {
+		return nil
+	}
+	c, err := util.GetTlsRootCA(env, mTls.ClientCaDir)
+	if err != nil {
+		return fmt.Errorf("failed to get client CA of %v. error %v", mTls.ClientCaDir, err)
 	}
+	if config.ClientCAs, err = c.GetRootCAPool(); err != nil {
+		return fmt.Errorf("bad client CA of %v. error %v", mTls.ClientCaDir, err)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if mTls.Optional {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+func StartHttpsServer(server *http.Server, config *tls.Config) (err error) {
+	logger.Init.Sugar().Infof("Attempting https: %v", server.Addr)
 
-	return server.ListenAndServeTLS("", "") // Cert & Key are already added
+	server.TLSConfig = config.Clone()
+	return server.ListenAndServeTLS("", "") // Cert & Key are served by the certManager
+}
+
+// Serves with the configured scheme. config is the TLS of the server with https
+func startServer(server *http.Server, config *tls.Config) (err error) {
+	service := factory.QodConfig.Configuration.Service
+	switch service.Scheme {
+	case "http":
+		err = server.ListenAndServe()
+	case "https":
+		err = StartHttpsServer(server, config)
+	default:
+		err = fmt.Errorf("unknown scheme %v", service.Scheme)
+	}
+	return err
 }
 
 func NewServer(addr string, handler http.Handler) (srv *http.Server) {
@@ -96,16 +172,17 @@ func NewQoD() *QoD {
 func (q *QoD) Initialize(c *cli.Context) (err error) {
 	// Read the Config
 	config = Config{
-		qodCfg: c.String("qodservice_cfg"), // QoDAPI_P config
+		qodCfg:    c.String("qodservice_cfg"), // QoDAPI_P config
+		overrides: c.StringSlice("set"),
 	}
 
 	if config.qodCfg != "" {
-		if err := factory.InitConfigFactory(config.qodCfg); err != nil {
+		if err := factory.InitConfigFactory(config.qodCfg, config.overrides...); err != nil {
 			return err
 		}
 	} else {
 		DefaultQodCfgConfigPath := "config/qodservice_cfg.yaml" // QoDAPI service config
-		if err := factory.InitConfigFactory(DefaultQodCfgConfigPath); err != nil {
+		if err := factory.InitConfigFactory(DefaultQodCfgConfigPath, config.overrides...); err != nil {
 			return err
 		}
 	}
@@ -131,23 +208,36 @@ func (q *QoD) Start(c *cli.Context) {
 		IssuerURL:           context.OAuth2Srv.IssuerURL,
 		PubKeyCacheDuration: context.OAuth2Srv.CacheDuration,
 		Audience:            make([]string, len(context.OAuth2Srv.Audience)),
-		AuthorizedScope:     make([]string, len(context.OAuth2Srv.AuthorizedScope)),
+		AdminScope:          context.OAuth2Srv.AdminScope,
+		MethodScopes:        context.OAuth2Srv.MethodScopes,
 	}
 	copy(oAuthConfig.Audience, context.OAuth2Srv.Audience)
-	copy(oAuthConfig.AuthorizedScope, context.OAuth2Srv.AuthorizedScope)
+	for _, issuer := range context.OAuth2Srv.Issuers {
+		oAuthConfig.Issuers = append(oAuthConfig.Issuers, oauth2.Issuer{
+			IssuerURL:  issuer.IssuerURL,
+			JwksURL:    issuer.JwksURL,
+			Algorithms: issuer.Algorithms,
+			Audience:   issuer.Audience,
+		})
+	}
 	logger.Init.Sugar().Infof("OAuth2: Config %v", oAuthConfig)
 	oAuth, err := oauth2.New(&oAuthConfig)
 	if err != nil {
-		logger.Init.Sugar().Fatalf("oauth2 config incorrect. conf %v", oAuthConfig)
+		logger.Init.Sugar().Fatalf("oauth2 config incorrect. conf %v. err %v", oAuthConfig, err)
 	}
 	authMiddlewareHandler, err := oAuth.AuthorizationMiddleware()
 	if err != nil {
 		logger.Init.Sugar().Fatalf("failed to setup OAuth2Middleware. err %v", err)
 	}
 	router.Use(authMiddlewareHandler)
+	// The client identity mapped from the verified client certificate
+	if service := factory.QodConfig.Configuration.Service; service != nil && service.MTls != nil &&
+		len(service.MTls.SubjectClientIds) > 0 {
+		router.Use(oauth2.ClientCertIdentity(service.MTls.SubjectClientIds))
+	}
 
 	router.Use(cors.New(cors.Config{
-		AllowMethods: []string{"GET", "POST", "DELETE"},
+		AllowMethods: []string{"GET", "POST", "PUT", "DELETE"},
 		AllowHeaders: []string{
 			"Authorization", "Origin", "Content-Length", "Content-Type", "User-Agent",
 			"Referrer", "Host", "Token", "X-Requested-With",
@@ -160,6 +250,25 @@ func (q *QoD) Start(c *cli.Context) {
 
 	// Add service handlers
 	qodapi.AddService(router)
+	qodapi.AddAdminService(router)
+
+	// Session events towards the clients
+	producer.StartNotifier()
+
+	// Sessions from before the owner was recorded
+	producer.LogOwnerlessSessions()
+
+	// Tear down sessions when they expire
+	producer.StartSessionExpiry()
+
+	// Check the sessions against the NEF subscriptions
+	producer.StartReconciler()
+
+	if service := factory.QodConfig.Configuration.Service; service.Scheme == "https" {
+		if err = initTls(service); err != nil {
+			logger.Init.Sugar().Fatalf("failed to init TLS. err %v", err)
+		}
+	}
 
 	// Handle Ctrl+C to gracefully terminate
 	signalChannel := make(chan os.Signal, 1)
@@ -170,15 +279,30 @@ func (q *QoD) Start(c *cli.Context) {
 		os.Exit(0)
 	}(c)
 
+	// Start the notification server. NEF posts its events here. NEF is authenticated
+	// by its certificate only, with notifyMtls. Otherwise the port must be reachable
+	// by NEF alone.
+	if context.NotifyPort != 0 {
+		if service := factory.QodConfig.Configuration.Service; service.Scheme != "https" || service.NotifyMTls == nil {
+			logger.Init.Sugar().Warnf("Notification server: NEF callbacks are not authenticated. Configure https with notifyMtls or restrict access to port %v",
+				context.NotifyPort)
+		}
+		notifyRouter := logger.NewRouterWithLogger(logger.Gin)
+		qodapi.AddNotificationService(notifyRouter)
+		notifyAddr := fmt.Sprintf("%s:%d", context.BindingDomainName, context.NotifyPort)
+		notifyServer := NewServer(notifyAddr, notifyRouter)
+		go func() {
+			if err := startServer(notifyServer, notifyTlsConfig); err != nil {
+				logger.Init.Sugar().Fatalf("failed to start notification server. err %v", err)
+			}
+		}()
+		logger.Init.Sugar().Infof("Notification server: %s", context.NotificationServiceUrl)
+	}
+
 	// Start the server
 	addr := fmt.Sprintf("%s:%d", qodContext.GetSelf().BindingDomainName, qodContext.GetSelf().Port)
 	server := NewServer(addr, router)
-	if factory.QodConfig.Configuration.Service.Scheme == "http" {
-		err = server.ListenAndServe()
-	} else if factory.QodConfig.Configuration.Service.Scheme == "https" {
-		err = StartHttpsServer(server, factory.QodConfig.Configuration.Service.Env, factory.QodConfig.Configuration.Service.BindingDomainName)
-	}
-
+	err = startServer(server, tlsConfig)
 	if err != nil {
 		logger.Init.Sugar().Fatalf("failed to start server. err %v", err)
 	}
@@ -189,5 +313,11 @@ func (q *QoD) Start(c *cli.Context) {
 func (q *QoD) Terminate(c *cli.Context) {
 	logger.Init.Sugar().Infof("%s: Terminated", c.App.Name)
 
+	if certManager != nil {
+		certManager.Stop()
+	}
+	producer.StopReconciler()
+	producer.StopSessionExpiry()
+	producer.StopNotifier()
 	qodContext.Terminate()
 }
@@ -0,0 +1,379 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+
+	qodContext "github.com/sfnuser/qodservice/context"
+	"github.com/sfnuser/qodservice/factory"
+	"github.com/sfnuser/qodservice/logger"
+	"github.com/sfnuser/qodservice/store"
+	"github.com/sfnuser/qodservice/util"
+)
+
+const (
+	PROVISION_FORMAT_YAML = "yaml"
+	PROVISION_FORMAT_JSON = "json"
+)
+
+// The provisioning file lists the application servers as they are provisioned
+// with the admin API
+type provisionFile struct {
+	AppServers []provisionEntry `yaml:"appServers" json:"appServers"`
+}
+type provisionEntry struct {
+	AsIpv4Addr string                `yaml:"asIpv4Addr,omitempty" json:"asIpv4Addr,omitempty"`
+	AsIpv6Addr string                `yaml:"asIpv6Addr,omitempty" json:"asIpv6Addr,omitempty"`
+	ScsAsId    string                `yaml:"scsAsId" json:"scsAsId"`
+	QoSMap     map[string]string     `yaml:"qosMap" json:"qosMap"`
+	Policy     *util.AppServerPolicy `yaml:"policy,omitempty" json:"policy,omitempty"`
+}
+
+var provisionFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "file",
+		Aliases: []string{"f"},
+		Usage:   "provisioning file, - for stdin/stdout",
+		Value:   "-",
+	},
+	&cli.StringFlag{
+		Name:  "format",
+		Usage: "yaml or json. Taken from the file extension if not given",
+	},
+}
+
+// GetCommands returns the subcommands besides running the service
+func (q *QoD) GetCommands() []*cli.Command {
+	return []*cli.Command{q.provisionCmd()}
+}
+
+func (q *QoD) provisionCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "provision",
+		Usage: "import or export the provisioned application servers",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "import",
+				Usage:  "provision the application servers of the file",
+				Action: q.provisionImport,
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only show the changes the import would make",
+					},
+					&cli.BoolFlag{
+						Name:  "prune",
+						Usage: "delete the application servers that are not in the file",
+					},
+				}, provisionFlags...),
+			},
+			{
+				Name:   "export",
+				Usage:  "write the provisioned application servers to the file",
+				Action: q.provisionExport,
+				Flags:  provisionFlags,
+			},
+		},
+	}
+}
+
+// Opens the store of the config. The memory store would be gone with this process.
+// The qosMaps are validated against the QoS profile catalogue of the config.
+func (q *QoD) openProvisioningStore(c *cli.Context) (store.Store, error) {
+	if err := q.Initialize(c); err != nil {
+		return nil, fmt.Errorf("failed to initialize. err %v", err)
+	}
+	logger.Initialize(c.String("logmode"))
+	if err := qodContext.InitQosProfiles(); err != nil {
+		return nil, fmt.Errorf("bad qosProfiles in the config. err %v", err)
+	}
+	db := factory.QodConfig.Configuration.Db
+	if db == nil {
+		return nil, errors.New("db section missing in the config")
+	}
+	if db.Type == store.STORE_TYPE_MEMORY {
+		return nil, errors.New("provisioning needs a persistent db, not the memory store")
+	}
+	return store.NewStore(db.Type, db.Name, db.Url)
+}
+
+func provisionFormat(c *cli.Context) (string, error) {
+	format := strings.ToLower(c.String("format"))
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(c.String("file"))) {
+		case ".json":
+			format = PROVISION_FORMAT_JSON
+		default:
+			format = PROVISION_FORMAT_YAML
+		}
+	}
+	switch format {
+	case "yml", PROVISION_FORMAT_YAML:
+		return PROVISION_FORMAT_YAML, nil
+	case PROVISION_FORMAT_JSON:
+		return PROVISION_FORMAT_JSON, nil
+	}
+	return "", fmt.Errorf("format %v not supported", format)
+}
+
+func readProvisionFile(c *cli.Context) ([]util.QoDProvAppServerData, error) {
+	format, err := provisionFormat(c)
+	if err != nil {
+		return nil, err
+	}
+	var content []byte
+	if file := c.String("file"); file == "-" {
+		content, err = ioutil.ReadAll(c.App.Reader)
+	} else {
+		content, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Unknown fields are rejected in both formats, a misspelt one would be dropped otherwise
+	var pf provisionFile
+	if format == PROVISION_FORMAT_JSON {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&pf)
+	} else {
+		err = yaml.UnmarshalStrict(content, &pf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v. err %v", format, err)
+	}
+
+	asData := make([]util.QoDProvAppServerData, 0, len(pf.AppServers))
+	seen := make(map[string]bool)
+	for i, entry := range pf.AppServers {
+		var data util.QoDProvAppServerData
+		data.AsIpv4Addr = entry.AsIpv4Addr
+		data.AsIpv6Addr = entry.AsIpv6Addr
+		data.ScsAsId = entry.ScsAsId
+		data.QoSMap = entry.QoSMap
+		data.Policy = entry.Policy
+		if err := util.ValidateAppServerData(&data); err != nil {
+			return nil, fmt.Errorf("appServers[%v]: %v", i, err)
+		}
+		asAddr, _ := data.AsAddr()
+		if seen[asAddr] {
+			return nil, fmt.Errorf("appServers[%v]: asAddr %v is listed twice", i, asAddr)
+		}
+		seen[asAddr] = true
+		asData = append(asData, data)
+	}
+	return asData, nil
+}
+
+func writeProvisionFile(c *cli.Context, asData []util.QoDProvAppServerData) error {
+	format, err := provisionFormat(c)
+	if err != nil {
+		return err
+	}
+	// Sorted so that the exports of the same data diff cleanly
+	sortAppServerData(asData)
+	pf := provisionFile{AppServers: make([]provisionEntry, 0, len(asData))}
+	for _, data := range asData {
+		pf.AppServers = append(pf.AppServers, provisionEntry{
+			AsIpv4Addr: data.AsIpv4Addr,
+			AsIpv6Addr: data.AsIpv6Addr,
+			ScsAsId:    data.ScsAsId,
+			QoSMap:     data.QoSMap,
+			Policy:     data.Policy,
+		})
+	}
+	var content []byte
+	if format == PROVISION_FORMAT_JSON {
+		content, err = json.MarshalIndent(&pf, "", "  ")
+		content = append(content, '\n')
+	} else {
+		content, err = yaml.Marshal(&pf)
+	}
+	if err != nil {
+		return err
+	}
+	if file := c.String("file"); file != "-" {
+		return ioutil.WriteFile(file, content, 0644)
+	}
+	_, err = c.App.Writer.Write(content)
+	return err
+}
+
+func sortAppServerData(asData []util.QoDProvAppServerData) {
+	sort.Slice(asData, func(i, j int) bool {
+		iAddr, _ := asData[i].AsAddr()
+		jAddr, _ := asData[j].AsAddr()
+		return iAddr < jAddr
+	})
+}
+
+// Change the import makes to the provisioned data of an AS
+type provisionChange struct {
+	op     string // add, update or delete
+	asData util.QoDProvAppServerData
+	old    *util.QoDProvAppServerData // On update
+}
+
+func diffAppServerData(current, wanted []util.QoDProvAppServerData, prune bool) []provisionChange {
+	byAddr := make(map[string]*util.QoDProvAppServerData, len(current))
+	for i := range current {
+		asAddr, _ := current[i].AsAddr()
+		byAddr[asAddr] = &current[i]
+	}
+	var changes []provisionChange
+	for _, data := range wanted {
+		asAddr, _ := data.AsAddr()
+		old, ok := byAddr[asAddr]
+		delete(byAddr, asAddr)
+		if !ok {
+			changes = append(changes, provisionChange{op: "add", asData: data})
+		} else if old.ScsAsId != data.ScsAsId || !reflect.DeepEqual(old.QoSMap, data.QoSMap) ||
+			!reflect.DeepEqual(old.Policy, data.Policy) {
+			changes = append(changes, provisionChange{op: "update", asData: data, old: old})
+		}
+	}
+	if prune {
+		var removed []util.QoDProvAppServerData
+		for _, old := range byAddr {
+			removed = append(removed, *old)
+		}
+		sortAppServerData(removed)
+		for _, data := range removed {
+			changes = append(changes, provisionChange{op: "delete", asData: data})
+		}
+	}
+	return changes
+}
+
+func printProvisionChange(w io.Writer, change *provisionChange) {
+	asAddr, _ := change.asData.AsAddr()
+	switch change.op {
+	case "add":
+		fmt.Fprintf(w, "+ %v scsAsId %v qosMap %v\n", asAddr, change.asData.ScsAsId, change.asData.QoSMap)
+	case "delete":
+		fmt.Fprintf(w, "- %v scsAsId %v qosMap %v\n", asAddr, change.asData.ScsAsId, change.asData.QoSMap)
+	case "update":
+		fmt.Fprintf(w, "~ %v\n", asAddr)
+		if change.old.ScsAsId != change.asData.ScsAsId {
+			fmt.Fprintf(w, "    scsAsId %v -> %v\n", change.old.ScsAsId, change.asData.ScsAsId)
+		}
+		if !reflect.DeepEqual(change.old.QoSMap, change.asData.QoSMap) {
+			fmt.Fprintf(w, "    qosMap %v -> %v\n", change.old.QoSMap, change.asData.QoSMap)
+		}
+		if !reflect.DeepEqual(change.old.Policy, change.asData.Policy) {
+			fmt.Fprintf(w, "    policy %v -> %v\n", formatPolicy(change.old.Policy), formatPolicy(change.asData.Policy))
+		}
+	}
+}
+
+func formatPolicy(policy *util.AppServerPolicy) string {
+	if policy == nil {
+		return "none"
+	}
+	data, _ := json.Marshal(policy)
+	return string(data)
+}
+
+func (q *QoD) provisionImport(c *cli.Context) error {
+	db, err := q.openProvisioningStore(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	wanted, err := readProvisionFile(c)
+	if err != nil {
+		return err
+	}
+
+	current, err := db.GetAllAppServerData()
+	if err != nil {
+		return fmt.Errorf("failed to get the provisioned data. err %v", err)
+	}
+	changes := diffAppServerData(current, wanted, c.Bool("prune"))
+	for i := range changes {
+		printProvisionChange(c.App.ErrWriter, &changes[i])
+	}
+	fmt.Fprintf(c.App.ErrWriter, "%v change(s), %v application server(s) in the file\n", len(changes), len(wanted))
+	if c.Bool("dry-run") {
+		return nil
+	}
+
+	// The file is validated and the changes are diffed against the provisioned data
+	// before anything is written. The changes are still written one by one, so a
+	// failure or a concurrent change leaves the ones before it in place.
+	for i := range changes {
+		if err := applyProvisionChange(db, &changes[i]); err != nil {
+			fmt.Fprintf(c.App.ErrWriter, "import stopped: %v of %v change(s) applied. Run it again to apply the rest\n",
+				i, len(changes))
+			return err
+		}
+	}
+	logger.Init.Sugar().Infof("Provisioning imported: %v change(s)", len(changes))
+	return nil
+}
+
+// Fails if the AS was added or deleted by someone else since the diff
+func applyProvisionChange(db store.Store, change *provisionChange) (err error) {
+	asAddr, ipv6 := change.asData.AsAddr()
+	var done bool
+	switch change.op {
+	case "add":
+		done, err = db.CreateAppServerData(&change.asData)
+	case "update":
+		done, err = db.UpdateAppServerData(&change.asData)
+	case "delete":
+		done, err = db.DeleteAppServerData(asAddr, ipv6)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to %v asAddr %v. err %v", change.op, asAddr, err)
+	}
+	switch {
+	case done:
+	case change.op == "add":
+		return fmt.Errorf("failed to add asAddr %v. It was provisioned in the meantime", asAddr)
+	case change.op == "update":
+		return fmt.Errorf("failed to update asAddr %v. It was deleted in the meantime", asAddr)
+	}
+	// An AS deleted in the meantime is gone as wanted
+	return nil
+}
+
+func (q *QoD) provisionExport(c *cli.Context) error {
+	db, err := q.openProvisioningStore(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	asData, err := db.GetAllAppServerData()
+	if err != nil {
+		return fmt.Errorf("failed to get the provisioned data. err %v", err)
+	}
+	return writeProvisionFile(c, asData)
+}
@@ -0,0 +1,408 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"sync"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/qodservice/notifier"
+	"github.com/sfnuser/qodservice/util"
+)
+
+// The memory store keeps everything in this process. It is meant for tests and
+// single replica setups without MongoDB; nothing survives a restart.
+
+type expiryLease struct {
+	owner string
+	until int64
+}
+
+type memorySession struct {
+	session util.QoDServiceSession
+	lease   *expiryLease
+}
+
+type memoryAppServerSlots struct {
+	taken   int
+	takenAt int64
+}
+
+type ueFlowKey struct {
+	ue      UeKey
+	scsAsId string
+}
+
+type memoryStore struct {
+	mu                  sync.Mutex
+	sessions            map[string]*memorySession // by sessionId
+	ueFlows             map[ueFlowKey]uint32
+	appServerSlots      map[string]*memoryAppServerSlots     // by scsAsId
+	appServers          map[string]util.QoDProvAppServerData // by asIpv4Addr or asIpv6Addr
+	failedNotifications []notifier.Delivery
+	nefDeadLetters      []NefDeadLetter
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		sessions:       make(map[string]*memorySession),
+		ueFlows:        make(map[ueFlowKey]uint32),
+		appServerSlots: make(map[string]*memoryAppServerSlots),
+		appServers:     make(map[string]util.QoDProvAppServerData),
+	}
+}
+
+func (m *memoryStore) Close() {}
+
+// Sessions go through the same encoding and decoding as with mongodb. The copy
+// also keeps callers from sharing the stored session.
+func cloneSession(session *util.QoDServiceSession) (*util.QoDServiceSession, error) {
+	data, err := toBsonM(session)
+	if err != nil {
+		return nil, err
+	}
+	var clone util.QoDServiceSession
+	if err := decodeMapStructure(&clone, data); err != nil {
+		return nil, err
+	}
+	return &clone, nil
+}
+
+func (m *memoryStore) cloneSessions(match func(s *memorySession) bool) ([]util.QoDServiceSession, error) {
+	var sessions []util.QoDServiceSession
+	for _, s := range m.sessions {
+		if !match(s) {
+			continue
+		}
+		clone, err := cloneSession(&s.session)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *clone)
+	}
+	return sessions, nil
+}
+
+func ueKeyValue(session *util.QoDServiceSession, field string) string {
+	switch field {
+	case UE_KEY_IPV4_ADDR:
+		return session.UeIpv4Addr
+	case UE_KEY_IPV6_ADDR:
+		return session.UeIpv6Addr
+	case UE_KEY_MSISDN:
+		return session.UeMsisdn
+	case UE_KEY_EXTERNAL_ID:
+		return session.UeExternalId
+	}
+	return ""
+}
+
+func (m *memoryStore) PutSession(session *util.QoDServiceSession) error {
+	clone, err := cloneSession(session)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[session.SessionId]; ok {
+		s.session = *clone
+		return nil
+	}
+	m.sessions[session.SessionId] = &memorySession{session: *clone}
+	return nil
+}
+
+func (m *memoryStore) UpdateSession(session *util.QoDServiceSession) (bool, error) {
+	clone, err := cloneSession(session)
+	if err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[session.SessionId]
+	if !ok {
+		return false, nil
+	}
+	s.session = *clone
+	return true, nil
+}
+
+func (m *memoryStore) UpdateSessionQosStatus(sessionId string, nefSubscriptionMissing bool, messages []api.Message) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionId]
+	if !ok {
+		return false, nil
+	}
+	s.session.NefSubscriptionMissing = nefSubscriptionMissing
+	s.session.SessionInfo.Messages = append([]api.Message(nil), messages...)
+	return true, nil
+}
+
+func (m *memoryStore) GetSession(sessionId string) (*util.QoDServiceSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneSession(&s.session)
+}
+
+func (m *memoryStore) GetAllSessions() ([]util.QoDServiceSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cloneSessions(func(s *memorySession) bool {
+		return true
+	})
+}
+
+func (m *memoryStore) GetSessionByNefSubscription(nefSubscriptionResource, scsAsId, nefSubscriptionId string) (*util.QoDServiceSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		if s.session.NefSubscriptionResource == nefSubscriptionResource {
+			return cloneSession(&s.session)
+		}
+	}
+	if scsAsId == "" || nefSubscriptionId == "" {
+		return nil, ErrNotFound
+	}
+	for _, s := range m.sessions {
+		if s.session.ScsAsId == scsAsId && s.session.NefSubscriptionId == nefSubscriptionId {
+			return cloneSession(&s.session)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memoryStore) DeleteSession(sessionId string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[sessionId]; !ok {
+		return false, nil
+	}
+	delete(m.sessions, sessionId)
+	return true, nil
+}
+
+func (m *memoryStore) GetUeSessions(ue UeKey, scsAsId, qosProfile string) ([]util.QoDServiceSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cloneSessions(func(s *memorySession) bool {
+		return ueKeyValue(&s.session, ue.Field) == ue.Value && s.session.ScsAsId == scsAsId &&
+			string(s.session.SessionReq.Qos) == qosProfile
+	})
+}
+
+func (m *memoryStore) GetClientUeSessions(ues []UeKey, clientId string, now int64) ([]util.QoDServiceSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cloneSessions(func(s *memorySession) bool {
+		if s.session.ClientId != clientId || s.session.SessionInfo.ExpiresAt <= now {
+			return false
+		}
+		for _, ue := range ues {
+			if ueKeyValue(&s.session, ue.Field) == ue.Value {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *memoryStore) GetExpiredSessions(now int64) ([]util.QoDServiceSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cloneSessions(func(s *memorySession) bool {
+		return s.session.SessionInfo.ExpiresAt <= now
+	})
+}
+
+func (m *memoryStore) ReserveAppServerSlot(scsAsId string, maxSlots int, now int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slots, ok := m.appServerSlots[scsAsId]
+	if !ok {
+		slots = &memoryAppServerSlots{}
+		m.appServerSlots[scsAsId] = slots
+	}
+	if slots.taken >= maxSlots {
+		return false, nil
+	}
+	slots.taken++
+	slots.takenAt = now
+	return true, nil
+}
+
+func (m *memoryStore) ReleaseAppServerSlot(scsAsId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if slots, ok := m.appServerSlots[scsAsId]; ok && slots.taken > 0 {
+		slots.taken--
+	}
+	return nil
+}
+
+func (m *memoryStore) ResyncAppServerSlots(scsAsId string, takenBefore int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slots, ok := m.appServerSlots[scsAsId]
+	if !ok || slots.takenAt >= takenBefore {
+		return nil
+	}
+	count := 0
+	for _, s := range m.sessions {
+		if s.session.ScsAsId == scsAsId && s.session.AsSlot {
+			count++
+		}
+	}
+	slots.taken = count
+	return nil
+}
+
+func (m *memoryStore) AcquireExpiryLease(sessionId, owner string, now int64, leaseSecs int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionId]
+	if !ok || s.session.SessionInfo.ExpiresAt > now {
+		return false, nil
+	}
+	if s.lease != nil && s.lease.until >= now && s.lease.owner != owner {
+		return false, nil
+	}
+	s.lease = &expiryLease{
+		owner: owner,
+		until: now + int64(leaseSecs),
+	}
+	return true, nil
+}
+
+func (m *memoryStore) IncrementUeFlow(ue UeKey, scsAsId string) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := ueFlowKey{ue: ue, scsAsId: scsAsId}
+	m.ueFlows[key]++
+	return m.ueFlows[key], nil
+}
+
+func (m *memoryStore) PutFailedNotification(d *notifier.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	failed := *d
+	failed.AuthToken = "" // Not kept, same as with mongodb
+	m.failedNotifications = append(m.failedNotifications, failed)
+	return nil
+}
+
+func (m *memoryStore) PutNefDeadLetter(deadLetter *NefDeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nefDeadLetters = append(m.nefDeadLetters, *deadLetter)
+	return nil
+}
+
+func (m *memoryStore) GetNefDeadLetters() ([]NefDeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deadLetters := make([]NefDeadLetter, len(m.nefDeadLetters))
+	copy(deadLetters, m.nefDeadLetters)
+	return deadLetters, nil
+}
+
+func (m *memoryStore) DeleteNefDeadLetter(scsAsId, nefSubscriptionId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, deadLetter := range m.nefDeadLetters {
+		if deadLetter.ScsAsId == scsAsId && deadLetter.NefSubscriptionId == nefSubscriptionId {
+			m.nefDeadLetters = append(m.nefDeadLetters[:i], m.nefDeadLetters[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// The qosMap and policy are copied so that callers do not share the stored ones
+func cloneAppServerData(asData *util.QoDProvAppServerData) util.QoDProvAppServerData {
+	clone := *asData
+	clone.QoSMap = make(map[string]string, len(asData.QoSMap))
+	for qosProfile, qosReference := range asData.QoSMap {
+		clone.QoSMap[qosProfile] = qosReference
+	}
+	if asData.Policy != nil {
+		policy := *asData.Policy
+		policy.TimeWindows = nil
+		for _, window := range asData.Policy.TimeWindows {
+			window.Days = append([]string(nil), window.Days...)
+			policy.TimeWindows = append(policy.TimeWindows, window)
+		}
+		clone.Policy = &policy
+	}
+	return clone
+}
+
+// IPv4 and IPv6 addresses can not collide, hence the address alone is the key
+func (m *memoryStore) GetAppServerData(asAddr string, ipv6 bool) (*util.QoDProvAppServerData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	asData, ok := m.appServers[asAddr]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	clone := cloneAppServerData(&asData)
+	return &clone, nil
+}
+
+func (m *memoryStore) GetAllAppServerData() ([]util.QoDProvAppServerData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var asData []util.QoDProvAppServerData
+	for _, data := range m.appServers {
+		asData = append(asData, cloneAppServerData(&data))
+	}
+	return asData, nil
+}
+
+func (m *memoryStore) CreateAppServerData(asData *util.QoDProvAppServerData) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	asAddr, _ := asData.AsAddr()
+	if _, ok := m.appServers[asAddr]; ok {
+		return false, nil
+	}
+	m.appServers[asAddr] = cloneAppServerData(asData)
+	return true, nil
+}
+
+func (m *memoryStore) UpdateAppServerData(asData *util.QoDProvAppServerData) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	asAddr, _ := asData.AsAddr()
+	if _, ok := m.appServers[asAddr]; !ok {
+		return false, nil
+	}
+	m.appServers[asAddr] = cloneAppServerData(asData)
+	return true, nil
+}
+
+func (m *memoryStore) DeleteAppServerData(asAddr string, ipv6 bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.appServers[asAddr]; !ok {
+		return false, nil
+	}
+	delete(m.appServers, asAddr)
+	return true, nil
+}
@@ -0,0 +1,273 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"testing"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/qodservice/util"
+)
+
+func newTestSession(sessionId, scsAsId, nefSubscriptionId string, expiresAt int64) *util.QoDServiceSession {
+	session := &util.QoDServiceSession{}
+	session.SessionId = sessionId
+	session.ScsAsId = scsAsId
+	session.NefSubscriptionId = nefSubscriptionId
+	session.NefSubscriptionResource = "http://nef/3gpp-as-session-with-qos/v1/" + scsAsId + "/subscriptions/" + nefSubscriptionId
+	session.SessionInfo.Id = sessionId
+	session.SessionInfo.ExpiresAt = expiresAt
+	return session
+}
+
+func newTestMemoryStore(t *testing.T, sessions ...*util.QoDServiceSession) *memoryStore {
+	t.Helper()
+	m := newMemoryStore()
+	for _, s := range sessions {
+		if err := m.PutSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestMemoryAcquireExpiryLease(t *testing.T) {
+	const now = 1000
+
+	tests := []struct {
+		name      string
+		expiresAt int64
+		holder    string // Takes the lease at 'now' before the owner tries
+		owner     string
+		at        int64
+		want      bool
+	}{
+		{"expired session", now, "", "a", now, true},
+		{"session not expired", now + 1, "", "a", now, false},
+		{"held by another owner", now, "b", "a", now + 30, false},
+		{"held by the same owner", now, "a", "a", now + 30, true},
+		{"lease of another owner ran out", now, "b", "a", now + 61, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemoryStore(t, newTestSession("s1", "as1", "1", tt.expiresAt))
+			if tt.holder != "" {
+				if ok, err := m.AcquireExpiryLease("s1", tt.holder, now, 60); !ok || err != nil {
+					t.Fatalf("holder did not get the lease: %v %v", ok, err)
+				}
+			}
+			ok, err := m.AcquireExpiryLease("s1", tt.owner, tt.at, 60)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.want {
+				t.Errorf("AcquireExpiryLease = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+
+	t.Run("unknown session", func(t *testing.T) {
+		m := newTestMemoryStore(t)
+		if ok, err := m.AcquireExpiryLease("s1", "a", now, 60); ok || err != nil {
+			t.Errorf("AcquireExpiryLease = %v %v, want false", ok, err)
+		}
+	})
+}
+
+func TestMemoryUpdateSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		deleted bool
+		want    bool
+	}{
+		{"stored session", false, true},
+		{"deleted session", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemoryStore(t, newTestSession("s1", "as1", "1", 100))
+			if tt.deleted {
+				if found, err := m.DeleteSession("s1"); !found || err != nil {
+					t.Fatalf("DeleteSession = %v %v", found, err)
+				}
+			}
+			ok, err := m.UpdateSession(newTestSession("s1", "as1", "1", 200))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.want {
+				t.Errorf("UpdateSession = %v, want %v", ok, tt.want)
+			}
+			session, err := m.GetSession("s1")
+			switch {
+			case tt.deleted && err != ErrNotFound:
+				t.Errorf("deleted session re-created: %v %v", session, err)
+			case !tt.deleted && (err != nil || session.SessionInfo.ExpiresAt != 200):
+				t.Errorf("session not updated: %v %v", session, err)
+			}
+		})
+	}
+}
+
+func TestMemoryUpdateSessionQosStatus(t *testing.T) {
+	messages := []api.Message{{Severity: "WARNING", Description: "QoS unavailable"}}
+
+	tests := []struct {
+		name    string
+		deleted bool
+		want    bool
+	}{
+		{"stored session", false, true},
+		{"deleted session", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMemoryStore(t, newTestSession("s1", "as1", "1", 100))
+			if tt.deleted {
+				m.DeleteSession("s1")
+			}
+			// The session is extended after it was read for the status update
+			m.UpdateSession(newTestSession("s1", "as1", "1", 200))
+
+			ok, err := m.UpdateSessionQosStatus("s1", true, messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.want {
+				t.Errorf("UpdateSessionQosStatus = %v, want %v", ok, tt.want)
+			}
+			session, err := m.GetSession("s1")
+			if tt.deleted {
+				if err != ErrNotFound {
+					t.Errorf("deleted session re-created: %v %v", session, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !session.NefSubscriptionMissing || len(session.SessionInfo.Messages) != 1 ||
+				session.SessionInfo.Messages[0].Description != messages[0].Description {
+				t.Errorf("status not set: %v %v", session.NefSubscriptionMissing, session.SessionInfo.Messages)
+			}
+			if session.SessionInfo.ExpiresAt != 200 {
+				t.Errorf("extend rolled back to expiresAt %v", session.SessionInfo.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestMemoryGetSessionByNefSubscription(t *testing.T) {
+	m := newTestMemoryStore(t,
+		newTestSession("s1", "as1", "1", 100),
+		newTestSession("s2", "as2", "1", 100),
+	)
+
+	tests := []struct {
+		name              string
+		resource          string
+		scsAsId           string
+		nefSubscriptionId string
+		want              string // sessionId, empty when not found
+	}{
+		{"resource", "http://nef/3gpp-as-session-with-qos/v1/as2/subscriptions/1", "", "", "s2"},
+		{"resource wins over the id", "http://nef/3gpp-as-session-with-qos/v1/as1/subscriptions/1", "as2", "1", "s1"},
+		{"id of the AS", "http://other/subscriptions/1", "as2", "1", "s2"},
+		{"id of another AS", "http://other/subscriptions/1", "as3", "1", ""},
+		{"id without AS", "http://other/subscriptions/1", "", "1", ""},
+		{"AS without id", "http://other/subscriptions/1", "as1", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := m.GetSessionByNefSubscription(tt.resource, tt.scsAsId, tt.nefSubscriptionId)
+			if tt.want == "" {
+				if err != ErrNotFound {
+					t.Errorf("got %v %v, want ErrNotFound", session, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if session.SessionId != tt.want {
+				t.Errorf("got session %v, want %v", session.SessionId, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryAppServerSlots(t *testing.T) {
+	m := newTestMemoryStore(t)
+	reserve := func(scsAsId string, now int64, want bool) {
+		t.Helper()
+		ok, err := m.ReserveAppServerSlot(scsAsId, 2, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("ReserveAppServerSlot(%v) = %v, want %v", scsAsId, ok, want)
+		}
+	}
+
+	reserve("as1", 100, true)
+	reserve("as1", 100, true)
+	reserve("as1", 100, false)
+	reserve("as2", 100, true) // Slots are per AS
+
+	if err := m.ReleaseAppServerSlot("as1"); err != nil {
+		t.Fatal(err)
+	}
+	reserve("as1", 110, true)
+	reserve("as1", 110, false)
+
+	// Only one session holds a slot, e.g. the other one was never stored
+	holder := newTestSession("s1", "as1", "1", 1000)
+	holder.AsSlot = true
+	if err := m.PutSession(holder); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.PutSession(newTestSession("s2", "as1", "2", 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A slot taken at 110 may not have its session stored yet
+	if err := m.ResyncAppServerSlots("as1", 110); err != nil {
+		t.Fatal(err)
+	}
+	reserve("as1", 120, false)
+	if err := m.ResyncAppServerSlots("as1", 121); err != nil {
+		t.Fatal(err)
+	}
+	reserve("as1", 130, true)
+	reserve("as1", 130, false)
+
+	// A release never takes the slots below zero
+	for i := 0; i < 3; i++ {
+		if err := m.ReleaseAppServerSlot("as2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reserve("as2", 140, true)
+	reserve("as2", 140, true)
+	reserve("as2", 140, false)
+
+	// Nor does a release for an AS without slots grant an extra one
+	if err := m.ReleaseAppServerSlot("as3"); err != nil {
+		t.Fatal(err)
+	}
+	reserve("as3", 150, true)
+	reserve("as3", 150, true)
+	reserve("as3", 150, false)
+}
@@ -0,0 +1,480 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/camara/qodmodels/db"
+	"github.com/sfnuser/dbapi"
+	"github.com/sfnuser/qodservice/notifier"
+	"github.com/sfnuser/qodservice/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The mongodb store works on the same collections and documents as dbapi.
+// Queries that dbapi does not cover are made with its wrapper directly.
+
+const (
+	COLLECTION_CAMARA_QOD_SERVICE_FAILED_NOTIFICATION = "camara.qod.service.notification.failed"
+	COLLECTION_CAMARA_QOD_SERVICE_NEF_DEAD_LETTER     = "camara.qod.service.nef.deadletter"
+	COLLECTION_CAMARA_QOD_SERVICE_AS_SLOTS            = "camara.qod.service.as.slots"
+)
+
+// Attempts of an update of the slots taken that is made only if they did not change
+const appServerSlotsUpdateAttempts = 10
+
+// Slots taken of the concurrent sessions of an AS. The _id is the scsAsId, the
+// unique index that makes the reservation atomic.
+type appServerSlots struct {
+	Taken   int   `mapstructure:"taken"`
+	TakenAt int64 `mapstructure:"takenAt"`
+}
+
+type mongoStore struct {
+	db *dbapi.DbApi
+}
+
+func newMongoStore(name, url string) (*mongoStore, error) {
+	d := dbapi.NewDbApi(name, url)
+	if err := d.Connect(); err != nil {
+		return nil, err
+	}
+	return &mongoStore{db: d}, nil
+}
+
+func (m *mongoStore) Close() {
+	m.db.Disconnect()
+}
+
+func notFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (m *mongoStore) getSession(filter bson.M) (*util.QoDServiceSession, error) {
+	getData, err := m.db.GetWrapper().GetOne(dbapi.COLLECTION_CAMARA_QOD_SERVICE_SESSION, filter)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	var session util.QoDServiceSession
+	if err := decodeMapStructure(&session, getData); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (m *mongoStore) getSessions(filter bson.M) ([]util.QoDServiceSession, error) {
+	getData, err := m.db.GetWrapper().GetMany(dbapi.COLLECTION_CAMARA_QOD_SERVICE_SESSION, filter)
+	if err != nil {
+		return nil, err
+	} else if len(getData) == 0 {
+		return nil, nil
+	}
+	var sessions []util.QoDServiceSession
+	if err := decodeMapStructure(&sessions, getData); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (m *mongoStore) PutSession(session *util.QoDServiceSession) error {
+	filter := bson.M{
+		"sessionId": session.SessionId,
+	}
+	putData, err := toBsonM(session)
+	if err != nil {
+		return err
+	}
+	_, err = m.db.GetWrapper().UpdateInsertOne(dbapi.COLLECTION_CAMARA_QOD_SERVICE_SESSION, filter, putData)
+	return err
+}
+
+// Unlike PutSession, the session is not re-created when it was deleted in the meantime
+func (m *mongoStore) UpdateSession(session *util.QoDServiceSession) (bool, error) {
+	filter := bson.M{
+		"sessionId": session.SessionId,
+	}
+	putData, err := toBsonM(session)
+	if err != nil {
+		return false, err
+	}
+	matchCount, err := m.db.GetWrapper().UpdateOne(dbapi.COLLECTION_CAMARA_QOD_SERVICE_SESSION, filter, putData)
+	if err != nil {
+		return false, err
+	}
+	return matchCount == 1, nil
+}
+
+func (m *mongoStore) UpdateSessionQosStatus(sessionId string, nefSubscriptionMissing bool, messages []api.Message) (bool, error) {
+	// Encoded by the json names, same as the rest of the session
+	tmp, err := json.Marshal(messages)
+	if err != nil {
+		return false, err
+	}
+	var messagesData []interface{}
+	if err := json.Unmarshal(tmp, &messagesData); err != nil {
+		return false, err
+	}
+	filter := bson.M{
+		"sessionId": sessionId,
+	}
+	putData := bson.M{
+		"nefSubscriptionMissing": nefSubscriptionMissing,
+		"sessionInfo.messages":   messagesData,
+	}
+	matchCount, err := m.db.GetWrapper().UpdateOne(dbapi.COLLECTION_CAMARA_QOD_SERVICE_SESSION, filter, putData)
+	if err != nil {
+		return false, err
+	}
+	return matchCount == 1, nil
+}
+
+func (m *mongoStore) GetSession(sessionId string) (*util.QoDServiceSession, error) {
+	return m.getSession(bson.M{"sessionId": sessionId})
+}
+
+func (m *mongoStore) GetAllSessions() ([]util.QoDServiceSession, error) {
+	return m.getSessions(bson.M{})
+}
+
+// NEF identifies the subscription with its resource URI. The scsAsId and
+// subscriptionId are matched as well in case NEF reports a different base URI
+// than the Location it returned on create.
+func (m *mongoStore) GetSessionByNefSubscription(nefSubscriptionResource, scsAsId, nefSubscriptionId string) (*util.QoDServiceSession, error) {
+	match := bson.A{
+		bson.M{"nefSubscriptionResource": nefSubscriptionResource},
+	}
+	if scsAsId != "" && nefSubscriptionId != "" {
+		match = append(match, bson.M{"scsAsId": scsAsId, "nefSubscriptionId": nefSubscriptionId})
+	}
+	return m.getSession(bson.M{"$or": match})
+}
+
+func (m *mongoStore) DeleteSession(sessionId string) (bool, error) {
+	matchCount, err := m.db.DeleteCamaraQoDServiceUeSession(sessionId)
+	if err != nil {
+		return false, err
+	}
+	return matchCount == 1, nil
+}
+
+// dbapi GetAllCamaraQoDServiceUeSession filters on "sessionReq.Qos" which is not
+// how the qosProfile is stored, hence the own query.
+func (m *mongoStore) GetUeSessions(ue UeKey, scsAsId, qosProfile string) ([]util.QoDServiceSession, error) {
+	filter := bson.M{
+		ue.Field:         ue.Value,
+		"scsAsId":        scsAsId,
+		"sessionReq.qos": qosProfile,
+	}
+	return m.getSessions(filter)
+}
+
+func (m *mongoStore) GetClientUeSessions(ues []UeKey, clientId string, now int64) ([]util.QoDServiceSession, error) {
+	ueFilter := bson.A{}
+	for _, ue := range ues {
+		ueFilter = append(ueFilter, bson.M{ue.Field: ue.Value})
+	}
+	filter := bson.M{
+		"$or":                   ueFilter,
+		"clientId":              clientId,
+		"sessionInfo.expiresAt": bson.M{"$gt": now},
+	}
+	return m.getSessions(filter)
+}
+
+func (m *mongoStore) GetExpiredSessions(now int64) ([]util.QoDServiceSession, error) {
+	filter := bson.M{
+		"sessionInfo.expiresAt": bson.M{"$lte": now},
+	}
+	return m.getSessions(filter)
+}
+
+// The increment matches only while a slot is free. Otherwise the upsert tries to
+// insert a second document with the same _id, which fails as a duplicate key.
+func (m *mongoStore) ReserveAppServerSlot(scsAsId string, maxSlots int, now int64) (bool, error) {
+	filter := bson.M{
+		"_id":   scsAsId,
+		"taken": bson.M{"$lt": maxSlots},
+	}
+	update := bson.M{
+		"$inc": bson.M{"taken": 1},
+		"$set": bson.M{"takenAt": now},
+	}
+	_, err := m.db.GetWrapper().GetIncrementedOne(COLLECTION_CAMARA_QOD_SERVICE_AS_SLOTS, filter, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// A decrement with GetIncrementedOne would upsert a document with taken -1 for an
+// AS without one. The dbapi wrapper has no $inc without upsert, hence the taken
+// slots are set from the ones read, only if nobody changed them in between.
+func (m *mongoStore) ReleaseAppServerSlot(scsAsId string) error {
+	for i := 0; i < appServerSlotsUpdateAttempts; i++ {
+		filter := bson.M{
+			"_id":   scsAsId,
+			"taken": bson.M{"$gt": 0},
+		}
+		getData, err := m.db.GetWrapper().GetOne(COLLECTION_CAMARA_QOD_SERVICE_AS_SLOTS, filter)
+		if err != nil {
+			if errors.Is(notFound(err), ErrNotFound) {
+				// No slot left to release
+				return nil
+			}
+			return err
+		}
+		var slots appServerSlots
+		if err := decodeMapStructure(&slots, getData); err != nil {
+			return err
+		}
+		filter = bson.M{
+			"_id":   scsAsId,
+			"taken": slots.Taken,
+		}
+		matchCount, err := m.db.GetWrapper().UpdateOne(COLLECTION_CAMARA_QOD_SERVICE_AS_SLOTS, filter,
+			bson.M{"taken": slots.Taken - 1})
+		if err != nil || matchCount == 1 {
+			return err
+		}
+	}
+	return fmt.Errorf("session slots of scsAsId %v changed on every attempt to release one", scsAsId)
+}
+
+// The slots are set only if they did not change since they were read
+func (m *mongoStore) ResyncAppServerSlots(scsAsId string, takenBefore int64) error {
+	getData, err := m.db.GetWrapper().GetOne(COLLECTION_CAMARA_QOD_SERVICE_AS_SLOTS, bson.M{"_id": scsAsId})
+	if err != nil {
+		if errors.Is(notFound(err), ErrNotFound) {
+			// No slot was ever taken
+			return nil
+		}
+		return err
+	}
+	var slots appServerSlots
+	if err := decodeMapStructure(&slots, getData); err != nil {
+		return err
+	}
+	if slots.TakenAt >= takenBefore {
+		return nil
+	}
+	filter := bson.M{
+		"scsAsId": scsAsId,
+		"asSlot":  true,
+	}
+	count, err := m.db.GetWrapper().CountRecords(dbapi.COLLECTION_CAMARA_QOD_SERVICE_SESSION, filter)
+	if err != nil || int(count) == slots.Taken {
+		return err
+	}
+	filter = bson.M{
+		"_id":     scsAsId,
+		"taken":   slots.Taken,
+		"takenAt": slots.TakenAt,
+	}
+	_, err = m.db.GetWrapper().UpdateOne(COLLECTION_CAMARA_QOD_SERVICE_AS_SLOTS, filter, bson.M{"taken": count})
+	return err
+}
+
+// The lease is kept in the session document, next to the session
+func (m *mongoStore) AcquireExpiryLease(sessionId, owner string, now int64, leaseSecs int) (bool, error) {
+	filter := bson.M{
+		"sessionId":             sessionId,
+		"sessionInfo.expiresAt": bson.M{"$lte": now},
+		"$or": bson.A{
+			bson.M{"expiryLease": bson.M{"$exists": false}},
+			bson.M{"expiryLease.until": bson.M{"$lt": now}},
+			bson.M{"expiryLease.owner": owner},
+		},
+	}
+	lease := bson.M{
+		"expiryLease": bson.M{
+			"owner": owner,
+			"until": now + int64(leaseSecs),
+		},
+	}
+	matchCount, err := m.db.GetWrapper().UpdateOne(dbapi.COLLECTION_CAMARA_QOD_SERVICE_SESSION, filter, lease)
+	if err != nil {
+		return false, err
+	}
+	return matchCount == 1, nil
+}
+
+// Same as dbapi GetCamaraQoDServiceIncrementUeFlow for any UeKey
+func (m *mongoStore) IncrementUeFlow(ue UeKey, scsAsId string) (uint32, error) {
+	filter := bson.M{
+		ue.Field:  ue.Value,
+		"scsAsId": scsAsId,
+	}
+	update := bson.M{
+		"$inc": bson.M{
+			"FlowCounter": 1,
+		},
+	}
+	getData, err := m.db.GetWrapper().GetIncrementedOne(dbapi.COLLECTION_CAMARA_QOD_SERVICE_UE_FLOW, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	var ueFlow db.ServiceQoDUeFlow
+	if err := decodeMapStructure(&ueFlow, getData); err != nil {
+		return 0, err
+	}
+	return ueFlow.FlowCounter, nil
+}
+
+// The notificationAuthToken is not stored
+func (m *mongoStore) PutFailedNotification(d *notifier.Delivery) error {
+	notification, err := toBsonM(d.Notification)
+	if err != nil {
+		return err
+	}
+	putData := bson.M{
+		"sessionId":       d.Notification.SessionId,
+		"notificationUri": d.NotificationUri,
+		"notification":    notification,
+		"attempts":        d.Attempts,
+		"lastError":       d.LastError,
+		"failedAt":        time.Now().Unix(),
+	}
+	return m.db.GetWrapper().InsertOne(COLLECTION_CAMARA_QOD_SERVICE_FAILED_NOTIFICATION, putData)
+}
+
+func (m *mongoStore) PutNefDeadLetter(deadLetter *NefDeadLetter) error {
+	putData, err := toBsonM(deadLetter)
+	if err != nil {
+		return err
+	}
+	return m.db.GetWrapper().InsertOne(COLLECTION_CAMARA_QOD_SERVICE_NEF_DEAD_LETTER, putData)
+}
+
+func (m *mongoStore) GetNefDeadLetters() ([]NefDeadLetter, error) {
+	getData, err := m.db.GetWrapper().GetMany(COLLECTION_CAMARA_QOD_SERVICE_NEF_DEAD_LETTER, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var deadLetters []NefDeadLetter
+	for _, data := range getData {
+		// Decoded by the json names, same as they were encoded
+		tmp, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		var deadLetter NefDeadLetter
+		if err := json.Unmarshal(tmp, &deadLetter); err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	return deadLetters, nil
+}
+
+func (m *mongoStore) DeleteNefDeadLetter(scsAsId, nefSubscriptionId string) error {
+	filter := bson.M{
+		"scsAsId":           scsAsId,
+		"nefSubscriptionId": nefSubscriptionId,
+	}
+	_, err := m.db.GetWrapper().DeleteOne(COLLECTION_CAMARA_QOD_SERVICE_NEF_DEAD_LETTER, filter)
+	return err
+}
+
+// IPv4 addressed ASs are provisioned as dbapi expects. IPv6 addressed ASs are
+// provisioned with asIpv6Addr instead.
+func appServerFilter(asAddr string, ipv6 bool) bson.M {
+	if ipv6 {
+		return bson.M{
+			"asIpv6Addr": asAddr,
+		}
+	}
+	return bson.M{
+		"asIpv4Addr": asAddr,
+	}
+}
+
+func (m *mongoStore) GetAppServerData(asAddr string, ipv6 bool) (*util.QoDProvAppServerData, error) {
+	getData, err := m.db.GetWrapper().GetOne(dbapi.COLLECTION_CAMARA_QOD_PROV_SESSION, appServerFilter(asAddr, ipv6))
+	if err != nil {
+		return nil, notFound(err)
+	}
+	var asData util.QoDProvAppServerData
+	if err := decodeMapStructure(&asData, getData); err != nil {
+		return nil, err
+	}
+	return &asData, nil
+}
+
+func (m *mongoStore) GetAllAppServerData() ([]util.QoDProvAppServerData, error) {
+	getData, err := m.db.GetWrapper().GetMany(dbapi.COLLECTION_CAMARA_QOD_PROV_SESSION, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var asData []util.QoDProvAppServerData
+	if err := decodeMapStructure(&asData, getData); err != nil {
+		return nil, err
+	}
+	return asData, nil
+}
+
+// The collection has no unique index on the AS address, hence the check before
+// the insert. Concurrent creates of the same AS are not expected from operators.
+func (m *mongoStore) CreateAppServerData(asData *util.QoDProvAppServerData) (bool, error) {
+	filter := appServerFilter(asData.AsAddr())
+	count, err := m.db.GetWrapper().CountRecords(dbapi.COLLECTION_CAMARA_QOD_PROV_SESSION, filter)
+	if err != nil {
+		return false, err
+	} else if count > 0 {
+		return false, nil
+	}
+	putData, err := toBsonM(asData)
+	if err != nil {
+		return false, err
+	}
+	_, err = m.db.GetWrapper().UpdateInsertOne(dbapi.COLLECTION_CAMARA_QOD_PROV_SESSION, filter, putData)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *mongoStore) UpdateAppServerData(asData *util.QoDProvAppServerData) (bool, error) {
+	putData, err := toBsonM(asData)
+	if err != nil {
+		return false, err
+	}
+	// The fields are set one by one, hence a policy that was removed is set to null
+	if asData.Policy == nil {
+		putData["policy"] = nil
+	}
+	matchCount, err := m.db.GetWrapper().UpdateOne(dbapi.COLLECTION_CAMARA_QOD_PROV_SESSION,
+		appServerFilter(asData.AsAddr()), putData)
+	if err != nil {
+		return false, err
+	}
+	return matchCount == 1, nil
+}
+
+func (m *mongoStore) DeleteAppServerData(asAddr string, ipv6 bool) (bool, error) {
+	deleteCount, err := m.db.GetWrapper().DeleteOne(dbapi.COLLECTION_CAMARA_QOD_PROV_SESSION, appServerFilter(asAddr, ipv6))
+	if err != nil {
+		return false, err
+	}
+	return deleteCount == 1, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/qodservice/notifier"
+	"github.com/sfnuser/qodservice/util"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	STORE_TYPE_MONGODB = "mongodb"
+	STORE_TYPE_MEMORY  = "memory"
+)
+
+// Fields of the session the UE is keyed on
+const (
+	UE_KEY_IPV4_ADDR   = "ueIpv4Addr"
+	UE_KEY_IPV6_ADDR   = "ueIpv6Addr"
+	UE_KEY_MSISDN      = "ueMsisdn"
+	UE_KEY_EXTERNAL_ID = "ueExternalId"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// NefDeadLetter is a NEF subscription that was left behind because the session
+// could not be created and the rollback failed as well. It is to be deleted at NEF.
+type NefDeadLetter struct {
+	SessionId               string `json:"sessionId"`
+	ScsAsId                 string `json:"scsAsId"`
+	NefSubscriptionId       string `json:"nefSubscriptionId"`
+	NefSubscriptionResource string `json:"nefSubscriptionResource"`
+	Reason                  string `json:"reason"`        // Why the session was rolled back
+	RollbackError           string `json:"rollbackError"` // Why the rollback failed
+	FailedAt                int64  `json:"failedAt"`
+}
+
+// UeKey identifies the UE of a session, e.g. {UE_KEY_IPV4_ADDR, "10.0.0.1"}
+type UeKey struct {
+	Field string
+	Value string
+}
+
+// SessionStore keeps the QoD sessions and the running FlowId counter per UE and AS
+type SessionStore interface {
+	// Insert the session or replace the existing one with the same sessionId
+	PutSession(session *util.QoDServiceSession) error
+	// Update the session only if it exists. Returns false if it does not.
+	UpdateSession(session *util.QoDServiceSession) (bool, error)
+	// Set only whether NEF lost the subscription of the session and the messages of the
+	// session, so that a concurrent update of the rest, e.g. an extend, is kept. Returns
+	// false if the session does not exist.
+	UpdateSessionQosStatus(sessionId string, nefSubscriptionMissing bool, messages []api.Message) (bool, error)
+	GetSession(sessionId string) (*util.QoDServiceSession, error)
+	GetAllSessions() ([]util.QoDServiceSession, error)
+	// Session of the NEF subscription resource URI. The subscriptionId is only
+	// unique per scsAsId, hence the fallback matches both and is skipped if either
+	// is empty.
+	GetSessionByNefSubscription(nefSubscriptionResource, scsAsId, nefSubscriptionId string) (*util.QoDServiceSession, error)
+	// Returns false if the session did not exist
+	DeleteSession(sessionId string) (bool, error)
+	// Sessions of the UE towards the AS with the given qosProfile
+	GetUeSessions(ue UeKey, scsAsId, qosProfile string) ([]util.QoDServiceSession, error)
+	// Sessions of the client, matching any of the UE keys, that have not expired by 'now'
+	GetClientUeSessions(ues []UeKey, clientId string, now int64) ([]util.QoDServiceSession, error)
+	// Sessions that expired at or before 'now' (secs since unix epoch)
+	GetExpiredSessions(now int64) ([]util.QoDServiceSession, error)
+	// Atomically take one of the maxSlots concurrent session slots of the AS. Returns
+	// false if all of them are taken.
+	ReserveAppServerSlot(scsAsId string, maxSlots int, now int64) (bool, error)
+	// Give back a slot taken with ReserveAppServerSlot
+	ReleaseAppServerSlot(scsAsId string) error
+	// Set the slots taken of the AS to the number of sessions holding one (AsSlot), e.g.
+	// after a crash between the reserve and the store of the session. Skipped while a
+	// slot taken at or after 'takenBefore' may not have its session stored yet.
+	ResyncAppServerSlots(scsAsId string, takenBefore int64) error
+	// Atomically take the expiry lease on an expired session. The lease is granted when
+	// nobody holds it, when the previous holder did not finish within its lease or when
+	// the owner already holds it. Returns true if the caller owns the lease.
+	AcquireExpiryLease(sessionId, owner string, now int64, leaseSecs int) (bool, error)
+	// Increments and returns the FlowId counter of the UE and AS
+	IncrementUeFlow(ue UeKey, scsAsId string) (uint32, error)
+	// Keep a notification that could not be delivered to the client
+	PutFailedNotification(d *notifier.Delivery) error
+	// Keep a NEF subscription that could not be rolled back
+	PutNefDeadLetter(deadLetter *NefDeadLetter) error
+	GetNefDeadLetters() ([]NefDeadLetter, error)
+	DeleteNefDeadLetter(scsAsId, nefSubscriptionId string) error
+}
+
+// ProvisioningStore keeps the provisioned data of the application servers
+type ProvisioningStore interface {
+	GetAppServerData(asAddr string, ipv6 bool) (*util.QoDProvAppServerData, error)
+	GetAllAppServerData() ([]util.QoDProvAppServerData, error)
+	// Returns false if the AS is provisioned already
+	CreateAppServerData(asData *util.QoDProvAppServerData) (bool, error)
+	// Replace the data of the AS only if it is provisioned. Returns false if it is not.
+	UpdateAppServerData(asData *util.QoDProvAppServerData) (bool, error)
+	// Returns false if the AS was not provisioned
+	DeleteAppServerData(asAddr string, ipv6 bool) (bool, error)
+}
+
+type Store interface {
+	SessionStore
+	ProvisioningStore
+	Close()
+}
+
+// NewStore returns the store of the given type. name and url are used by mongodb only.
+func NewStore(storeType, name, url string) (Store, error) {
+	switch storeType {
+	case "", STORE_TYPE_MONGODB:
+		return newMongoStore(name, url)
+	case STORE_TYPE_MEMORY:
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("db type %v not supported", storeType)
+	}
+}
+
+func decodeMapStructure(result interface{}, data interface{}) error {
+	config := mapstructure.DecoderConfig{
+		Result: result,
+	}
+	decoder, err := mapstructure.NewDecoder(&config)
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(data)
+}
+
+// Same encoding as dbapi uses for its documents
+func toBsonM(data interface{}) (bson.M, error) {
+	tmp, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var putData = bson.M{}
+	if err = json.Unmarshal(tmp, &putData); err != nil {
+		return nil, err
+	}
+	return putData, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sfnuser/qodservice/logger"
+)
+
+// CertManager serves the cert & key of a TLS server through tls.Config.GetCertificate.
+// The CredentialReader is polled and a renewed pair takes the place of the served one
+// atomically, the handshakes in flight keep the pair they got. A pair that fails to
+// load (e.g. the cert is written but the key not yet) leaves the served one in place
+// until the next poll.
+type CertManager struct {
+	reader   CredentialReader
+	location string // Where the cert & key are read from, for the errors
+	cert     atomic.Pointer[tls.Certificate]
+	mutex    sync.Mutex // Serializes the reloads
+	certPem  []byte     // The pair being served, to tell a renewed one
+	keyPem   []byte
+	stop     chan struct{}
+}
+
+// NewCertManager loads the cert & key of the domain in the env. It fails if that
+// first pair does not load, so that a server does not start without.
+func NewCertManager(env, domainName string) (*CertManager, error) {
+	reader, err := newCertAndKeyReader(env, domainName)
+	if err != nil {
+		return nil, err
+	}
+	m := &CertManager{
+		reader:   reader,
+		location: fmt.Sprintf("%v (env %v)", domainName, env),
+	}
+	if _, err = m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload reads the cert & key and serves them if they changed. It tells if a new
+// pair is served.
+func (m *CertManager) Reload() (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := getCertAndKey(m.reader); err != nil {
+		return false, fmt.Errorf("failed to read cert & key of %v. error %v", m.location, err)
+	}
+	c := m.reader.ReturnAll()
+	if bytes.Equal(c.GetMyCert(), m.certPem) && bytes.Equal(c.GetMyKey(), m.keyPem) {
+		return false, nil
+	}
+	cert, err := tls.X509KeyPair(c.GetMyCert(), c.GetMyKey())
+	if err != nil {
+		return false, fmt.Errorf("invalid cert & key of %v. error %v", m.location, err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return false, fmt.Errorf("invalid cert of %v. error %v", m.location, err)
+	}
+	if now := time.Now(); now.After(cert.Leaf.NotAfter) || now.Before(cert.Leaf.NotBefore) {
+		return false, fmt.Errorf("cert of %v is valid from %v until %v only", m.location,
+			cert.Leaf.NotBefore, cert.Leaf.NotAfter)
+	}
+	m.cert.Store(&cert)
+	m.certPem = append([]byte(nil), c.GetMyCert()...)
+	m.keyPem = append([]byte(nil), c.GetMyKey()...)
+	logger.Util.Sugar().Infof("CertManager: serving cert of %v, valid until %v", cert.Leaf.Subject, cert.Leaf.NotAfter)
+	return true, nil
+}
+
+// GetCertificate is to be set as tls.Config.GetCertificate
+func (m *CertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.cert.Load(), nil
+}
+
+// Start polls the CredentialReader for a renewed pair every interval
+func (m *CertManager) Start(interval time.Duration) {
+	m.stop = make(chan struct{})
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := m.Reload(); err != nil {
+					logger.Util.Sugar().Errorf("CertManager: keeping the served cert. err %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(m.stop)
+	logger.Util.Sugar().Infof("CertManager: started. reloadInterval %v", interval)
+}
+
+func (m *CertManager) Stop() {
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
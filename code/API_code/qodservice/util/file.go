@@ -25,6 +25,26 @@ type credFromFile struct {
 	mTls       MTlsCred
 }
 
+// The cert.pem & key.pem of the certPath dir and the rootCA.pem of the rootCaPath dir
+func newCredFromFile(certPath, rootCaPath string) (CredentialReader, error) {
+	return &credFromFile{
+		myCertPath: certPath + CERT_OBJ_NAME,
+		myKeyPath:  certPath + KEY_OBJ_NAME,
+		rootCaPath: rootCaPath + ROOTCA_OBJ_NAME,
+	}, nil
+}
+
+// The tls.crt & tls.key of a kubernetes.io/tls secret mounted at the certPath dir and
+// the ca.crt of the one at the rootCaPath dir. Kubernetes swaps the files of an updated
+// secret at once.
+func newCredFromK8sSecret(certPath, rootCaPath string) (CredentialReader, error) {
+	return &credFromFile{
+		myCertPath: certPath + K8S_CERT_OBJ_NAME,
+		myKeyPath:  certPath + K8S_KEY_OBJ_NAME,
+		rootCaPath: rootCaPath + K8S_ROOTCA_OBJ_NAME,
+	}, nil
+}
+
 func (c *credFromFile) getBlob(url string) ([]byte, error) {
 	return ioutil.ReadFile(url)
 }
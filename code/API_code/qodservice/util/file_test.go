@@ -0,0 +1,175 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by the parent or self-signed
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+func newTestCert(t *testing.T, cn string, isCA bool, notBefore, notAfter time.Time, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+// A server certificate issued by a CA, both valid for a day
+func newTestServerCert(t *testing.T) (server, ca *testCert) {
+	now := time.Now()
+	ca = newTestCert(t, "Test CA", true, now.Add(-time.Hour), now.Add(24*time.Hour), nil)
+	server = newTestCert(t, "qod.example", false, now.Add(-time.Hour), now.Add(24*time.Hour), ca)
+	return server, ca
+}
+
+// A server certificate issued by an intermediate CA of a root CA
+func newTestChainCert(t *testing.T) (server, intermediate, root *testCert) {
+	now := time.Now()
+	root = newTestCert(t, "Test Root CA", true, now.Add(-time.Hour), now.Add(24*time.Hour), nil)
+	intermediate = newTestCert(t, "Test Intermediate CA", true, now.Add(-time.Hour), now.Add(24*time.Hour), root)
+	server = newTestCert(t, "qod.example", false, now.Add(-time.Hour), now.Add(24*time.Hour), intermediate)
+	return server, intermediate, root
+}
+
+// Verifies the chain of the cert & key as a TLS server sends it, with only the root trusted
+func verifyTestChain(t *testing.T, certPem, keyPem []byte, root *testCert) {
+	t.Helper()
+	tlsCert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatalf("bad cert & key: %v", err)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+	}
+	opts.Roots.AddCert(root.cert)
+	for _, der := range tlsCert.Certificate[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Intermediates.AddCert(cert)
+	}
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		t.Errorf("chain of %v certificate(s) not verified by the root: %v", len(tlsCert.Certificate), err)
+	}
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileCredentials(t *testing.T) {
+	server, ca := newTestServerCert(t)
+	tests := []struct {
+		env                       string
+		certFile, keyFile, caFile string
+	}{
+		{ENV_LOCAL, CERT_OBJ_NAME, KEY_OBJ_NAME, ROOTCA_OBJ_NAME},
+		{ENV_K8S, K8S_CERT_OBJ_NAME, K8S_KEY_OBJ_NAME, K8S_ROOTCA_OBJ_NAME},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFile(t, dir, tt.certFile, server.certPem)
+			writeTestFile(t, dir, tt.keyFile, server.keyPem)
+			writeTestFile(t, dir, tt.caFile, ca.certPem)
+
+			m, err := GetTlsCredentials(tt.env, dir, dir)
+			if err != nil {
+				t.Fatalf("GetTlsCredentials: %v", err)
+			}
+			if !bytes.Equal(m.GetMyCert(), server.certPem) || !bytes.Equal(m.GetMyKey(), server.keyPem) {
+				t.Errorf("cert & key not the ones of %v", dir)
+			}
+			if _, err := tls.X509KeyPair(m.GetMyCert(), m.GetMyKey()); err != nil {
+				t.Errorf("bad cert & key: %v", err)
+			}
+			pool, err := m.GetRootCAPool()
+			if err != nil {
+				t.Fatalf("GetRootCAPool: %v", err)
+			}
+			if _, err := server.cert.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+				t.Errorf("server cert not verified by the root CA: %v", err)
+			}
+
+			// A secret without its CA
+			emptyDir := t.TempDir()
+			if _, err := GetTlsCredentials(tt.env, dir, emptyDir); err == nil {
+				t.Errorf("GetTlsCredentials without %v: no error", tt.caFile)
+			}
+		})
+	}
+}
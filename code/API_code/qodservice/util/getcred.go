@@ -14,7 +14,11 @@
 
 package util
 
-import "fmt"
+import (
+	"crypto/x509"
+	"fmt"
+	"sync"
+)
 
 type MTlsCred struct {
 	myCert []byte
@@ -26,10 +30,54 @@ const (
 	ROOTCA_OBJ_NAME = "/rootCA.pem"
 	CERT_OBJ_NAME   = "/cert.pem"
 	KEY_OBJ_NAME    = "/key.pem"
-	ENV_LOCAL       = "local"
-	ENV_AZURE       = "azure"
+
+	K8S_ROOTCA_OBJ_NAME = "/ca.crt"
+	K8S_CERT_OBJ_NAME   = "/tls.crt"
+	K8S_KEY_OBJ_NAME    = "/tls.key"
+
+	PKCS12_ROOTCA_OBJ_NAME = "/rootCA.p12"
+	PKCS12_CERT_OBJ_NAME   = "/cert.p12"
+
+	ENV_LOCAL  = "local"
+	ENV_AZURE  = "azure"
+	ENV_K8S    = "k8s"    // Kubernetes secret mounted as dir
+	ENV_PKCS12 = "pkcs12" // Registered by RegisterPkcs12CredentialReader
+	ENV_VAULT  = "vault"  // Registered by RegisterVaultCredentialReader
 )
 
+// CredentialReaderFactory builds the CredentialReader of an env. certPath locates the
+// cert & key and rootCaPath the root CA, both as the backend understands them (e.g. a
+// dir or a secret path). Either of them may be empty when it is not read.
+type CredentialReaderFactory func(certPath, rootCaPath string) (CredentialReader, error)
+
+var credentialReaders = struct {
+	sync.RWMutex
+	factories map[string]CredentialReaderFactory
+}{
+	factories: map[string]CredentialReaderFactory{
+		ENV_LOCAL: newCredFromFile,
+		ENV_K8S:   newCredFromK8sSecret,
+	},
+}
+
+// RegisterCredentialReader makes the backend selectable by its env name (service.env).
+// A backend registered before under the name is replaced.
+func RegisterCredentialReader(env string, factory CredentialReaderFactory) {
+	credentialReaders.Lock()
+	defer credentialReaders.Unlock()
+	credentialReaders.factories[env] = factory
+}
+
+func newCredentialReader(env, certPath, rootCaPath string) (CredentialReader, error) {
+	credentialReaders.RLock()
+	factory, ok := credentialReaders.factories[env]
+	credentialReaders.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown env %v", env)
+	}
+	return factory(certPath, rootCaPath)
+}
+
 type CredentialReader interface {
 	ReadMyCert() error
 	ReadMyKey() error
@@ -49,6 +97,15 @@ func (m *MTlsCred) GetRootCA() []byte {
 	return m.rootCA
 }
 
+// GetRootCAPool returns the pool of the root CA certificates, to verify the peer with
+func (m *MTlsCred) GetRootCAPool() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(m.rootCA) {
+		return nil, fmt.Errorf("no PEM certificate in root CA")
+	}
+	return pool, nil
+}
+
 func getCertAndKey(c CredentialReader) error {
 	err := c.ReadMyCert()
 	if err != nil {
@@ -71,27 +128,38 @@ func getCredentials(c CredentialReader) (m *MTlsCred, err error) {
 }
 
 func GetTlsCredentials(env, domainName, rootCaPath string) (m *MTlsCred, err error) {
-	if env == ENV_LOCAL {
-		f := credFromFile{
-			myCertPath: domainName + CERT_OBJ_NAME,
-			myKeyPath:  domainName + KEY_OBJ_NAME,
-			rootCaPath: rootCaPath + ROOTCA_OBJ_NAME,
-		}
-		return getCredentials(&f)
-	} else {
-		return nil, fmt.Errorf("unknown env %v", env)
+	c, err := newCredentialReader(env, domainName, rootCaPath)
+	if err != nil {
+		return nil, err
 	}
+	return getCredentials(c)
+}
+
+// GetTlsRootCA reads the root CA only, e.g. to pin the CA of a server without
+// presenting a client certificate
+func GetTlsRootCA(env, rootCaPath string) (m *MTlsCred, err error) {
+	c, err := newCredentialReader(env, "", rootCaPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.ReadRootCA(); err != nil {
+		return nil, err
+	}
+	return c.ReturnAll(), nil
+}
+
+// The reader of the cert & key of the domain in the env
+func newCertAndKeyReader(env, domainName string) (CredentialReader, error) {
+	return newCredentialReader(env, domainName, "")
 }
 
 func GetTlsCredentialsWithoutRootCA(env, domainName string) (m *MTlsCred, err error) {
-	if env == ENV_LOCAL {
-		f := credFromFile{
-			myCertPath: domainName + CERT_OBJ_NAME,
-			myKeyPath:  domainName + KEY_OBJ_NAME,
-		}
-		getCertAndKey(&f)
-		return f.ReturnAll(), nil
-	} else {
-		return nil, fmt.Errorf("unknown env %v", env)
+	c, err := newCertAndKeyReader(env, domainName)
+	if err != nil {
+		return nil, err
+	}
+	if err = getCertAndKey(c); err != nil {
+		return nil, err
 	}
+	return c.ReturnAll(), nil
 }
@@ -0,0 +1,253 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+)
+
+// The generated api.Ipv6Addr model has no value. A ueId or asId that carries an
+// ipv6addr fails to decode with the api models and loses all its properties.
+// The identifiers are therefore decoded here and the IPv6 address is kept in the
+// AdditionalProperties of api.UeId/api.AsId, which the api models encode as is.
+// The IPv6 address is canonicalised on decode so that the sessions are stored and
+// looked up with the same text whatever notation the client uses.
+
+const IPV6ADDR_PROPERTY = "ipv6addr"
+
+type rawIdentifier struct {
+	ExternalId *string `json:"externalId,omitempty"`
+	Msisdn     *string `json:"msisdn,omitempty"`
+	Ipv4addr   *string `json:"ipv4addr,omitempty"`
+	Ipv6addr   *string `json:"ipv6addr,omitempty"`
+}
+
+type rawIdentifiers struct {
+	UeId *rawIdentifier `json:"ueId,omitempty"`
+	AsId *rawIdentifier `json:"asId,omitempty"`
+}
+
+// FlowAddrs are the addresses the IP flow is described with
+type FlowAddrs struct {
+	UeAddr string
+	AsAddr string
+	Ipv6   bool
+}
+
+func setUeId(ueId *api.UeId, raw *rawIdentifier) {
+	ueId.ExternalId = raw.ExternalId
+	ueId.Msisdn = raw.Msisdn
+	ueId.Ipv4addr = raw.Ipv4addr
+	ueId.Ipv6addr = nil
+	if raw.Ipv6addr != nil {
+		SetUeIpv6Addr(ueId, NormalizeIpv6Addr(*raw.Ipv6addr))
+	}
+}
+
+func setAsId(asId *api.AsId, raw *rawIdentifier) {
+	asId.Ipv4addr = raw.Ipv4addr
+	asId.Ipv6addr = nil
+	if raw.Ipv6addr != nil {
+		SetAsIpv6Addr(asId, NormalizeIpv6Addr(*raw.Ipv6addr))
+	}
+}
+
+func decodeIdentifiers(data []byte, ueId *api.UeId, asId *api.AsId) error {
+	var raw rawIdentifiers
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw.UeId != nil && ueId != nil {
+		setUeId(ueId, raw.UeId)
+	}
+	if raw.AsId != nil && asId != nil {
+		setAsId(asId, raw.AsId)
+	}
+	return nil
+}
+
+// DecodeCreateSession decodes the createSession request body including IPv6 addresses.
+// The generated api.QosProfile only knows QOS_E/S/M/L and the body loses all its
+// properties with any other qos. The qos is therefore decoded apart; it is checked
+// against the QoS profile catalogue on validation.
+func DecodeCreateSession(data []byte, sessionReq *api.CreateSession) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var qos string
+	if rawQos, ok := raw["qos"]; ok {
+		if err := json.Unmarshal(rawQos, &qos); err != nil {
+			return err
+		}
+		delete(raw, "qos")
+		withoutQos, err := json.Marshal(raw)
+		if err != nil {
+			return err
+		}
+		data = withoutQos
+	}
+	if err := json.Unmarshal(data, sessionReq); err != nil {
+		return err
+	}
+	sessionReq.Qos = api.QosProfile(qos)
+	return decodeIdentifiers(data, &sessionReq.UeId, &sessionReq.AsId)
+}
+
+// DecodeRetrieveSessions decodes the retrieveSessions request body including IPv6 addresses
+func DecodeRetrieveSessions(data []byte, retrieveReq *RetrieveSessionsInput) error {
+	if err := json.Unmarshal(data, retrieveReq); err != nil {
+		return err
+	}
+	if retrieveReq.UeId == nil {
+		return nil
+	}
+	return decodeIdentifiers(data, retrieveReq.UeId, nil)
+}
+
+func getIpv6AddrProperty(props map[string]interface{}) *string {
+	if val, ok := props[IPV6ADDR_PROPERTY].(string); ok {
+		return &val
+	}
+	return nil
+}
+
+func GetUeIpv6Addr(ueId *api.UeId) *string {
+	return getIpv6AddrProperty(ueId.AdditionalProperties)
+}
+
+func SetUeIpv6Addr(ueId *api.UeId, addr string) {
+	if ueId.AdditionalProperties == nil {
+		ueId.AdditionalProperties = make(map[string]interface{})
+	}
+	ueId.AdditionalProperties[IPV6ADDR_PROPERTY] = addr
+}
+
+func GetAsIpv6Addr(asId *api.AsId) *string {
+	return getIpv6AddrProperty(asId.AdditionalProperties)
+}
+
+func SetAsIpv6Addr(asId *api.AsId, addr string) {
+	if asId.AdditionalProperties == nil {
+		asId.AdditionalProperties = make(map[string]interface{})
+	}
+	asId.AdditionalProperties[IPV6ADDR_PROPERTY] = addr
+}
+
+// An IPv6 address or prefix (address/prefixLength)
+func isValidIpv6Addr(addr string) bool {
+	var ip net.IP
+	if strings.Contains(addr, "/") {
+		var err error
+		if ip, _, err = net.ParseCIDR(addr); err != nil {
+			return false
+		}
+	} else {
+		ip = net.ParseIP(addr)
+	}
+	return ip != nil && ip.To4() == nil
+}
+
+// NormalizeIpv6Addr returns the canonical text (RFC 5952) of an IPv6 address or
+// prefix, e.g. 2001:db8::1 for 2001:0DB8:0:0::1. An invalid one is returned as is.
+func NormalizeIpv6Addr(addr string) string {
+	if idx := strings.Index(addr, "/"); idx >= 0 {
+		if ip, _, err := net.ParseCIDR(addr); err == nil && ip.To4() == nil {
+			return ip.String() + addr[idx:]
+		}
+		return addr
+	}
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// SelectFlowAddrs picks the UE and AS addresses of the same IP version.
+// IPv4 is preferred when both versions are possible. A UE identified only by
+// msisdn or externalId has no address; the AS address decides the IP version.
+func SelectFlowAddrs(ueId *api.UeId, asId *api.AsId) (*FlowAddrs, error) {
+	if ueId.Ipv4addr != nil && asId.Ipv4addr != nil {
+		return &FlowAddrs{
+			UeAddr: *ueId.Ipv4addr,
+			AsAddr: *asId.Ipv4addr,
+		}, nil
+	}
+	ueIpv6Addr := GetUeIpv6Addr(ueId)
+	asIpv6Addr := GetAsIpv6Addr(asId)
+	if ueIpv6Addr != nil && asIpv6Addr != nil {
+		return &FlowAddrs{
+			UeAddr: *ueIpv6Addr,
+			AsAddr: *asIpv6Addr,
+			Ipv6:   true,
+		}, nil
+	}
+	if ueId.Ipv4addr == nil && ueIpv6Addr == nil && (ueId.Msisdn != nil || ueId.ExternalId != nil) {
+		if asId.Ipv4addr != nil {
+			return &FlowAddrs{
+				AsAddr: *asId.Ipv4addr,
+			}, nil
+		}
+		return &FlowAddrs{
+			AsAddr: *asIpv6Addr,
+			Ipv6:   true,
+		}, nil
+	}
+	return nil, errors.New("ueId and asId do not have addresses of the same IP version")
+}
+
+// FlowUeAddr is the UE address to describe the flow with. The UE address of a UE
+// identified by msisdn or externalId is known to the network only.
+func (f *FlowAddrs) FlowUeAddr() string {
+	if f.UeAddr == "" {
+		return "any"
+	}
+	return f.UeAddr
+}
+
+// NormalizeMsisdn strips the optional '+' of the E.164 number
+func NormalizeMsisdn(msisdn string) string {
+	return strings.TrimPrefix(msisdn, "+")
+}
+
+// ConvertMsisdnToGpsi returns the GPSI of the msisdn as per 3GPP TS 29.571
+func ConvertMsisdnToGpsi(msisdn string) string {
+	return "msisdn-" + NormalizeMsisdn(msisdn)
+}
+
+// An E.164 number, optionally prefixed with '+'
+func isValidMsisdn(msisdn string) bool {
+	digits := NormalizeMsisdn(msisdn)
+	if len(digits) < 5 || len(digits) > 15 {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// An externalId as per 3GPP TS 23.682 (<Local Identifier>@<Domain Identifier>)
+func isValidExternalId(externalId string) bool {
+	idx := strings.Index(externalId, "@")
+	return idx > 0 && idx < len(externalId)-1
+}
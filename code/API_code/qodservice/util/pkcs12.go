@@ -0,0 +1,121 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// The cert & key of the cert.p12 bundle of the certPath dir and the root CA of the
+// rootCA.p12 bundle of the rootCaPath dir. The root CA are the CA certificates of a
+// bundle with a key, so a single bundle with its CA chain may serve both, or the
+// certificates of a Java trust store. Both the legacy 3DES / RC2 and the AES
+// (PBES2) encryption of OpenSSL 3 are read.
+type credFromPkcs12 struct {
+	certPath   string
+	rootCaPath string
+	password   string
+	mTls       MTlsCred
+}
+
+// RegisterPkcs12CredentialReader selects the PKCS#12 bundles with env pkcs12. The
+// bundles are decrypted with the password.
+func RegisterPkcs12CredentialReader(password string) {
+	RegisterCredentialReader(ENV_PKCS12, func(certPath, rootCaPath string) (CredentialReader, error) {
+		return &credFromPkcs12{
+			certPath:   certPath + PKCS12_CERT_OBJ_NAME,
+			rootCaPath: rootCaPath + PKCS12_ROOTCA_OBJ_NAME,
+			password:   password,
+		}, nil
+	})
+}
+
+func encodeCertificates(certs []*x509.Certificate) (certsPem []byte) {
+	for _, cert := range certs {
+		certsPem = append(certsPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return certsPem
+}
+
+// The CA certificates to send after the cert, so that peers trusting only the root
+// can verify it. The self-signed roots are left out.
+func intermediateCerts(caCerts []*x509.Certificate) []*x509.Certificate {
+	var intermediates []*x509.Certificate
+	for _, caCert := range caCerts {
+		if bytes.Equal(caCert.RawSubject, caCert.RawIssuer) && caCert.CheckSignatureFrom(caCert) == nil {
+			continue
+		}
+		intermediates = append(intermediates, caCert)
+	}
+	return intermediates
+}
+
+// The cert & key are in the same bundle. Both are read here. The intermediate CAs of
+// the bundle follow the cert.
+func (c *credFromPkcs12) ReadMyCert() error {
+	pfxData, err := ioutil.ReadFile(c.certPath)
+	if err != nil {
+		return err
+	}
+	key, cert, caCerts, err := pkcs12.DecodeChain(pfxData, c.password)
+	if err != nil {
+		return fmt.Errorf("no cert & key in PKCS#12 bundle %v. error %v", c.certPath, err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("bad key in PKCS#12 bundle %v. error %v", c.certPath, err)
+	}
+	c.mTls.myCert = encodeCertificates(append([]*x509.Certificate{cert}, intermediateCerts(caCerts)...))
+	c.mTls.myKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	return nil
+}
+
+func (c *credFromPkcs12) ReadMyKey() error {
+	if len(c.mTls.myKey) == 0 {
+		return errors.New("no key in PKCS#12 bundle " + c.certPath)
+	}
+	return nil
+}
+
+func (c *credFromPkcs12) ReadRootCA() error {
+	pfxData, err := ioutil.ReadFile(c.rootCaPath)
+	if err != nil {
+		return err
+	}
+	_, _, caCerts, err := pkcs12.DecodeChain(pfxData, c.password)
+	if err != nil {
+		// Not a bundle with a key. Maybe a trust store
+		var trustErr error
+		if caCerts, trustErr = pkcs12.DecodeTrustStore(pfxData, c.password); trustErr != nil {
+			return fmt.Errorf("bad PKCS#12 bundle %v. error %v, as trust store %v", c.rootCaPath, err, trustErr)
+		}
+	}
+	if len(caCerts) == 0 {
+		return errors.New("no CA certificate in PKCS#12 bundle " + c.rootCaPath)
+	}
+	c.mTls.rootCA = encodeCertificates(caCerts)
+	return nil
+}
+
+func (c *credFromPkcs12) ReturnAll() *MTlsCred {
+	return &c.mTls
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestPkcs12Credentials(t *testing.T) {
+	server, ca := newTestServerCert(t)
+	const password = "secret"
+	RegisterPkcs12CredentialReader(password)
+
+	tests := []struct {
+		name    string
+		encoder *pkcs12.Encoder
+	}{
+		{"legacy 3DES", pkcs12.LegacyDES},
+		{"legacy RC2", pkcs12.LegacyRC2},
+		{"AES (OpenSSL 3)", pkcs12.Modern2023},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One bundle with the CA chain serves as cert.p12 and rootCA.p12
+			pfxData, err := tt.encoder.Encode(server.key, server.cert, []*x509.Certificate{ca.cert}, password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			writeTestFile(t, dir, PKCS12_CERT_OBJ_NAME, pfxData)
+			writeTestFile(t, dir, PKCS12_ROOTCA_OBJ_NAME, pfxData)
+
+			m, err := GetTlsCredentials(ENV_PKCS12, dir, dir)
+			if err != nil {
+				t.Fatalf("GetTlsCredentials: %v", err)
+			}
+			if !bytes.Equal(m.GetMyCert(), server.certPem) {
+				t.Errorf("cert is not the one with the key:\n%s", m.GetMyCert())
+			}
+			if _, err := tls.X509KeyPair(m.GetMyCert(), m.GetMyKey()); err != nil {
+				t.Errorf("bad cert & key: %v", err)
+			}
+			if !bytes.Equal(m.GetRootCA(), ca.certPem) {
+				t.Errorf("root CA is not the CA chain of the bundle:\n%s", m.GetRootCA())
+			}
+		})
+	}
+
+	t.Run("intermediate CA", func(t *testing.T) {
+		server, intermediate, root := newTestChainCert(t)
+		pfxData, err := pkcs12.Modern2023.Encode(server.key, server.cert, []*x509.Certificate{intermediate.cert, root.cert}, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		writeTestFile(t, dir, PKCS12_CERT_OBJ_NAME, pfxData)
+
+		m, err := GetTlsCredentialsWithoutRootCA(ENV_PKCS12, dir)
+		if err != nil {
+			t.Fatalf("GetTlsCredentialsWithoutRootCA: %v", err)
+		}
+		if want := append(append([]byte{}, server.certPem...), intermediate.certPem...); !bytes.Equal(m.GetMyCert(), want) {
+			t.Errorf("cert is not followed by the intermediate CA only:\n%s", m.GetMyCert())
+		}
+		verifyTestChain(t, m.GetMyCert(), m.GetMyKey(), root)
+	})
+
+	t.Run("trust store", func(t *testing.T) {
+		pfxData, err := pkcs12.Modern2023.EncodeTrustStore([]*x509.Certificate{ca.cert}, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		writeTestFile(t, dir, PKCS12_ROOTCA_OBJ_NAME, pfxData)
+
+		m, err := GetTlsRootCA(ENV_PKCS12, dir)
+		if err != nil {
+			t.Fatalf("GetTlsRootCA: %v", err)
+		}
+		if !bytes.Equal(m.GetRootCA(), ca.certPem) {
+			t.Errorf("root CA is not the certificate of the trust store:\n%s", m.GetRootCA())
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		pfxData, err := pkcs12.Modern2023.Encode(server.key, server.cert, nil, "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		writeTestFile(t, dir, PKCS12_CERT_OBJ_NAME, pfxData)
+
+		if _, err := GetTlsCredentialsWithoutRootCA(ENV_PKCS12, dir); err == nil {
+			t.Error("GetTlsCredentialsWithoutRootCA: no error")
+		}
+	})
+
+	t.Run("bundle without CA", func(t *testing.T) {
+		pfxData, err := pkcs12.Modern2023.Encode(server.key, server.cert, nil, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		writeTestFile(t, dir, PKCS12_ROOTCA_OBJ_NAME, pfxData)
+
+		if _, err := GetTlsRootCA(ENV_PKCS12, dir); err == nil {
+			t.Error("GetTlsRootCA: no error")
+		}
+	})
+}
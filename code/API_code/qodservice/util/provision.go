@@ -0,0 +1,254 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	_ "time/tzdata" // The time zones of the policies do not depend on the image having tzdata
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/camara/qodmodels/db"
+	"github.com/sfnuser/qodservice/logger"
+)
+
+// QoDProvAppServerData is the provisioned data of an application server. It is
+// the db.ProvQoDAppServerData with the address of IPv6 addressed ASs.
+type QoDProvAppServerData struct {
+	db.ProvQoDAppServerData `mapstructure:",squash"`
+	AsIpv6Addr              string           `json:"asIpv6Addr,omitempty"`
+	Policy                  *AppServerPolicy `json:"policy,omitempty"` // No limits if not given
+}
+
+// AppServerPolicy limits the sessions towards the AS as per the commercial agreement
+type AppServerPolicy struct {
+	MaxDurationSecs       int32 `json:"maxDurationSecs,omitempty" yaml:"maxDurationSecs,omitempty"`
+	MaxConcurrentSessions int   `json:"maxConcurrentSessions,omitempty" yaml:"maxConcurrentSessions,omitempty"`
+	// Sessions can be created within any of these windows only. Any time if not given.
+	TimeWindows []TimeWindow `json:"timeWindows,omitempty" yaml:"timeWindows,omitempty"`
+	TimeZone    string       `json:"timeZone,omitempty" yaml:"timeZone,omitempty"` // IANA name of the windows' time zone. UTC if not given
+}
+
+type TimeWindow struct {
+	Days  []string `json:"days,omitempty" yaml:"days,omitempty"` // Mon, Tue, .. Sun. Every day if not given
+	Start string   `json:"start" yaml:"start"`                   // HH:MM
+	End   string   `json:"end" yaml:"end"`                       // HH:MM, not included. Before start for windows across midnight
+}
+
+type AppServerReq struct {
+	AsAddr string                // Address the AS is provisioned with, from the URI
+	Data   *QoDProvAppServerData // On create and update
+}
+type AppServerResp struct {
+	Data      *QoDProvAppServerData
+	ErrorInfo *api.ErrorInfo
+}
+type AppServersResp struct {
+	Data      []QoDProvAppServerData
+	ErrorInfo *api.ErrorInfo
+}
+
+// AsAddr returns the address the AS is provisioned with and whether it is IPv6
+func (d *QoDProvAppServerData) AsAddr() (string, bool) {
+	if d.AsIpv6Addr != "" {
+		return d.AsIpv6Addr, true
+	}
+	return d.AsIpv4Addr, false
+}
+
+// IsIpv6Addr tells the IP version of an AS address as used in the admin URIs
+func IsIpv6Addr(addr string) bool {
+	return strings.Contains(addr, ":")
+}
+
+// NormalizeAsAddr canonicalises the IPv6 AS address of an admin URI
+func NormalizeAsAddr(addr string) string {
+	if IsIpv6Addr(addr) {
+		return NormalizeIpv6Addr(addr)
+	}
+	return addr
+}
+
+// DecodeAppServerData decodes the provisioned data of an application server. Unknown
+// fields are refused, a misspelt policy field would otherwise lift the limit.
+func DecodeAppServerData(data []byte, asData *QoDProvAppServerData) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(asData); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("unexpected data after the app server data")
+	}
+	return nil
+}
+
+// An IPv4 address or prefix (address/prefixLength)
+func isValidIpv4Addr(addr string) bool {
+	var ip net.IP
+	if strings.Contains(addr, "/") {
+		var err error
+		if ip, _, err = net.ParseCIDR(addr); err != nil {
+			return false
+		}
+	} else {
+		ip = net.ParseIP(addr)
+	}
+	return ip != nil && ip.To4() != nil
+}
+
+// ValidateAppServerData also canonicalises the IPv6 AS address of valid data, the
+// one the AS is stored and looked up with
+func ValidateAppServerData(asData *QoDProvAppServerData) error {
+	var errString string
+	switch {
+	case asData.AsIpv4Addr == "" && asData.AsIpv6Addr == "":
+		errString = "asIpv4Addr or asIpv6Addr is mandatory"
+	case asData.AsIpv4Addr != "" && asData.AsIpv6Addr != "":
+		errString = "only one of asIpv4Addr or asIpv6Addr is allowed"
+	case asData.AsIpv4Addr != "" && !isValidIpv4Addr(asData.AsIpv4Addr):
+		errString = fmt.Sprintf("asIpv4Addr %v not valid", asData.AsIpv4Addr)
+	case asData.AsIpv6Addr != "" && !isValidIpv6Addr(asData.AsIpv6Addr):
+		errString = fmt.Sprintf("asIpv6Addr %v not valid", asData.AsIpv6Addr)
+	case strings.TrimSpace(asData.ScsAsId) == "":
+		errString = "scsAsId is mandatory"
+	case len(asData.QoSMap) == 0:
+		errString = "qosMap is mandatory"
+	}
+	if errString != "" {
+		logger.Util.Error("error:", logger.LogString("asData", errString))
+		return errors.New(errString)
+	}
+	if asData.Policy != nil {
+		if err := validateAppServerPolicy(asData.Policy); err != nil {
+			logger.Util.Error("error:", logger.LogString("asData", err.Error()))
+			return err
+		}
+	}
+	for qosProfile, qosReference := range asData.QoSMap {
+		qos := api.QosProfile(qosProfile)
+		if err := validateQoS(&qos); err != nil {
+			return fmt.Errorf("qosMap key %v is not a valid qosProfile", qosProfile)
+		}
+		if strings.TrimSpace(qosReference) == "" {
+			errString = fmt.Sprintf("qosMap qosReference of %v is empty", qosProfile)
+			logger.Util.Error("error:", logger.LogString("asData", errString))
+			return errors.New(errString)
+		}
+	}
+	asData.AsIpv6Addr = NormalizeIpv6Addr(asData.AsIpv6Addr)
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+// Minutes since midnight of HH:MM
+func parseTimeOfDay(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, fmt.Errorf("time %v is not HH:MM", hhmm)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func validateAppServerPolicy(policy *AppServerPolicy) error {
+	if policy.MaxDurationSecs < 0 {
+		return fmt.Errorf("policy maxDurationSecs %v not valid", policy.MaxDurationSecs)
+	}
+	if policy.MaxConcurrentSessions < 0 {
+		return fmt.Errorf("policy maxConcurrentSessions %v not valid", policy.MaxConcurrentSessions)
+	}
+	if _, err := time.LoadLocation(policy.TimeZone); err != nil {
+		return fmt.Errorf("policy timeZone %v not valid", policy.TimeZone)
+	}
+	for i, window := range policy.TimeWindows {
+		for _, day := range window.Days {
+			if _, ok := weekdays[day]; !ok {
+				return fmt.Errorf("policy timeWindows[%v] day %v not valid", i, day)
+			}
+		}
+		start, err := parseTimeOfDay(window.Start)
+		if err != nil {
+			return fmt.Errorf("policy timeWindows[%v] start: %v", i, err)
+		}
+		end, err := parseTimeOfDay(window.End)
+		if err != nil {
+			return fmt.Errorf("policy timeWindows[%v] end: %v", i, err)
+		}
+		if start == end {
+			return fmt.Errorf("policy timeWindows[%v] is empty", i)
+		}
+	}
+	return nil
+}
+
+// InTimeWindows tells if 't' is within any of the time windows of the policy. A
+// window across midnight belongs to the day it starts on.
+func (p *AppServerPolicy) InTimeWindows(t time.Time) bool {
+	if len(p.TimeWindows) == 0 {
+		return true
+	}
+	if loc, err := time.LoadLocation(p.TimeZone); err == nil {
+		t = t.In(loc)
+	}
+	now := t.Hour()*60 + t.Minute()
+	for _, window := range p.TimeWindows {
+		// Validated on provisioning
+		start, _ := parseTimeOfDay(window.Start)
+		end, _ := parseTimeOfDay(window.End)
+		day := t.Weekday()
+		if start < end {
+			if now < start || now >= end {
+				continue
+			}
+		} else if now >= start {
+			// Within the window started today
+		} else if now < end {
+			// Within the window started yesterday
+			day = (day + 6) % 7
+		} else {
+			continue
+		}
+		if windowOnDay(&window, day) {
+			return true
+		}
+	}
+	return false
+}
+
+func windowOnDay(window *TimeWindow, day time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, d := range window.Days {
+		if weekdays[d] == day {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+)
+
+func TestDecodeAppServerData(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"valid", `{"asIpv4Addr": "10.0.0.1", "scsAsId": "as1", "qosMap": {"QOS_E": "ref1"},
+			"policy": {"maxDurationSecs": 600, "timeWindows": [{"days": ["Mon"], "start": "08:00", "end": "18:00"}]}}`, false},
+		{"IPv6", `{"asIpv6Addr": "2001:db8::1", "scsAsId": "as1", "qosMap": {"QOS_E": "ref1"}}`, false},
+		{"unknown field", `{"asIpv4Addr": "10.0.0.1", "scsAsId": "as1", "qosMap": {"QOS_E": "ref1"}, "priority": 1}`, true},
+		{"misspelt policy field", `{"asIpv4Addr": "10.0.0.1", "scsAsId": "as1", "qosMap": {"QOS_E": "ref1"},
+			"policy": {"maxDuration": 600}}`, true},
+		{"unknown time window field", `{"asIpv4Addr": "10.0.0.1", "scsAsId": "as1", "qosMap": {"QOS_E": "ref1"},
+			"policy": {"timeWindows": [{"start": "08:00", "end": "18:00", "tz": "CET"}]}}`, true},
+		{"trailing data", `{"asIpv4Addr": "10.0.0.1", "scsAsId": "as1", "qosMap": {"QOS_E": "ref1"}} {}`, true},
+		{"wrong type", `{"asIpv4Addr": "10.0.0.1", "scsAsId": "as1", "qosMap": ["QOS_E"]}`, true},
+		{"not JSON", `asIpv4Addr: 10.0.0.1`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var asData QoDProvAppServerData
+			err := DecodeAppServerData([]byte(tt.data), &asData)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (asData.ScsAsId != "as1" || asData.QoSMap["QOS_E"] != "ref1") {
+				t.Errorf("decoded %+v", asData)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sfnuser/camara/qodmodels/api"
+	"github.com/sfnuser/qodservice/logger"
+)
+
+// The QoS profile catalogue tells the clients what each qosProfile stands for,
+// in the model of the CAMARA QoS Profiles API. The qos of the requests is
+// checked against it.
+
+const (
+	QOS_PROFILE_STATUS_ACTIVE     = "ACTIVE"
+	QOS_PROFILE_STATUS_INACTIVE   = "INACTIVE" // Not offered; requests with it are rejected
+	QOS_PROFILE_STATUS_DEPRECATED = "DEPRECATED"
+)
+
+type Rate struct {
+	Value int32  `json:"value"`
+	Unit  string `json:"unit"` // bps, kbps, Mbps, Gbps or Tbps
+}
+
+type Duration struct {
+	Value int32  `json:"value"`
+	Unit  string `json:"unit"` // Days, Hours, Minutes, Seconds, Milliseconds, Microseconds or Nanoseconds
+}
+
+type QosProfileInfo struct {
+	Name                    string    `json:"name"`
+	Description             string    `json:"description,omitempty"`
+	Status                  string    `json:"status"`
+	TargetMinUpstreamRate   *Rate     `json:"targetMinUpstreamRate,omitempty"`
+	TargetMinDownstreamRate *Rate     `json:"targetMinDownstreamRate,omitempty"`
+	PacketDelayBudget       *Duration `json:"packetDelayBudget,omitempty"` // Latency
+	Jitter                  *Duration `json:"jitter,omitempty"`
+	PacketErrorLossRate     *int32    `json:"packetErrorLossRate,omitempty"` // Exponent n of the rate 10^-n
+	MaxDuration             *Duration `json:"maxDuration,omitempty"`         // Of the sessions with this profile
+}
+
+type GetQosProfilesResp struct {
+	QosProfiles []QosProfileInfo
+	ErrorInfo   *api.ErrorInfo
+}
+type GetQosProfileReq struct {
+	Name string
+}
+type GetQosProfileResp struct {
+	QosProfile *QosProfileInfo
+	ErrorInfo  *api.ErrorInfo
+}
+
+var rateUnits = map[string]bool{"bps": true, "kbps": true, "Mbps": true, "Gbps": true, "Tbps": true}
+
+var durationUnitSecs = map[string]float64{
+	"Days":         86400,
+	"Hours":        3600,
+	"Minutes":      60,
+	"Seconds":      1,
+	"Milliseconds": 1e-3,
+	"Microseconds": 1e-6,
+	"Nanoseconds":  1e-9,
+}
+
+// The catalogue when none is configured
+var defaultQosProfiles = []QosProfileInfo{
+	{
+		Name:        string(api.E),
+		Description: "Enhanced communication, for latency sensitive real time interaction",
+		Status:      QOS_PROFILE_STATUS_ACTIVE,
+	},
+	{
+		Name:        string(api.S),
+		Description: "Small guaranteed bitrate, e.g. for audio or low resolution video",
+		Status:      QOS_PROFILE_STATUS_ACTIVE,
+	},
+	{
+		Name:        string(api.M),
+		Description: "Medium guaranteed bitrate, e.g. for HD video",
+		Status:      QOS_PROFILE_STATUS_ACTIVE,
+	},
+	{
+		Name:        string(api.L),
+		Description: "Large guaranteed bitrate, e.g. for 4K video",
+		Status:      QOS_PROFILE_STATUS_ACTIVE,
+	},
+}
+
+var qosProfiles = struct {
+	sync.RWMutex
+	profiles []QosProfileInfo
+	byName   map[string]*QosProfileInfo
+}{}
+
+func init() {
+	setQosProfiles(defaultQosProfiles)
+}
+
+func setQosProfiles(profiles []QosProfileInfo) {
+	byName := make(map[string]*QosProfileInfo, len(profiles))
+	for i := range profiles {
+		byName[profiles[i].Name] = &profiles[i]
+	}
+	qosProfiles.Lock()
+	qosProfiles.profiles = profiles
+	qosProfiles.byName = byName
+	qosProfiles.Unlock()
+}
+
+// SetQosProfiles replaces the catalogue. Profiles without status are ACTIVE.
+func SetQosProfiles(profiles []QosProfileInfo) error {
+	catalogue := make([]QosProfileInfo, len(profiles))
+	names := make(map[string]bool, len(profiles))
+	for i, profile := range profiles {
+		if err := validateQosProfileInfo(&profile); err != nil {
+			return fmt.Errorf("qosProfiles[%v]: %v", i, err)
+		}
+		if names[profile.Name] {
+			return fmt.Errorf("qosProfiles[%v]: name %v is listed twice", i, profile.Name)
+		}
+		names[profile.Name] = true
+		if profile.Status == "" {
+			profile.Status = QOS_PROFILE_STATUS_ACTIVE
+		}
+		catalogue[i] = profile
+	}
+	if len(catalogue) == 0 {
+		return errors.New("qosProfiles is empty")
+	}
+	setQosProfiles(catalogue)
+	return nil
+}
+
+func GetQosProfiles() []QosProfileInfo {
+	qosProfiles.RLock()
+	defer qosProfiles.RUnlock()
+	profiles := make([]QosProfileInfo, len(qosProfiles.profiles))
+	copy(profiles, qosProfiles.profiles)
+	return profiles
+}
+
+func GetQosProfile(name string) (*QosProfileInfo, bool) {
+	qosProfiles.RLock()
+	defer qosProfiles.RUnlock()
+	profile, ok := qosProfiles.byName[name]
+	if !ok {
+		return nil, false
+	}
+	clone := *profile
+	return &clone, true
+}
+
+// MaxDurationSecs returns the maxDuration in seconds, 0 when the profile has none
+func (p *QosProfileInfo) MaxDurationSecs() int64 {
+	if p.MaxDuration == nil {
+		return 0
+	}
+	return int64(float64(p.MaxDuration.Value) * durationUnitSecs[p.MaxDuration.Unit])
+}
+
+func validateRate(field string, rate *Rate) error {
+	if rate != nil && (rate.Value < 0 || !rateUnits[rate.Unit]) {
+		return fmt.Errorf("%v %v %v not valid", field, rate.Value, rate.Unit)
+	}
+	return nil
+}
+
+func validateDuration(field string, duration *Duration) error {
+	if duration == nil {
+		return nil
+	}
+	if _, ok := durationUnitSecs[duration.Unit]; !ok || duration.Value < 0 {
+		return fmt.Errorf("%v %v %v not valid", field, duration.Value, duration.Unit)
+	}
+	return nil
+}
+
+func validateQosProfileInfo(profile *QosProfileInfo) error {
+	if profile.Name == "" {
+		return errors.New("name is mandatory")
+	}
+	switch profile.Status {
+	case "", QOS_PROFILE_STATUS_ACTIVE, QOS_PROFILE_STATUS_INACTIVE, QOS_PROFILE_STATUS_DEPRECATED:
+	default:
+		return fmt.Errorf("status %v not valid", profile.Status)
+	}
+	if err := validateRate("targetMinUpstreamRate", profile.TargetMinUpstreamRate); err != nil {
+		return err
+	}
+	if err := validateRate("targetMinDownstreamRate", profile.TargetMinDownstreamRate); err != nil {
+		return err
+	}
+	if err := validateDuration("packetDelayBudget", profile.PacketDelayBudget); err != nil {
+		return err
+	}
+	if err := validateDuration("jitter", profile.Jitter); err != nil {
+		return err
+	}
+	if err := validateDuration("maxDuration", profile.MaxDuration); err != nil {
+		return err
+	}
+	if profile.MaxDuration != nil && profile.MaxDurationSecs() < 1 {
+		return errors.New("maxDuration is less than a second")
+	}
+	if profile.PacketErrorLossRate != nil && *profile.PacketErrorLossRate < 0 {
+		return fmt.Errorf("packetErrorLossRate %v not valid", *profile.PacketErrorLossRate)
+	}
+	return nil
+}
+
+// The session duration is checked against the maxDuration of its qosProfile
+func validateQosDuration(qos *api.QosProfile, duration *int32) error {
+	if duration == nil {
+		return nil
+	}
+	profile, ok := GetQosProfile(string(*qos))
+	if !ok {
+		return nil
+	}
+	if maxDuration := profile.MaxDurationSecs(); maxDuration != 0 && int64(*duration) > maxDuration {
+		errString := fmt.Sprintf("duration %v exceeds the maxDuration %v secs of qosProfile %v", *duration,
+			maxDuration, *qos)
+		logger.Util.Error("error:", logger.LogString("qos", errString))
+		return errors.New(errString)
+	}
+	return nil
+}
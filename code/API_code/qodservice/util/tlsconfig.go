@@ -0,0 +1,108 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+const (
+	TLS_DEFAULT_MIN_VERSION = "1.2"
+)
+
+// TLS versions a server may be limited to. The ones before 1.2 are deprecated (RFC 8996).
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Cipher suites of TLS 1.2 when none are configured: forward secret and AEAD only.
+// The ones of TLS 1.3 are not configurable.
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// TlsPolicy of the servers
+type TlsPolicy struct {
+	MinVersion   string   // 1.2 or 1.3. TLS_DEFAULT_MIN_VERSION if empty
+	CipherSuites []string // TLS 1.2 cipher suites by their Go / IANA name. defaultCipherSuites if empty
+}
+
+// NewServerTlsConfig returns the tls.Config of a server as per the policy. HTTP/2 is
+// offered by ALPN ahead of HTTP/1.1. The certificate is to be added by the caller.
+func NewServerTlsConfig(policy *TlsPolicy) (*tls.Config, error) {
+	minVersion := TLS_DEFAULT_MIN_VERSION
+	var cipherNames []string
+	if policy != nil {
+		if policy.MinVersion != "" {
+			minVersion = policy.MinVersion
+		}
+		cipherNames = policy.CipherSuites
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS minVersion %v, 1.2 or 1.3 expected", minVersion)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: version,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if version == tls.VersionTLS13 {
+		// Go does not let the TLS 1.3 suites be configured, a list would be ignored
+		if len(cipherNames) > 0 {
+			return nil, fmt.Errorf("TLS cipherSuites apply to TLS 1.2 only, they cannot be set with minVersion %v", minVersion)
+		}
+		return tlsConfig, nil
+	}
+
+	if len(cipherNames) == 0 {
+		tlsConfig.CipherSuites = defaultCipherSuites
+		return tlsConfig, nil
+	}
+	secure := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	var h2Capable bool
+	for _, name := range cipherNames {
+		id, ok := secure[name]
+		if !ok {
+			if insecure[name] {
+				return nil, fmt.Errorf("insecure TLS cipher suite %v", name)
+			}
+			return nil, fmt.Errorf("unknown TLS cipher suite %v", name)
+		}
+		// HTTP/2 mandates one of these with TLS 1.2 (RFC 7540 9.2.2)
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			h2Capable = true
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	if !h2Capable {
+		return nil, fmt.Errorf("TLS cipherSuites miss the one HTTP/2 requires: " +
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestNewServerTlsConfig(t *testing.T) {
+	tests := []struct {
+		name             string
+		policy           *TlsPolicy
+		wantMinVersion   uint16
+		wantCipherSuites []uint16
+		wantErr          string
+	}{
+		{name: "no policy", wantMinVersion: tls.VersionTLS12, wantCipherSuites: defaultCipherSuites},
+		{name: "default", policy: &TlsPolicy{}, wantMinVersion: tls.VersionTLS12, wantCipherSuites: defaultCipherSuites},
+		{name: "TLS 1.3", policy: &TlsPolicy{MinVersion: "1.3"}, wantMinVersion: tls.VersionTLS13},
+		{
+			name: "cipher suites",
+			policy: &TlsPolicy{MinVersion: "1.2", CipherSuites: []string{
+				"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+			wantMinVersion: tls.VersionTLS12,
+			wantCipherSuites: []uint16{
+				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		},
+		{
+			name:             "ECDSA suite HTTP/2 requires",
+			policy:           &TlsPolicy{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}},
+			wantMinVersion:   tls.VersionTLS12,
+			wantCipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		},
+		{
+			name:    "without the suite HTTP/2 requires",
+			policy:  &TlsPolicy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+			wantErr: "TLS cipherSuites miss the one HTTP/2 requires: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		},
+		{
+			name:    "insecure suite",
+			policy:  &TlsPolicy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"}},
+			wantErr: "insecure TLS cipher suite TLS_RSA_WITH_RC4_128_SHA",
+		},
+		{
+			name:    "unknown suite",
+			policy:  &TlsPolicy{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_NULL"}},
+			wantErr: "unknown TLS cipher suite TLS_NULL",
+		},
+		{
+			name:    "cipher suites with TLS 1.3",
+			policy:  &TlsPolicy{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+			wantErr: "TLS cipherSuites apply to TLS 1.2 only, they cannot be set with minVersion 1.3",
+		},
+		{
+			name:    "TLS 1.1",
+			policy:  &TlsPolicy{MinVersion: "1.1"},
+			wantErr: "unsupported TLS minVersion 1.1, 1.2 or 1.3 expected",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := NewServerTlsConfig(tt.policy)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tlsConfig.MinVersion != tt.wantMinVersion {
+				t.Errorf("MinVersion %x, want %x", tlsConfig.MinVersion, tt.wantMinVersion)
+			}
+			if !reflect.DeepEqual(tlsConfig.CipherSuites, tt.wantCipherSuites) {
+				t.Errorf("CipherSuites %v, want %v", tlsConfig.CipherSuites, tt.wantCipherSuites)
+			}
+			if !reflect.DeepEqual(tlsConfig.NextProtos, []string{"h2", "http/1.1"}) {
+				t.Errorf("NextProtos %v, want h2 first", tlsConfig.NextProtos)
+			}
+		})
+	}
+}
@@ -35,6 +35,10 @@ const (
 	SERVICE_UNAVAILABLE string = "SERVICE_UNAVAILABLE"
 	CONFLICT            string = "CONFLICT"
 	INTERNAL            string = "INTERNAL"
+	OUT_OF_RANGE        string = "OUT_OF_RANGE"      // A value within the schema but beyond what is allowed
+	QUOTA_EXCEEDED      string = "QUOTA_EXCEEDED"    // The client is out of its resource quota
+	UNAUTHENTICATED     string = "UNAUTHENTICATED"   // Access token missing, invalid or expired
+	PERMISSION_DENIED   string = "PERMISSION_DENIED" // Access token lacks the scope of the route
 )
 
 var allowedErrorCodes = []string{
@@ -45,10 +49,13 @@ var allowedErrorCodes = []string{
 	"SERVICE_UNAVAILABLE",
 	"CONFLICT",
 	"INTERNAL",
+	"OUT_OF_RANGE",
+	"QUOTA_EXCEEDED",
 }
 
 type CreateSessionReq struct {
 	SessionReq *api.CreateSession
+	ClientId   string // OAuth2 client creating the session
 }
 type CreateSessionResp struct {
 	SessionInfo *api.SessionInfo
@@ -56,10 +63,88 @@ type CreateSessionResp struct {
 }
 type DeleteSessionReq struct {
 	SessionId string
+	ClientId  string // Only the owner of the session may delete it
+	IsAdmin   bool   // Unless the client has the admin scope
 }
 type DeleteSessionResp struct {
 	ErrorInfo *api.ErrorInfo // If no error then session is deleted successfully
 }
+type GetSessionReq struct {
+	SessionId string
+	ClientId  string // Only the owner of the session may get it
+	IsAdmin   bool   // Unless the client has the admin scope
+}
+type GetSessionResp struct {
+	SessionInfo *api.SessionInfo
+	ErrorInfo   *api.ErrorInfo
+}
+
+type RetrieveSessionsReq struct {
+	UeId     *api.UeId
+	ClientId string // Only the sessions of this OAuth2 client are retrieved
+}
+type RetrieveSessionsResp struct {
+	SessionInfos []api.SessionInfo
+	ErrorInfo    *api.ErrorInfo
+}
+
+// Request body of the retrieve sessions operation (later QoD versions)
+type RetrieveSessionsInput struct {
+	UeId *api.UeId `json:"ueId"`
+}
+
+type ExtendSessionReq struct {
+	SessionId          string
+	AdditionalDuration int32
+	ClientId           string // Only the owner of the session may extend it
+	IsAdmin            bool   // Unless the client has the admin scope
+}
+type ExtendSessionResp struct {
+	SessionInfo *api.SessionInfo
+	ErrorInfo   *api.ErrorInfo
+}
+
+// Request body of the extend session duration operation (later QoD versions)
+type ExtendSessionDuration struct {
+	// Additional duration in seconds to be added to the current session duration
+	RequestedAdditionalDuration *int32 `json:"requestedAdditionalDuration"`
+}
+
+type NefNotificationReq struct {
+	Notification *NefUserPlaneNotification
+}
+type NefNotificationResp struct {
+	ErrorInfo *api.ErrorInfo // If no error then notification is handled
+}
+
+// UserPlaneNotificationData as per 3GPP TS 29.122. The generated NEF model is unable to
+// decode the event enum, hence the events are kept as plain strings here.
+type NefUserPlaneNotification struct {
+	Transaction  string                    `json:"transaction"`
+	EventReports []NefUserPlaneEventReport `json:"eventReports"`
+}
+type NefUserPlaneEventReport struct {
+	Event         string   `json:"event"`
+	FlowIds       *[]int32 `json:"flowIds,omitempty"`
+	AppliedQosRef *string  `json:"appliedQosRef,omitempty"`
+}
+
+type ReconcileResp struct {
+	Report    *ReconcileReport
+	ErrorInfo *api.ErrorInfo
+}
+
+// Outcome of a reconciliation between the sessions and the NEF subscriptions
+type ReconcileReport struct {
+	StartedAt            int64 `json:"startedAt"`
+	SessionsChecked      int   `json:"sessionsChecked"`
+	SubscriptionsMissing int   `json:"subscriptionsMissing"` // Sessions whose NEF subscription is gone
+	NefSubscriptions     int   `json:"nefSubscriptions"`
+	OrphansFound         int   `json:"orphansFound"` // NEF subscriptions without a session
+	OrphansDeleted       int   `json:"orphansDeleted"`
+	DeadLettersCleared   int   `json:"deadLettersCleared"`
+	Errors               int   `json:"errors"`
+}
 
 type QoDApiSessionInfo struct {
 	SessionReq              *api.CreateSession
@@ -72,6 +157,24 @@ type QoDApiSessionInfo struct {
 	QosReference            string
 	FlowId                  uint32
 	FlowDescriptions        *[]string
+	ClientId                string
+}
+
+// QoDServiceSession is the session document stored by this service. It is the
+// db.ServiceQoDUeSession with the fields that only this service uses.
+type QoDServiceSession struct {
+	db.ServiceQoDUeSession `mapstructure:",squash"`
+	ClientId               string `json:"clientId,omitempty"` // OAuth2 client that owns the session
+	// The api models are unable to store IPv6 addresses, hence these are kept here
+	UeIpv6Addr string `json:"ueIpv6Addr,omitempty"`
+	AsIpv6Addr string `json:"asIpv6Addr,omitempty"`
+	// UE identifiers the session is keyed on when the UE has no IP address
+	UeMsisdn     string `json:"ueMsisdn,omitempty"` // Without the '+' prefix
+	UeExternalId string `json:"ueExternalId,omitempty"`
+	// Set by the reconciliation when NEF no longer has the subscription of the session
+	NefSubscriptionMissing bool `json:"nefSubscriptionMissing,omitempty"`
+	// The session holds one of the maxConcurrentSessions slots of the AS
+	AsSlot bool `json:"asSlot,omitempty"`
 }
 
 func NewQoDErrorInfo(code, message string) []byte {
@@ -83,46 +186,59 @@ func NewQoDErrorInfo(code, message string) []byte {
 	return data
 }
 func validateUeId(ueId *api.UeId) error {
-	if ueId.Ipv4addr == nil {
-		//We need mandatory IPv4Addr within ueId at this point
-		errString := "ueId did not have mandatory ipv4Addr property"
+	ueIpv6Addr := GetUeIpv6Addr(ueId)
+	if ueId.Ipv4addr == nil && ueIpv6Addr == nil && ueId.Msisdn == nil && ueId.ExternalId == nil {
+		//We need at least one of the UE identifiers at this point
+		errString := "ueId did not have any of ipv4addr, ipv6addr, msisdn or externalId property"
 		logger.Util.Error("error:", logger.LogString("ueId", errString))
 		return errors.New(errString)
 	}
-	if ueId.Ipv6addr != nil {
-		logger.Util.Sugar().Warnf("ueId: ipv6addr processing unsupported. ipv6addr %v", ueId.Ipv4addr)
+	if ueIpv6Addr != nil && !isValidIpv6Addr(*ueIpv6Addr) {
+		errString := fmt.Sprintf("ueId ipv6addr %v not valid", *ueIpv6Addr)
+		logger.Util.Error("error:", logger.LogString("ueId", errString))
+		return errors.New(errString)
 	}
-	if ueId.ExternalId != nil {
-		logger.Util.Sugar().Warnf("ueId: externalId processing unsupported. externalId %v", ueId.ExternalId)
+	if ueId.Msisdn != nil && !isValidMsisdn(*ueId.Msisdn) {
+		errString := fmt.Sprintf("ueId msisdn %v not valid", *ueId.Msisdn)
+		logger.Util.Error("error:", logger.LogString("ueId", errString))
+		return errors.New(errString)
 	}
-	if ueId.Msisdn != nil {
-		logger.Util.Sugar().Warnf("ueId: msisdn processing unsupported. msisdn %v", ueId.Msisdn)
+	if ueId.ExternalId != nil && !isValidExternalId(*ueId.ExternalId) {
+		errString := fmt.Sprintf("ueId externalId %v not valid", *ueId.ExternalId)
+		logger.Util.Error("error:", logger.LogString("ueId", errString))
+		return errors.New(errString)
 	}
 	return nil
 }
 func validateAsId(asId *api.AsId) error {
-	if asId.Ipv4addr == nil {
-		//We need mandatory IPv4Addr within ueId at this point
-		errString := "asId did not have mandatory ipv4Addr property"
+	asIpv6Addr := GetAsIpv6Addr(asId)
+	if asId.Ipv4addr == nil && asIpv6Addr == nil {
+		//We need mandatory IPv4Addr or IPv6Addr within asId at this point
+		errString := "asId did not have mandatory ipv4addr or ipv6addr property"
 		logger.Util.Error("error:", logger.LogString("asId", errString))
 		return errors.New(errString)
 	}
-	if asId.Ipv6addr != nil {
-		logger.Util.Sugar().Warnf("asId: ipv6addr processing unsupported. ipv6addr %v", asId.Ipv4addr)
+	if asIpv6Addr != nil && !isValidIpv6Addr(*asIpv6Addr) {
+		errString := fmt.Sprintf("asId ipv6addr %v not valid", *asIpv6Addr)
+		logger.Util.Error("error:", logger.LogString("asId", errString))
+		return errors.New(errString)
 	}
 	return nil
 }
+
+// The qosProfile has to be in the catalogue and not INACTIVE
 func validateQoS(qos *api.QosProfile) error {
-	switch *qos {
-	case api.E:
-	case api.L:
-	case api.M:
-	case api.S:
-	default:
+	profile, ok := GetQosProfile(string(*qos))
+	if !ok {
 		errString := "qosProfile invalid"
 		logger.Util.Error("error:", logger.LogString("qos", errString))
 		return errors.New(errString)
 	}
+	if profile.Status == QOS_PROFILE_STATUS_INACTIVE {
+		errString := fmt.Sprintf("qosProfile %v is inactive", *qos)
+		logger.Util.Error("error:", logger.LogString("qos", errString))
+		return errors.New(errString)
+	}
 	return nil
 }
 func isValidPort(port int32) bool {
@@ -178,23 +294,50 @@ func ValidateSessionReq(sessionReq *api.CreateSession) error {
 		err = validateAsId(&sessionReq.AsId)
 		if err == nil {
 			err = validateQoS(&sessionReq.Qos)
+			if err == nil {
+				err = validateQosDuration(&sessionReq.Qos, sessionReq.Duration)
+			}
 			if err == nil {
 				err = validateUePorts(sessionReq.UePorts)
 				if err == nil {
 					err = validateAsPorts(sessionReq.AsPorts)
+					if err == nil {
+						_, err = SelectFlowAddrs(&sessionReq.UeId, &sessionReq.AsId)
+					}
 				}
 			}
 		}
 	}
 	return err
 }
+func ValidateRetrieveSessionsReq(retrieveReq *RetrieveSessionsInput) error {
+	if retrieveReq.UeId == nil {
+		errString := "ueId missing"
+		logger.Util.Error("error:", logger.LogString("retrieve", errString))
+		return errors.New(errString)
+	}
+	return validateUeId(retrieveReq.UeId)
+}
+func ValidateExtendSessionReq(extendReq *ExtendSessionDuration) error {
+	if extendReq.RequestedAdditionalDuration == nil {
+		errString := "requestedAdditionalDuration missing"
+		logger.Util.Error("error:", logger.LogString("extend", errString))
+		return errors.New(errString)
+	}
+	if *extendReq.RequestedAdditionalDuration < 1 {
+		errString := fmt.Sprintf("requestedAdditionalDuration %v not valid", *extendReq.RequestedAdditionalDuration)
+		logger.Util.Error("error:", logger.LogString("extend", errString))
+		return errors.New(errString)
+	}
+	return nil
+}
 func ConvertErrorToHttpStatusCode(errCode string) int {
 	switch errCode {
-	case INVALID_INPUT:
+	case INVALID_INPUT, OUT_OF_RANGE:
 		return http.StatusBadRequest
-	case UNAUTHORIZED:
+	case UNAUTHORIZED, UNAUTHENTICATED:
 		return http.StatusUnauthorized
-	case FORBIDDEN:
+	case FORBIDDEN, PERMISSION_DENIED:
 		return http.StatusForbidden
 	case NOT_FOUND:
 		return http.StatusNotFound
@@ -202,6 +345,8 @@ func ConvertErrorToHttpStatusCode(errCode string) int {
 		return http.StatusServiceUnavailable
 	case CONFLICT:
 		return http.StatusConflict
+	case QUOTA_EXCEEDED:
+		return http.StatusTooManyRequests
 	default:
 		return http.StatusInternalServerError
 	}
@@ -225,8 +370,23 @@ func ConvertPortSpecToFilterFormat(ports *api.PortsSpec) string {
 	logger.Util.Sugar().Debugf("ConvPortSpecToFilter: portFmt %v", portFmt)
 	return portFmt
 }
-func ConvertSpecToDbSessionInfo(inSession *QoDApiSessionInfo) *db.ServiceQoDUeSession {
-	session := db.ServiceQoDUeSession{
+func ConvertSpecToDbSessionInfo(inSession *QoDApiSessionInfo) *QoDServiceSession {
+	serviceSession := QoDServiceSession{
+		ClientId: inSession.ClientId,
+	}
+	if ueIpv6Addr := GetUeIpv6Addr(&inSession.SessionReq.UeId); ueIpv6Addr != nil {
+		serviceSession.UeIpv6Addr = *ueIpv6Addr
+	}
+	if asIpv6Addr := GetAsIpv6Addr(&inSession.SessionReq.AsId); asIpv6Addr != nil {
+		serviceSession.AsIpv6Addr = *asIpv6Addr
+	}
+	if msisdn := inSession.SessionReq.UeId.Msisdn; msisdn != nil {
+		serviceSession.UeMsisdn = NormalizeMsisdn(*msisdn)
+	}
+	if externalId := inSession.SessionReq.UeId.ExternalId; externalId != nil {
+		serviceSession.UeExternalId = *externalId
+	}
+	serviceSession.ServiceQoDUeSession = db.ServiceQoDUeSession{
 		UeIpv4Addr:              inSession.UeIpv4Addr,
 		ScsAsId:                 inSession.ScsAsId,
 		SessionId:               inSession.SessionId,
@@ -238,13 +398,15 @@ func ConvertSpecToDbSessionInfo(inSession *QoDApiSessionInfo) *db.ServiceQoDUeSe
 			FlowDescriptions: inSession.FlowDescriptions,
 		},
 	}
-	dbSessReq := &session.SessionReq
-	dbSessInfo := &session.SessionInfo
+	dbSessReq := &serviceSession.SessionReq
+	dbSessInfo := &serviceSession.SessionInfo
 	inSessReq := inSession.SessionReq
 
 	// Copy SessionReq data
 	dbSessReq.AsId.Ipv4addr = inSessReq.AsId.Ipv4addr
 	dbSessReq.UeId.Ipv4addr = inSessReq.UeId.Ipv4addr
+	dbSessReq.UeId.Msisdn = inSessReq.UeId.Msisdn
+	dbSessReq.UeId.ExternalId = inSessReq.UeId.ExternalId
 	dbSessReq.Duration = inSessReq.Duration
 	if inSessReq.UePorts != nil {
 		dbSessReq.UePorts = inSessReq.UePorts
@@ -268,12 +430,64 @@ func ConvertSpecToDbSessionInfo(inSession *QoDApiSessionInfo) *db.ServiceQoDUeSe
 
 	dbSessInfo.AsId.Ipv4addr = dbSessReq.AsId.Ipv4addr
 	dbSessInfo.UeId.Ipv4addr = dbSessReq.UeId.Ipv4addr
+	dbSessInfo.UeId.Msisdn = dbSessReq.UeId.Msisdn
+	dbSessInfo.UeId.ExternalId = dbSessReq.UeId.ExternalId
 	dbSessInfo.Qos = dbSessReq.Qos
 	dbSessInfo.NotificationUri = dbSessReq.NotificationUri
 	dbSessInfo.NotificationAuthToken = dbSessReq.NotificationAuthToken
 
-	return &session
+	return &serviceSession
+}
+func ConvertDbToSpecSessionInfo(session *db.ServiceQoDUeSession) *api.SessionInfo {
+	dbSessInfo := &session.SessionInfo
+	sessionInfo := api.SessionInfo{
+		Id:                    dbSessInfo.Id,
+		Duration:              dbSessInfo.Duration,
+		StartedAt:             dbSessInfo.StartedAt,
+		ExpiresAt:             dbSessInfo.ExpiresAt,
+		Qos:                   dbSessInfo.Qos,
+		UePorts:               dbSessInfo.UePorts,
+		AsPorts:               dbSessInfo.AsPorts,
+		NotificationUri:       dbSessInfo.NotificationUri,
+		NotificationAuthToken: dbSessInfo.NotificationAuthToken,
+		Messages:              dbSessInfo.Messages,
+	}
+	sessionInfo.UeId.Ipv4addr = dbSessInfo.UeId.Ipv4addr
+	sessionInfo.UeId.Msisdn = dbSessInfo.UeId.Msisdn
+	sessionInfo.UeId.ExternalId = dbSessInfo.UeId.ExternalId
+	sessionInfo.AsId.Ipv4addr = dbSessInfo.AsId.Ipv4addr
+
+	return &sessionInfo
 }
+
+// ConvertServiceToSpecSessionInfo is ConvertDbToSpecSessionInfo including the IPv6 addresses
+func ConvertServiceToSpecSessionInfo(session *QoDServiceSession) *api.SessionInfo {
+	sessionInfo := ConvertDbToSpecSessionInfo(&session.ServiceQoDUeSession)
+	if session.UeIpv6Addr != "" {
+		SetUeIpv6Addr(&sessionInfo.UeId, session.UeIpv6Addr)
+	}
+	if session.AsIpv6Addr != "" {
+		SetAsIpv6Addr(&sessionInfo.AsId, session.AsIpv6Addr)
+	}
+	return sessionInfo
+}
+
+// ParseNefSubscriptionResource returns the scsAsId and subscriptionId of a NEF
+// subscription resource URI {apiRoot}/3gpp-as-session-with-qos/v1/{scsAsId}/subscriptions/{subscriptionId}
+func ParseNefSubscriptionResource(resource string) (scsAsId, subscriptionId string, err error) {
+	idx := strings.LastIndex(resource, "/subscriptions/")
+	if idx < 0 {
+		return "", "", fmt.Errorf("no subscriptions/ in nef subscription resource %s", resource)
+	}
+	subscriptionId = strings.Trim(resource[idx+len("/subscriptions/"):], "/")
+	scsAsId = resource[:idx]
+	scsAsId = scsAsId[strings.LastIndex(scsAsId, "/")+1:]
+	if scsAsId == "" || subscriptionId == "" {
+		return "", "", fmt.Errorf("no scsAsId or subscriptionId in nef subscription resource %s", resource)
+	}
+	return scsAsId, subscriptionId, nil
+}
+
 func ExtractSubstr(sourceStr, startMarkerStr, endMarkerStr string) (string, error) {
 	if idx := strings.Index(sourceStr, startMarkerStr); idx >= 0 {
 		result := sourceStr[idx+len(startMarkerStr):]
@@ -0,0 +1,276 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Some defaults when the values are not configured
+const (
+	vaultDefaultKvMount  = "secret"
+	vaultDefaultPkiMount = "pki"
+	vaultDefaultTimeout  = 10 * time.Second
+)
+
+// Config of the HashiCorp Vault backend
+type VaultConfig struct {
+	Address  string        // e.g. https://vault:8200. VAULT_ADDR if empty
+	Token    string        // VAULT_TOKEN if empty
+	CaCert   string        // PEM file of the CA Vault is verified with. System CAs if empty
+	KvMount  string        // Mount of the KV v2 secrets engine. secret if empty
+	PkiMount string        // Mount of the PKI secrets engine. pki if empty
+	PkiRole  string        // The cert & key are issued by the PKI engine with the role instead of read from KV
+	PkiTtl   string        // TTL of the issued certs (e.g. 720h). The one of the role if empty
+	Timeout  time.Duration // Timeout of a request to Vault
+}
+
+// With KV, the cert & key are the certificate & private_key of the KV secret at
+// certPath and the root CA is the ca of the one at rootCaPath. With PKI, the cert &
+// key are issued with certPath as common_name and renewed after two thirds of their
+// lifetime, and the root CA is the CA of the PKI mount at rootCaPath.
+type credFromVault struct {
+	conf       *VaultConfig
+	cli        *http.Client
+	certPath   string
+	rootCaPath string
+	renewAt    time.Time // When a cert issued by PKI is to be renewed
+	mTls       MTlsCred
+}
+
+// RegisterVaultCredentialReader selects Vault with env vault
+func RegisterVaultCredentialReader(conf VaultConfig) error {
+	if conf.Address == "" {
+		conf.Address = os.Getenv("VAULT_ADDR")
+	}
+	if conf.Address == "" {
+		return errors.New("vault address missing")
+	}
+	conf.Address = strings.TrimSuffix(conf.Address, "/")
+	if conf.Token == "" {
+		conf.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if conf.KvMount == "" {
+		conf.KvMount = vaultDefaultKvMount
+	}
+	if conf.PkiMount == "" {
+		conf.PkiMount = vaultDefaultPkiMount
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = vaultDefaultTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.CaCert != "" {
+		caCert, err := ioutil.ReadFile(conf.CaCert)
+		if err != nil {
+			return fmt.Errorf("failed to read vault CA. error %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return errors.New("no PEM certificate in vault CA")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	cli := &http.Client{
+		Transport: transport,
+		Timeout:   conf.Timeout,
+	}
+
+	RegisterCredentialReader(ENV_VAULT, func(certPath, rootCaPath string) (CredentialReader, error) {
+		return &credFromVault{
+			conf:       &conf,
+			cli:        cli,
+			certPath:   certPath,
+			rootCaPath: rootCaPath,
+		}, nil
+	})
+	return nil
+}
+
+// Sends the request to the Vault API and returns the body of the response
+func (c *credFromVault) request(method, path string, body interface{}) ([]byte, error) {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, c.conf.Address+"/v1/"+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", c.conf.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		vaultErr := struct {
+			Errors []string `json:"errors"`
+		}{}
+		json.Unmarshal(respBody, &vaultErr)
+		return nil, fmt.Errorf("vault %v %v: %v %v", method, path, resp.Status, strings.Join(vaultErr.Errors, ", "))
+	}
+	return respBody, nil
+}
+
+// The data of the KV v2 secret at path
+func (c *credFromVault) readKv(path string) (map[string]string, error) {
+	respBody, err := c.request(http.MethodGet, c.conf.KvMount+"/data/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	secret := struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}{}
+	if err = json.Unmarshal(respBody, &secret); err != nil {
+		return nil, fmt.Errorf("bad vault secret %v. error %v", path, err)
+	}
+	return secret.Data.Data, nil
+}
+
+// Issues the cert & key by the PKI engine
+func (c *credFromVault) issuePki() error {
+	issueReq := map[string]string{"common_name": c.certPath}
+	if c.conf.PkiTtl != "" {
+		issueReq["ttl"] = c.conf.PkiTtl
+	}
+	respBody, err := c.request(http.MethodPost, c.conf.PkiMount+"/issue/"+c.conf.PkiRole, issueReq)
+	if err != nil {
+		return err
+	}
+	issued := struct {
+		Data struct {
+			Certificate string   `json:"certificate"`
+			PrivateKey  string   `json:"private_key"`
+			IssuingCa   string   `json:"issuing_ca"`
+			CaChain     []string `json:"ca_chain"`
+		} `json:"data"`
+	}{}
+	if err = json.Unmarshal(respBody, &issued); err != nil {
+		return fmt.Errorf("bad vault PKI response. error %v", err)
+	}
+	block, _ := pem.Decode([]byte(issued.Data.Certificate))
+	if block == nil || issued.Data.PrivateKey == "" {
+		return errors.New("no cert & key in vault PKI response")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("bad cert in vault PKI response. error %v", err)
+	}
+	// The intermediate CAs follow the cert. The chain is given by newer Vaults only.
+	caChain := issued.Data.CaChain
+	if len(caChain) == 0 {
+		caChain = []string{issued.Data.IssuingCa}
+	}
+	var caCerts []*x509.Certificate
+	for _, caPem := range caChain {
+		rest := []byte(caPem)
+		for {
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			caCert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("bad CA in vault PKI response. error %v", err)
+			}
+			caCerts = append(caCerts, caCert)
+		}
+	}
+	c.renewAt = cert.NotBefore.Add(cert.NotAfter.Sub(cert.NotBefore) * 2 / 3)
+	c.mTls.myCert = append([]byte(strings.TrimSpace(issued.Data.Certificate)+"\n"),
+		encodeCertificates(intermediateCerts(caCerts))...)
+	c.mTls.myKey = []byte(issued.Data.PrivateKey)
+	return nil
+}
+
+// The cert & key are read together here. A cert issued by PKI is kept until it is
+// to be renewed, it is not issued again at every read.
+func (c *credFromVault) ReadMyCert() error {
+	if c.conf.PkiRole != "" {
+		if len(c.mTls.myCert) != 0 && time.Now().Before(c.renewAt) {
+			return nil
+		}
+		return c.issuePki()
+	}
+	data, err := c.readKv(c.certPath)
+	if err != nil {
+		return err
+	}
+	if data["certificate"] == "" || data["private_key"] == "" {
+		return fmt.Errorf("no certificate & private_key in vault secret %v", c.certPath)
+	}
+	c.mTls.myCert = []byte(data["certificate"])
+	c.mTls.myKey = []byte(data["private_key"])
+	return nil
+}
+
+func (c *credFromVault) ReadMyKey() error {
+	if len(c.mTls.myKey) == 0 {
+		return fmt.Errorf("no private_key of %v in vault", c.certPath)
+	}
+	return nil
+}
+
+func (c *credFromVault) ReadRootCA() error {
+	if c.conf.PkiRole != "" {
+		mount := c.rootCaPath
+		if mount == "" {
+			mount = c.conf.PkiMount
+		}
+		rootCA, err := c.request(http.MethodGet, mount+"/ca/pem", nil)
+		if err != nil {
+			return err
+		}
+		c.mTls.rootCA = rootCA
+		return nil
+	}
+	data, err := c.readKv(c.rootCaPath)
+	if err != nil {
+		return err
+	}
+	if data["ca"] == "" {
+		return fmt.Errorf("no ca in vault secret %v", c.rootCaPath)
+	}
+	c.mTls.rootCA = []byte(data["ca"])
+	return nil
+}
+
+func (c *credFromVault) ReturnAll() *MTlsCred {
+	return &c.mTls
+}
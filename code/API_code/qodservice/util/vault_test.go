@@ -0,0 +1,226 @@
+// Copyright 2023 Spry Fox Networks
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testVaultToken = "test-token"
+
+// fakeVault answers the KV v2 reads, the PKI issues and the PKI CA of Vault
+type fakeVault struct {
+	t       *testing.T
+	kv      map[string]map[string]string
+	ca      *testCert
+	issue   func() *testCert // The cert issued by PKI
+	caChain []*testCert      // Of the issued cert
+	issued  int
+	issueCn string
+	ttl     string
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != testVaultToken {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		data, ok := f.kv[strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"data": data},
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/pki/issue/qod":
+		issueReq := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&issueReq); err != nil {
+			f.t.Errorf("bad PKI issue request: %v", err)
+		}
+		f.issued++
+		f.issueCn = issueReq["common_name"]
+		f.ttl = issueReq["ttl"]
+		cert := f.issue()
+		data := map[string]interface{}{
+			// Vault gives the PEMs without the trailing newline
+			"certificate": strings.TrimSpace(string(cert.certPem)),
+			"private_key": string(cert.keyPem),
+		}
+		if len(f.caChain) != 0 {
+			var caChain []string
+			for _, caCert := range f.caChain {
+				caChain = append(caChain, strings.TrimSpace(string(caCert.certPem)))
+			}
+			data["issuing_ca"] = caChain[0]
+			data["ca_chain"] = caChain
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/pki/ca/pem":
+		w.Write(f.ca.certPem)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[]}`))
+	}
+}
+
+func newFakeVault(t *testing.T, conf VaultConfig) *fakeVault {
+	t.Helper()
+	f := &fakeVault{t: t, kv: map[string]map[string]string{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	conf.Address = srv.URL + "/"
+	if conf.Token == "" {
+		conf.Token = testVaultToken
+	}
+	if err := RegisterVaultCredentialReader(conf); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestVaultKvCredentials(t *testing.T) {
+	server, ca := newTestServerCert(t)
+
+	tests := []struct {
+		name    string
+		token   string
+		kv      map[string]map[string]string
+		wantErr string
+	}{
+		{
+			name: "cert, key & CA",
+			kv: map[string]map[string]string{
+				"qod/tls": {"certificate": string(server.certPem), "private_key": string(server.keyPem)},
+				"qod/ca":  {"ca": string(ca.certPem)},
+			},
+		},
+		{
+			name: "no private_key",
+			kv: map[string]map[string]string{
+				"qod/tls": {"certificate": string(server.certPem)},
+				"qod/ca":  {"ca": string(ca.certPem)},
+			},
+			wantErr: "no certificate & private_key in vault secret qod/tls",
+		},
+		{
+			name: "no ca",
+			kv: map[string]map[string]string{
+				"qod/tls": {"certificate": string(server.certPem), "private_key": string(server.keyPem)},
+				"qod/ca":  {},
+			},
+			wantErr: "no ca in vault secret /qod/ca",
+		},
+		{
+			name:    "permission denied",
+			token:   "bad-token",
+			wantErr: "403 Forbidden permission denied",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeVault(t, VaultConfig{Token: tt.token})
+			f.kv = tt.kv
+
+			m, err := GetTlsCredentials(ENV_VAULT, "qod/tls", "/qod/ca")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("GetTlsCredentials: error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetTlsCredentials: %v", err)
+			}
+			if !bytes.Equal(m.GetMyCert(), server.certPem) || !bytes.Equal(m.GetMyKey(), server.keyPem) {
+				t.Error("cert & key are not the ones of the secret")
+			}
+			if !bytes.Equal(m.GetRootCA(), ca.certPem) {
+				t.Error("root CA is not the one of the secret")
+			}
+		})
+	}
+}
+
+func TestVaultPkiCredentials(t *testing.T) {
+	ca := newTestCert(t, "Test CA", true, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour), nil)
+
+	tests := []struct {
+		name       string
+		notBefore  time.Duration // Relative to now
+		notAfter   time.Duration
+		wantIssued int // After two reads
+	}{
+		{"kept before two thirds of the lifetime", -time.Hour, 2 * time.Hour, 1},
+		{"renewed after two thirds of the lifetime", -2 * time.Hour, 30 * time.Minute, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeVault(t, VaultConfig{PkiRole: "qod", PkiTtl: "3h"})
+			f.ca = ca
+			f.issue = func() *testCert {
+				return newTestCert(t, "qod.example", false, time.Now().Add(tt.notBefore), time.Now().Add(tt.notAfter), ca)
+			}
+
+			c, err := newCredentialReader(ENV_VAULT, "qod.example", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := getCertAndKey(c); err != nil {
+					t.Fatalf("read %v: %v", i, err)
+				}
+			}
+			if f.issued != tt.wantIssued {
+				t.Errorf("issued %v times, want %v", f.issued, tt.wantIssued)
+			}
+			if f.issueCn != "qod.example" || f.ttl != "3h" {
+				t.Errorf("issued with common_name %q & ttl %q", f.issueCn, f.ttl)
+			}
+			if err := c.ReadRootCA(); err != nil {
+				t.Fatalf("ReadRootCA: %v", err)
+			}
+			if !bytes.Equal(c.ReturnAll().GetRootCA(), ca.certPem) {
+				t.Error("root CA is not the CA of the PKI mount")
+			}
+		})
+	}
+}
+
+func TestVaultPkiIntermediateCA(t *testing.T) {
+	server, intermediate, root := newTestChainCert(t)
+	f := newFakeVault(t, VaultConfig{PkiRole: "qod"})
+	f.issue = func() *testCert { return server }
+	f.caChain = []*testCert{intermediate, root}
+
+	m, err := GetTlsCredentialsWithoutRootCA(ENV_VAULT, "qod.example")
+	if err != nil {
+		t.Fatalf("GetTlsCredentialsWithoutRootCA: %v", err)
+	}
+	if want := append(append([]byte{}, server.certPem...), intermediate.certPem...); !bytes.Equal(m.GetMyCert(), want) {
+		t.Errorf("cert is not followed by the intermediate CA only:\n%s", m.GetMyCert())
+	}
+	verifyTestChain(t, m.GetMyCert(), m.GetMyKey(), root)
+}
@@ -11,5 +11,19 @@ var doc = {
 printjson(doc)
 db.camara.qod.provisionedData.session.insertOne(doc)
 
+// An AS reachable over IPv6 is provisioned with 'asIpv6Addr' instead of 'asIpv4Addr', in canonical form (RFC 5952)
+var docIpv6 = {
+    "asIpv6Addr": "2001:db8:10:1::100", // This is the asId->ipv6addr to be used by QoD Client while accessing QoD Service
+    "scsAsId": "spryfoxnetworks",
+    "qosMap": {
+        "QOS_E": "qos-66",
+        "QOS_S": "qos-77",
+        "QOS_M": "qos-88",
+        "QOS_L": "qos-99"
+    },
+}
+printjson(docIpv6)
+db.camara.qod.provisionedData.session.insertOne(docIpv6)
+
 // Add more entries as appropriate
 